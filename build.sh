@@ -1,6 +1,13 @@
 #!/bin/bash
+# NFTBUILD=/path/to/nftbuild embeds that script, see cmd/embedded/nftbuild/README
+tags=""
+if [ -n "$NFTBUILD" ]; then
+    cp "$NFTBUILD" cmd/embedded/nftbuild/nftbuild || exit 1
+    echo "Embedding nftbuild, SHA-256 $(sha256sum cmd/embedded/nftbuild/nftbuild | cut -d' ' -f1)"
+    tags="-tags nftbuild_embed"
+fi
 echo "Building for Linux (amd64)..."
-GOOS=linux GOARCH=amd64 go build -o qcd-linux main.go
+GOOS=linux GOARCH=amd64 go build $tags -o qcd-linux main.go
 if [ $? -eq 0 ]; then
     echo "Build successful: qcd-linux"
 else
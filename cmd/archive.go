@@ -0,0 +1,348 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ttacon/chalk"
+)
+
+// archiveSkip records a path that could not be (fully) added to an archive.
+type archiveSkip struct {
+	Path string
+	Err  error
+}
+
+// archiveStats summarises what ended up in an archive.
+type archiveStats struct {
+	Entries   int
+	Bytes     int64
+	Unchanged int
+	Skipped   []archiveSkip
+	Manifest  *backupManifest
+}
+
+// archiveOptions controls what writeArchive puts in an archive.
+type archiveOptions struct {
+	// Paths left out of the archive, along with anything below them
+	Exclude []string
+	// Globs for paths to leave out, see matchesExclude
+	ExcludePatterns []string
+	// Print every archived path
+	Verbose bool
+	// Store extended attributes (ACLs, SELinux labels, capabilities) as PAX records
+	Xattrs bool
+	// Manifest of the backup this one builds on. When set only files that changed since
+	// then are stored, everything else is referenced from the earlier archives.
+	Previous *backupManifest
+}
+
+// fileID identifies an inode so hard links are stored once.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type archiveWriter struct {
+	tw       *tar.Writer
+	verbose  bool
+	xattrs   bool
+	excluded map[string]bool
+	patterns []string
+	links    map[fileID]string
+	previous map[string]manifestEntry
+	stats    archiveStats
+}
+
+// writeArchive writes a gzipped tarball of targets to tarName in-process, keeping
+// ownership, modes, symlinks, hard links and mtimes. Files that can't be read are
+// reported and skipped instead of failing the whole archive.
+func writeArchive(tarName string, targets []string, opts archiveOptions) (*archiveStats, error) {
+	partName := tarName + ".part"
+	out, err := os.OpenFile(partName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the stream as it hits the disk (after encryption) for the manifest
+	archiveHash := sha256.New()
+	enc, err := encryptBackup(io.MultiWriter(out, archiveHash))
+	if err != nil {
+		out.Close()
+		os.Remove(partName)
+		return nil, err
+	}
+	gz := gzip.NewWriter(enc)
+	aw := &archiveWriter{
+		tw:       tar.NewWriter(gz),
+		verbose:  opts.Verbose,
+		xattrs:   opts.Xattrs,
+		excluded: make(map[string]bool),
+		patterns: opts.ExcludePatterns,
+		links:    make(map[fileID]string),
+	}
+	aw.stats.Manifest = &backupManifest{
+		Version: manifestVersion,
+		Archive: filepath.Base(tarName),
+		Created: time.Now().UTC(),
+		Xattrs:  opts.Xattrs && xattrsSupported,
+	}
+	if opts.Previous != nil {
+		aw.previous = previousState(opts.Previous)
+		aw.stats.Manifest.Incremental = true
+		aw.stats.Manifest.Parent = opts.Previous.Archive
+	}
+	for _, path := range append([]string{partName}, opts.Exclude...) {
+		if abs, err := filepath.Abs(path); err == nil {
+			aw.excluded[abs] = true
+		}
+	}
+
+	err = aw.addTargets(targets)
+	if err == nil {
+		err = aw.tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(partName, tarName)
+	}
+	if err != nil {
+		os.Remove(partName)
+		return nil, err
+	}
+
+	info, err := os.Stat(tarName)
+	if err != nil {
+		return nil, err
+	}
+	aw.stats.Manifest.ArchiveSize = info.Size()
+	aw.stats.Manifest.ArchiveSHA256 = hex.EncodeToString(archiveHash.Sum(nil))
+	return &aw.stats, nil
+}
+
+func (aw *archiveWriter) addTargets(targets []string) error {
+	for _, target := range targets {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			aw.skip(target, err)
+			continue
+		}
+		if err := filepath.Walk(abs, aw.walk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk is the filepath.WalkFunc for archiveWriter. Per-file problems are recorded and
+// swallowed; only errors writing the archive itself are returned.
+func (aw *archiveWriter) walk(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		aw.skip(path, err)
+		return nil
+	}
+	if aw.excluded[path] || matchesExclude(path, aw.patterns) {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	return aw.add(path, info)
+}
+
+func (aw *archiveWriter) add(path string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			aw.skip(path, err)
+			return nil
+		}
+		link = target
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		// Sockets and other special files tar can't represent
+		aw.skip(path, err)
+		return nil
+	}
+	hdr.Name = archiveName(path, info.IsDir())
+	// PAX keeps sub-second mtimes and long names; atime/ctime can't be restored anyway
+	hdr.Format = tar.FormatPAX
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if aw.xattrs {
+		attrs, err := readXattrs(path)
+		if err != nil {
+			fmt.Println(NewMessage(chalk.Yellow, "Could not read extended attributes of "+path+": "+err.Error()))
+		}
+		setHeaderXattrs(hdr, attrs)
+	}
+
+	var file *os.File
+	entry := newManifestEntry(hdr)
+	if info.Mode().IsRegular() {
+		id, hasLinks := statFileID(info)
+		if first, seen := aw.links[id]; hasLinks && seen {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			entry = newManifestEntry(hdr)
+		} else if prev, ok := aw.previous[entry.Path]; ok && aw.unchanged(path, entry, prev) {
+			// Content lives in an earlier archive of the chain
+			entry.SHA256 = prev.SHA256
+			entry.Archive = prev.Archive
+			aw.stats.Manifest.Entries = append(aw.stats.Manifest.Entries, entry)
+			aw.stats.Unchanged++
+			if hasLinks {
+				aw.links[id] = hdr.Name
+			}
+			return nil
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			// Open before writing the header so permission errors don't leave a
+			// half-written entry behind
+			file, err = os.Open(path)
+			if err != nil {
+				aw.skip(path, err)
+				return nil
+			}
+			defer file.Close()
+			if hasLinks {
+				aw.links[id] = hdr.Name
+			}
+		}
+	}
+
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write header for %s: %w", path, err)
+	}
+
+	var readErr error
+	if file != nil {
+		// Hash exactly what goes into the archive, padding included
+		h := sha256.New()
+		w := io.MultiWriter(aw.tw, h)
+		written, err := io.CopyN(w, file, hdr.Size)
+		aw.stats.Bytes += written
+		if err != nil {
+			// The header promised hdr.Size bytes; pad so the archive stays readable
+			if _, perr := io.CopyN(w, zeroReader{}, hdr.Size-written); perr != nil {
+				return fmt.Errorf("failed to write %s: %w", path, perr)
+			}
+			readErr = fmt.Errorf("only %d of %d bytes could be read: %w", written, hdr.Size, err)
+		}
+		entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	aw.stats.Manifest.Entries = append(aw.stats.Manifest.Entries, entry)
+	if readErr != nil {
+		aw.skip(path, readErr)
+		return nil
+	}
+
+	aw.stats.Entries++
+	if aw.verbose {
+		fmt.Println(NewMessage(chalk.White, "Archived "+path))
+	}
+	return nil
+}
+
+// unchanged reports whether a regular file's content still matches its entry in the
+// previous backup. A file of the same size is always hashed, the mtime is easily reset
+// with touch -r after tampering. Mode and ownership don't matter here, they are recorded
+// in the manifest either way.
+func (aw *archiveWriter) unchanged(path string, entry, prev manifestEntry) bool {
+	if prev.Type != entry.Type || prev.Size != entry.Size || prev.SHA256 == "" {
+		return false
+	}
+	sum, _, err := hashFile(path)
+	return err == nil && sum == prev.SHA256
+}
+
+func (aw *archiveWriter) skip(path string, err error) {
+	aw.stats.Skipped = append(aw.stats.Skipped, archiveSkip{Path: path, Err: err})
+	fmt.Println(NewMessage(chalk.Yellow, "Skipping "+path+": "+err.Error()))
+}
+
+// archiveName converts an absolute path into a tar entry name the same way GNU tar
+// does: leading slashes are stripped, and directories get a trailing slash.
+func archiveName(path string, isDir bool) string {
+	name := strings.TrimLeft(filepath.ToSlash(path), "/")
+	if name == "" {
+		return "./"
+	}
+	if isDir && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return name
+}
+
+// statFileID returns the inode of files with more than one link.
+func statFileID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// walkArchive streams every entry of a gzipped (and possibly encrypted) tarball to fn.
+// The reader passed to fn is only valid until fn returns.
+func walkArchive(tarName string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := openBackupFile(tarName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tarName, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", tarName, err)
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIncrementalHashesUnchangedLookingFiles(t *testing.T) {
+	useConfig(t, nil)
+	src, dest := t.TempDir(), t.TempDir()
+	stamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := map[string]string{"same": "a=1\n", "tampered": "b=1\n", "touched": "c=1\n"}
+	for name, body := range files {
+		path := filepath.Join(src, name)
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full, err := writeArchive(filepath.Join(dest, fullBackupPrefix+"20240102_030405.tar.gz"), []string{src}, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and mtime put back, as with touch -r
+	tampered := filepath.Join(src, "tampered")
+	if err := os.WriteFile(tampered, []byte("b=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tampered, stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+	// Only the mtime changed
+	later := stamp.Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "touched"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	inc, err := writeArchive(filepath.Join(dest, incrementalBackupPrefix+"20240102_040405.tar.gz"), []string{src}, archiveOptions{Previous: full.Manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inc.Unchanged != 2 {
+		t.Errorf("%d files referenced from the full backup, want 2", inc.Unchanged)
+	}
+	for _, e := range inc.Manifest.Entries {
+		if e.Path != tampered {
+			continue
+		}
+		if e.Archive != "" {
+			t.Errorf("tampered file referenced from %s instead of stored", e.Archive)
+		}
+		return
+	}
+	t.Errorf("tampered file missing from the incremental manifest")
+}
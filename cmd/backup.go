@@ -4,7 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -12,58 +13,136 @@ import (
 	"github.com/ttacon/chalk"
 )
 
+// Timestamp layout used in backup file names, e.g. bak_20240301_091500.tar.gz
+const backupTimeLayout = "20060102_150405"
+
+// Name prefixes of full and incremental backups
+const (
+	fullBackupPrefix        = "bak_"
+	incrementalBackupPrefix = "inc_"
+)
+
 var installRestic bool
+var resticBundle string
 var skipTar bool
+var verboseBackup bool
+var incrementalBackup bool
 
 var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "Backup critical services",
-	Long:  `Backs up configurations. Can automatically download and configure restic and resticprofile for robust backups.`,
+	Long: `Backs up configurations. Can automatically download (or install from an offline --bundle) and configure restic and resticprofile for robust backups.
+Downloaded or bundled restic releases are only installed when their SHA-256 is pinned in backup.restic.checksums (sha256sum lines); backup.restic.allow_unpinned overrides that.
+Everything in backup.targets is backed up, plus the targets, excludes and hooks of the backup.profiles entry matching --sys, or of every profile whose service is detected on this box. A warning is printed when a profile excludes part of a backup.targets entry.
+Commands in backup.hooks.pre run first (e.g. mysqldump or pg_dumpall), and anything they write to their output file in backup.hooks.dir is backed up too. backup.hooks.post runs afterwards with $QCD_BACKUP_ARCHIVE and $QCD_BACKUP_STATUS set.
+Each new backup is copied to every backup.replicas entry (an sftp:// server or another box running backup receive) and verified there; a failed copy fails the run.
+Set backup.hide to move the store out of ./backups into a random hidden directory under backup.hide_root, and backup.immutable to chattr +i every finished backup (prune clears the flag before removing one). qcd monitor reports anything that touches the store.
+Use backup schedule to run this periodically and backup status to see how the last run went.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println(NewMessage(chalk.Green, "Starting Backup Process..."))
+		plan, err := resolveBackupPlan()
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		if len(plan.Profiles) > 0 {
+			fmt.Println(NewMessage(chalk.Blue, "Using backup profile(s):").ThenColor(chalk.White, strings.Join(plan.Profiles, ", ")))
+		}
+
+		lock, err := lockBackup()
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		defer lock.Close()
+
+		run := backupRunStatus{Started: time.Now().UTC(), Status: "running"}
+		recordBackupRun(run)
+		var problems []string
+
+		// Dump databases and services first so the dumps end up in the backup
+		if err := runBackupHooks("pre", nil); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Backup aborted: "+err.Error()))
+			runPostHooks("", "failed")
+			run.Finished, run.Status, run.Error = time.Now().UTC(), "failed", err.Error()
+			recordBackupRun(run)
+			os.Exit(1)
+		}
 
 		// 1. Basic Tarball Backup of Configs
 		if !skipTar {
-			backupConfigs()
+			archive, err := backupConfigs(incrementalBackup || viper.GetBool("backup.incremental"))
+			if err != nil {
+				fmt.Println(NewMessage(chalk.Red, err.Error()))
+				problems = append(problems, err.Error())
+			}
+			run.Archive = archive
 		} else {
 			fmt.Println(NewMessage(chalk.Yellow, "Skipping tarball backup"))
 		}
 
 		// 2. Restic Integration
 		if installRestic {
-			if err := setupRestic(); err != nil {
+			bundle := resticBundle
+			if bundle == "" {
+				bundle = viper.GetString("backup.restic.bundle")
+			}
+			if err := setupRestic(bundle); err != nil {
 				fmt.Println(NewMessage(chalk.Red, "Restic Setup Failed: "+err.Error()))
+				problems = append(problems, "restic setup: "+err.Error())
 			} else {
 				fmt.Println(NewMessage(chalk.Green, "Restic Setup Complete. Running Backup Profile..."))
-				RunCommand("resticprofile", "backup", "default")
-				RunCommand("resticprofile", "schedule", "default")
+				if err := RunCommand("resticprofile", resticprofileArgs("backup")...); err != nil {
+					problems = append(problems, "restic backup: "+err.Error())
+				}
+				RunCommand("resticprofile", resticprofileArgs("schedule")...)
 			}
 		}
+
+		run.Status = "success"
+		if len(problems) > 0 {
+			run.Status = "failed"
+			run.Error = strings.Join(problems, "; ")
+		}
+		runPostHooks(run.Archive, run.Status)
+		run.Finished = time.Now().UTC()
+		recordBackupRun(run)
+		if run.Status != "success" {
+			os.Exit(1)
+		}
 	},
 }
 
+// runPostHooks runs the post-backup hooks, telling them which archive was written and
+// whether the backup succeeded.
+func runPostHooks(archive, status string) {
+	env := []string{"QCD_BACKUP_ARCHIVE=" + archive, "QCD_BACKUP_STATUS=" + status}
+	if err := runBackupHooks("post", env); err != nil {
+		fmt.Println(NewMessage(chalk.Red, err.Error()))
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(backupCmd)
 	backupCmd.Flags().BoolVarP(&installRestic, "restic", "r", false, "Install and configure restic/resticprofile")
+	backupCmd.Flags().StringVar(&resticBundle, "bundle", "", "Install restic/resticprofile from this directory or tarball instead of downloading")
 	backupCmd.Flags().BoolVarP(&skipTar, "skip-tar", "s", false, "Skip basic tarball backup")
+	backupCmd.Flags().BoolVarP(&verboseBackup, "verbose", "v", false, "Print every file as it is archived")
+	backupCmd.Flags().BoolVarP(&incrementalBackup, "incremental", "i", false, "Only store files changed since the last backup")
 }
 
-func backupConfigs() {
-	dest := viper.GetString("backup.dest")
+// backupConfigs writes a tarball of the backup targets and returns its path.
+func backupConfigs(incremental bool) (string, error) {
+	if err := hideBackupDest(); err != nil {
+		return "", err
+	}
+	dest := backupDest()
 
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
 		os.MkdirAll(dest, 0755)
 	}
 
-	targets := viper.GetStringSlice("backup.targets")
-	if len(targets) == 0 {
-		// Fallback if config is missing or empty
-		targets = []string{"/etc/dovecot", "/etc/postfix", "/opt/splunk", "/var/www"}
-	}
-
 	actualTargets := []string{}
 
-	for _, target := range targets {
+	for _, target := range append(backupTargets(), hookTargets()...) {
 		if _, err := os.Stat(target); os.IsNotExist(err) {
 			fmt.Println(NewMessage(chalk.Yellow, "Warning: Target "+target+" does not exist, skipping..."))
 		} else {
@@ -71,107 +150,166 @@ func backupConfigs() {
 		}
 	}
 
-	timestamp := time.Now().Format("20060102_150405")
-	tarName := filepath.Join(dest, fmt.Sprintf("bak_%s.tar.gz", timestamp))
+	opts := archiveOptions{
+		Exclude:         []string{dest},
+		ExcludePatterns: backupExcludes(),
+		Verbose:         verboseBackup,
+		Xattrs:          backupXattrs(),
+	}
+	prefix := fullBackupPrefix
+	if incremental {
+		base, err := incrementalBase(dest)
+		if err != nil {
+			fmt.Println(NewMessage(chalk.Yellow, "Taking a full backup instead of an incremental: "+err.Error()))
+		} else {
+			opts.Previous = base
+			prefix = incrementalBackupPrefix
+			fmt.Println(NewMessage(chalk.Blue, "Incremental backup on top of "+base.Archive))
+		}
+	}
+
+	timestamp := time.Now().Format(backupTimeLayout)
+	tarName := filepath.Join(dest, fmt.Sprintf("%s%s.tar.gz", prefix, timestamp))
+	if backupEncrypted() {
+		tarName += ".age"
+	}
 
 	fmt.Println(NewMessage(chalk.Blue, "Creating tarball of directories..."))
-	// tar -czf ...
-	args := []string{"-czf", tarName}
-	args = append(args, actualTargets...)
+	stats, err := writeArchive(tarName, actualTargets, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup tarball: %w", err)
+	}
 
-	if err := RunCommand("tar", args...); err != nil {
-		fmt.Println(NewMessage(chalk.Red, "Failed to create backup tarball: "+err.Error()))
-	} else {
-		fmt.Println(NewMessage(chalk.Green, "Backup created at "+tarName))
+	if err := writeManifest(stats.Manifest, manifestPath(tarName)); err != nil {
+		// Without a manifest the archive can't be verified or used as an incremental base,
+		// so it must not be replicated or count as a backup
+		os.Remove(tarName)
+		os.Remove(manifestPath(tarName))
+		return "", fmt.Errorf("failed to write backup manifest, removed %s: %w", tarName, err)
 	}
+	protectBackup(tarName)
+
+	fmt.Println(NewMessage(chalk.Green, "Backup created at "+tarName).
+		ThenColor(chalk.White, fmt.Sprintf("(%d entries, %d bytes)", stats.Entries, stats.Bytes)))
+	if stats.Unchanged > 0 {
+		fmt.Println(NewMessage(chalk.Blue, fmt.Sprintf("%d unchanged file(s) referenced from earlier backups", stats.Unchanged)))
+	}
+	if len(stats.Skipped) > 0 {
+		fmt.Println(NewMessage(chalk.Yellow, fmt.Sprintf("%d path(s) could not be backed up, see warnings above", len(stats.Skipped))))
+	}
+
+	// Get a copy off the box before anything else can go wrong
+	replicaErr := replicateBackups([]string{tarName})
+
+	if err := pruneBackups(false); err != nil {
+		fmt.Println(NewMessage(chalk.Red, "Failed to apply backup retention: "+err.Error()))
+	}
+	return tarName, replicaErr
 }
 
-func setupRestic() error {
-	// Auto-download restic and resticprofile
-	// Assuming Linux amd64 for CCDC usually
-	arch := runtime.GOARCH
-	if arch != "amd64" {
-		return fmt.Errorf("auto-download currently only supports amd64, got %s", arch)
+// backupTargets returns the paths to back up on this box, see resolveBackupPlan.
+func backupTargets() []string {
+	plan, err := resolveBackupPlan()
+	if CheckError(err) {
+		return viper.GetStringSlice("backup.targets")
 	}
+	return plan.Targets
+}
 
-	// URLs (hardcoded for now, should be dynamic in prod)
-	resticUrl := "https://github.com/restic/restic/releases/download/v0.16.4/restic_0.16.4_linux_amd64.bz2"
-	resticProfileUrl := "https://github.com/creativeprojects/resticprofile/releases/download/v0.26.0/resticprofile_0.26.0_linux_amd64.tar.gz"
+// backupExcludes returns the exclude globs of the selected backup profiles.
+func backupExcludes() []string {
+	plan, err := resolveBackupPlan()
+	if err != nil {
+		return viper.GetStringSlice("backup.excludes")
+	}
+	return plan.Excludes
+}
 
-	binDir := "/usr/local/bin"
+// backupFile describes a tarball in the backup destination.
+type backupFile struct {
+	Name        string
+	Path        string
+	Time        time.Time
+	Size        int64
+	Incremental bool
+}
 
-	// Check if installed
-	if err := RunCommand("restic", "version"); err != nil {
-		fmt.Println(NewMessage(chalk.Yellow, "Restic not found. Downloading..."))
-		if err := DownloadFile("/tmp/restic.bz2", resticUrl); err != nil {
-			return err
-		}
-		RunCommand("bzip2", "-d", "/tmp/restic.bz2")
-		RunCommand("install", "-m", "0755", "/tmp/restic", filepath.Join(binDir, "restic"))
+// parseBackupName extracts the timestamp from a backup file name such as
+// bak_20240301_091500.tar.gz or inc_20240301_093000.tar.gz.age.
+func parseBackupName(name string) (time.Time, bool, bool) {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, ".age"), ".tar.gz")
+	if base == strings.TrimSuffix(name, ".age") {
+		return time.Time{}, false, false
 	}
 
-	if err := RunCommand("resticprofile", "version"); err != nil {
-		fmt.Println(NewMessage(chalk.Yellow, "ResticProfile not found. Downloading..."))
-		if err := DownloadFile("/tmp/resticprofile.tar.gz", resticProfileUrl); err != nil {
-			return err
-		}
-		RunCommand("tar", "-xzf", "/tmp/resticprofile.tar.gz", "-C", "/tmp")
-		RunCommand("install", "-m", "0755", "/tmp/resticprofile", filepath.Join(binDir, "resticprofile"))
+	incremental := strings.HasPrefix(base, incrementalBackupPrefix)
+	if !incremental && !strings.HasPrefix(base, fullBackupPrefix) {
+		return time.Time{}, false, false
+	}
+	stamp := strings.TrimPrefix(strings.TrimPrefix(base, fullBackupPrefix), incrementalBackupPrefix)
+	t, err := time.ParseInLocation(backupTimeLayout, stamp, time.Local)
+	if err != nil {
+		return time.Time{}, false, false
 	}
+	return t, incremental, true
+}
 
-	// Configure Profile
-	configPath := "profiles.yaml" // current dir or /etc/resticprofile/profiles.yaml
+// listBackups returns the full and incremental tarballs in dest, oldest first. Encrypted
+// tarballs carry an extra .age suffix.
+func listBackups(dest string) ([]backupFile, error) {
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		return nil, err
+	}
 
-	// Use configured backup destination for restic repo as well
-	dest := viper.GetString("backup.dest")
-	if dest == "" {
-		dest = "./backups"
+	var backups []backupFile
+	for _, entry := range entries {
+		name := entry.Name()
+		t, incremental, ok := parseBackupName(name)
+		if entry.IsDir() || !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{
+			Name:        name,
+			Path:        filepath.Join(dest, name),
+			Time:        t,
+			Size:        info.Size(),
+			Incremental: incremental,
+		})
 	}
-	repoPath := filepath.Join(dest, "restic")
 
-	// Configure Password File
-	passwdPath := "/root/.restic-passwd"
-	// Check if running as root, if not, maybe use current user's home?
-	// CCDC tools usually run as root.
-	if os.Geteuid() != 0 {
-		home, _ := os.UserHomeDir()
-		passwdPath = filepath.Join(home, ".restic-passwd")
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// resolveBackup turns a user supplied archive reference into a path. It accepts a path
+// to an archive, a file name inside backup.dest, or "latest".
+func resolveBackup(ref string) (string, error) {
+	if _, err := os.Stat(ref); err == nil {
+		return ref, nil
 	}
 
-	if _, err := os.Stat(passwdPath); os.IsNotExist(err) {
-		fmt.Println(NewMessage(chalk.Yellow, "Creating restic password file at "+passwdPath))
-		// Using a fixed password for CCDC simplicity/recovery, but safely stored
-		err := os.WriteFile(passwdPath, []byte("changeme_ccdc_password"), 0600)
+	dest := backupDest()
+	if ref == "latest" {
+		backups, err := listBackups(dest)
 		if err != nil {
-			return fmt.Errorf("failed to create password file: %w", err)
+			return "", err
+		}
+		if len(backups) == 0 {
+			return "", fmt.Errorf("no backups found in %s", dest)
 		}
+		return backups[len(backups)-1].Path, nil
 	}
 
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		fmt.Println(NewMessage(chalk.Yellow, "Creating basic resticprofile config..."))
-		configContent := fmt.Sprintf(`
-default:
-  repository: "local:%s"
-  password-file: "%s"
-  initialize: true
-  backup:
-    source:
-      - "/etc/dovecot"
-      - "/etc/postfix"
-      - "/var/www"
-	  - "/opt/splunk"
-    schedule: "*-*-* *:00,15,30,45'"
-    retention:
-      keep-last: 5
-`, repoPath, passwdPath)
-		// Note: Password should be prompted or secure. Using hardcoded for CCDC quick start.
-		os.WriteFile(configPath, []byte(configContent), 0600)
-	}
-
-	// Explicitly try to init to ensure it exists (ignoring error if it already exists)
-	// We do this because auto-init sometimes fails permissions or paths silently if not explicit
-	fmt.Println(NewMessage(chalk.Blue, "Ensuring Restic Repository Initialized..."))
-	RunCommand("resticprofile", "init")
-
-	return nil
+	path := filepath.Join(dest, ref)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("backup %s not found", ref)
+	}
+	return path, nil
 }
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseBackupName(t *testing.T) {
+	stamp := time.Date(2024, 3, 1, 9, 15, 0, 0, time.Local)
+	tests := []struct {
+		name        string
+		ok          bool
+		incremental bool
+	}{
+		{"bak_20240301_091500.tar.gz", true, false},
+		{"bak_20240301_091500.tar.gz.age", true, false},
+		{"inc_20240301_091500.tar.gz", true, true},
+		{"inc_20240301_091500.tar.gz.age", true, true},
+		{"bak_20240301_091500.tar.gz.manifest.json", false, false},
+		{"bak_20240301_091500.tar.gz.part", false, false},
+		{"bak_20240301.tar.gz", false, false},
+		{"full_20240301_091500.tar.gz", false, false},
+		{"bak_20240301_091500.tar", false, false},
+	}
+	for _, tt := range tests {
+		got, incremental, ok := parseBackupName(tt.name)
+		if ok != tt.ok || incremental != tt.incremental {
+			t.Errorf("parseBackupName(%q) = _, %v, %v, want %v, %v", tt.name, incremental, ok, tt.incremental, tt.ok)
+			continue
+		}
+		if ok && !got.Equal(stamp) {
+			t.Errorf("parseBackupName(%q) time = %v, want %v", tt.name, got, stamp)
+		}
+	}
+}
+
+func TestBackupChain(t *testing.T) {
+	tests := []struct {
+		kinds string
+		i     int
+		want  []int
+	}{
+		{"F", 0, []int{0}},
+		{"FII", 2, []int{0, 1, 2}},
+		{"FII", 1, []int{0, 1}},
+		{"FIFI", 3, []int{2, 3}},
+		{"FIFI", 2, []int{2}},
+		// Incrementals left over after their full backup was removed
+		{"IIF", 1, []int{0, 1}},
+	}
+	for _, tt := range tests {
+		if got := backupChain(testBackups(tt.kinds, 1), tt.i); !slices.Equal(got, tt.want) {
+			t.Errorf("backupChain(%s, %d) = %v, want %v", tt.kinds, tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestBackupConfigsWithoutManifest(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "conf"), []byte("a=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// An unreadable signing key makes writeManifest fail after the archive is written
+	keyFile := filepath.Join(t.TempDir(), "manifest.key")
+	if err := os.WriteFile(keyFile, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, map[string]interface{}{
+		"backup.dest":              dest,
+		"backup.targets":           []string{src},
+		"backup.manifest_key_file": keyFile,
+	})
+	systemType = "ftp"
+	t.Cleanup(func() { systemType = "" })
+
+	archive, err := backupConfigs(false)
+	if err == nil {
+		t.Fatalf("backupConfigs succeeded without a manifest: %s", archive)
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s left in the backup destination", e.Name())
+	}
+}
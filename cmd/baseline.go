@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Bump when hostBaseline changes shape, baselines from newer versions are refused
+const baselineVersion = 1
+
+var baselineFile string
+var baselineForce bool
+
+var baselineCmd = &cobra.Command{
+	Use:   "baseline",
+	Short: "Record and compare a known good snapshot of the host's state",
+	Long: `Captures users and groups, sudoers rules, SUID/SGID files, listening ports, enabled services, cron entries, SSH authorized_keys, loaded kernel modules and installed packages into one versioned JSON document.
+Capture it while the box is known good, then run baseline compare to see everything that changed since.`,
+}
+
+var baselineCaptureCmd = &cobra.Command{
+	Use:   "capture",
+	Short: "Record the current host state as the baseline",
+	Run: func(cmd *cobra.Command, args []string) {
+		path := baselinePath()
+		if _, err := os.Stat(path); err == nil && !baselineForce {
+			fmt.Println(NewMessage(chalk.Red, "A baseline already exists at "+path+", use --force to replace it"))
+			os.Exit(1)
+		}
+
+		fmt.Println(NewMessage(chalk.Blue, "Capturing host state..."))
+		b := captureBaseline()
+		if err := writeJSONFile(path, b); CheckError(err) {
+			os.Exit(1)
+		}
+		for _, s := range b.sections() {
+			fmt.Println(NewMessage(chalk.White, fmt.Sprintf("%-16s %d", s.Name, len(s.Items))))
+		}
+		b.printErrors()
+		fmt.Println(NewMessage(chalk.Green, "Baseline saved to "+path))
+	},
+}
+
+var baselineCompareCmd = &cobra.Command{
+	Use:   "compare",
+	Short: "Report what changed on the host since the baseline",
+	Long:  `Captures the current host state and lists everything added, removed or changed compared to the saved baseline. Exits with status 1 when anything differs.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		saved, err := loadBaseline(baselinePath())
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		fmt.Println(NewMessage(chalk.Blue, "Comparing host state against the baseline from "+saved.Captured.Local().Format(time.DateTime)+"..."))
+		current := captureBaseline()
+		current.printErrors()
+
+		if changes := compareBaselines(saved, current); changes > 0 {
+			fmt.Println(NewMessage(chalk.Red, fmt.Sprintf("%d change(s) since the baseline", changes)))
+			os.Exit(1)
+		}
+		fmt.Println(NewMessage(chalk.Green, "Host matches the baseline"))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(baselineCmd)
+	baselineCmd.AddCommand(baselineCaptureCmd)
+	baselineCmd.AddCommand(baselineCompareCmd)
+	baselineCmd.PersistentFlags().StringVarP(&baselineFile, "file", "f", "", "Baseline file (default baseline.file)")
+	baselineCaptureCmd.Flags().BoolVar(&baselineForce, "force", false, "Replace an existing baseline")
+}
+
+// hostBaseline is the saved state of a host. Every section is sorted so the document
+// diffs cleanly.
+type hostBaseline struct {
+	Version        int                `json:"version"`
+	Captured       time.Time          `json:"captured"`
+	Hostname       string             `json:"hostname"`
+	Users          []baselineUser     `json:"users"`
+	Groups         []baselineGroup    `json:"groups"`
+	Sudoers        []baselineLine     `json:"sudoers"`
+	SUID           []baselineSUIDFile `json:"suid"`
+	Listening      []baselineSocket   `json:"listening"`
+	Services       []string           `json:"services"`
+	Cron           []baselineLine     `json:"cron"`
+	AuthorizedKeys []baselineKey      `json:"authorized_keys"`
+	Modules        []string           `json:"modules"`
+	Packages       []baselinePackage  `json:"packages"`
+	// Sections that couldn't be collected, by section name
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type baselineUser struct {
+	Name  string `json:"name"`
+	UID   string `json:"uid"`
+	GID   string `json:"gid"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+}
+
+type baselineGroup struct {
+	Name    string   `json:"name"`
+	GID     string   `json:"gid"`
+	Members []string `json:"members,omitempty"`
+}
+
+// baselineLine is one meaningful line of a config file such as sudoers or a crontab.
+type baselineLine struct {
+	File string `json:"file"`
+	Line string `json:"line"`
+}
+
+type baselineSUIDFile struct {
+	Path   string `json:"path"`
+	Mode   string `json:"mode"`
+	UID    int    `json:"uid"`
+	GID    int    `json:"gid"`
+	SHA256 string `json:"sha256"`
+}
+
+type baselineSocket struct {
+	Proto   string `json:"proto"`
+	Address string `json:"address"`
+	Process string `json:"process,omitempty"`
+}
+
+type baselineKey struct {
+	User        string `json:"user"`
+	File        string `json:"file"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+	Options     string `json:"options,omitempty"`
+}
+
+type baselinePackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// baselineSection is a section flattened to key -> value for comparing.
+type baselineSection struct {
+	Name  string
+	Items map[string]string
+}
+
+func (b *hostBaseline) sections() []baselineSection {
+	users := make(map[string]string)
+	for _, u := range b.Users {
+		users[u.Name] = fmt.Sprintf("uid=%s gid=%s home=%s shell=%s", u.UID, u.GID, u.Home, u.Shell)
+	}
+	groups := make(map[string]string)
+	for _, g := range b.Groups {
+		groups[g.Name] = "gid=" + g.GID + " members=" + strings.Join(g.Members, ",")
+	}
+	suid := make(map[string]string)
+	for _, f := range b.SUID {
+		suid[f.Path] = fmt.Sprintf("%s %d:%d sha256 %s", f.Mode, f.UID, f.GID, f.SHA256)
+	}
+	listening := make(map[string]string)
+	for _, s := range b.Listening {
+		listening[s.Proto+" "+s.Address] = s.Process
+	}
+	keys := make(map[string]string)
+	for _, k := range b.AuthorizedKeys {
+		keys[k.User+" "+k.Type+" "+k.Fingerprint] = strings.TrimSpace(k.Comment + " " + k.Options)
+	}
+	// Some packages (kernels, gpg-pubkey) are installed in several versions at once
+	versions := make(map[string][]string)
+	for _, p := range b.Packages {
+		versions[p.Name] = append(versions[p.Name], p.Version)
+	}
+	packages := make(map[string]string)
+	for name, v := range versions {
+		sort.Strings(v)
+		packages[name] = strings.Join(v, ", ")
+	}
+
+	return []baselineSection{
+		{"users", users},
+		{"groups", groups},
+		{"sudoers", lineItems(b.Sudoers)},
+		{"suid", suid},
+		{"listening", listening},
+		{"services", setItems(b.Services)},
+		{"cron", lineItems(b.Cron)},
+		{"authorized_keys", keys},
+		{"modules", setItems(b.Modules)},
+		{"packages", packages},
+	}
+}
+
+func lineItems(lines []baselineLine) map[string]string {
+	items := make(map[string]string)
+	for _, l := range lines {
+		items[l.File+": "+l.Line] = ""
+	}
+	return items
+}
+
+func setItems(values []string) map[string]string {
+	items := make(map[string]string)
+	for _, v := range values {
+		items[v] = ""
+	}
+	return items
+}
+
+func (b *hostBaseline) printErrors() {
+	names := make([]string, 0, len(b.Errors))
+	for name := range b.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(NewMessage(chalk.Yellow, "Could not collect "+name+": "+b.Errors[name]))
+	}
+}
+
+// compareBaselines prints the differences between two baselines section by section and
+// returns how many there are. Sections either side failed to collect are skipped.
+func compareBaselines(saved, current *hostBaseline) int {
+	changes := 0
+	currentSections := current.sections()
+	for i, old := range saved.sections() {
+		now := currentSections[i]
+		if _, failed := saved.Errors[old.Name]; failed {
+			fmt.Println(NewMessage(chalk.Yellow, "Skipping "+old.Name+", it wasn't collected in the baseline"))
+			continue
+		}
+		if _, failed := current.Errors[old.Name]; failed {
+			fmt.Println(NewMessage(chalk.Yellow, "Skipping "+old.Name+", it couldn't be collected now"))
+			continue
+		}
+
+		var added, removed, changed []string
+		for key, value := range now.Items {
+			oldValue, ok := old.Items[key]
+			switch {
+			case !ok:
+				added = append(added, describeBaselineItem(key, value))
+			case oldValue != value:
+				changed = append(changed, key+": "+oldValue+" -> "+value)
+			}
+		}
+		for key, value := range old.Items {
+			if _, ok := now.Items[key]; !ok {
+				removed = append(removed, describeBaselineItem(key, value))
+			}
+		}
+		if len(added)+len(removed)+len(changed) == 0 {
+			continue
+		}
+
+		sort.Strings(added)
+		sort.Strings(removed)
+		sort.Strings(changed)
+		fmt.Println(NewMessage(chalk.Blue, fmt.Sprintf("%s (%d added, %d removed, %d changed):", old.Name, len(added), len(removed), len(changed))))
+		for _, item := range added {
+			fmt.Println(" + " + item)
+		}
+		for _, item := range removed {
+			fmt.Println(" - " + item)
+		}
+		for _, item := range changed {
+			fmt.Println(" ~ " + item)
+		}
+		changes += len(added) + len(removed) + len(changed)
+	}
+	return changes
+}
+
+func describeBaselineItem(key, value string) string {
+	if value == "" {
+		return key
+	}
+	return key + " (" + value + ")"
+}
+
+// baselinePath returns where the baseline is kept: --file, baseline.file or the state
+// directory.
+func baselinePath() string {
+	if baselineFile != "" {
+		return baselineFile
+	}
+	if path := viper.GetString("baseline.file"); path != "" {
+		return path
+	}
+	return filepath.Join(qcdStateDir(), "baseline.json")
+}
+
+func loadBaseline(path string) (*hostBaseline, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no baseline at %s, run qcd baseline capture first", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := &hostBaseline{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("invalid baseline %s: %w", path, err)
+	}
+	if b.Version > baselineVersion {
+		return nil, fmt.Errorf("baseline %s is version %d, this qcd only understands up to %d", path, b.Version, baselineVersion)
+	}
+	return b, nil
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import "testing"
+
+func TestParseProcNetAddr(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"0100007F:0016", "127.0.0.1:22", false},
+		{"00000000:0050", "0.0.0.0:80", false},
+		{"00000000000000000000000001000000:0277", "[::1]:631", false},
+		{"00000000000000000000000000000000:1F90", "[::]:8080", false},
+		{"0000000000000000FFFF00000100007F:0035", "127.0.0.1:53", false},
+		{"0100007F", "", true},
+		{"0100007:0016", "", true},
+		{"0100007F:GGGG", "", true},
+		{"0100007F:10000", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseProcNetAddr(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseProcNetAddr(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBaselinePackagesKeepEveryVersion(t *testing.T) {
+	old := &hostBaseline{Packages: []baselinePackage{
+		{Name: "kernel.x86_64", Version: "0:5.14.0-362"},
+		{Name: "kernel.x86_64", Version: "0:5.14.0-427"},
+		{Name: "bash.x86_64", Version: "0:5.1.8-6"},
+	}}
+	tests := []struct {
+		name     string
+		packages []baselinePackage
+		changes  int
+	}{
+		{"same set in another order", []baselinePackage{old.Packages[2], old.Packages[1], old.Packages[0]}, 0},
+		{"one version removed", []baselinePackage{old.Packages[1], old.Packages[2]}, 1},
+		{"version added", append([]baselinePackage{{Name: "kernel.x86_64", Version: "0:5.14.0-503"}}, old.Packages...), 1},
+		{"package added", append([]baselinePackage{{Name: "nc.x86_64", Version: "0:7.92-1"}}, old.Packages...), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareBaselines(old, &hostBaseline{Packages: tt.packages}); got != tt.changes {
+				t.Errorf("compareBaselines found %d changes, want %d", got, tt.changes)
+			}
+		})
+	}
+}
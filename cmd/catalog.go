@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/ttacon/chalk"
+)
+
+// Bump when catalogBackup changes so stale caches are rebuilt
+const catalogVersion = 2
+
+const catalogFileName = "catalog.json"
+
+var catalogRefresh bool
+
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the backups in backup.dest",
+	Long: `Lists every backup in backup.dest with its type, size and number of files. The contents are indexed from the manifests (or the archives themselves when a manifest is missing) and cached, so later list and find runs are fast.
+Encrypted backups are never cached, their paths and hashes stay inside the encrypted manifest and are decrypted again on every run.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog, err := loadCatalog(backupDest(), catalogRefresh)
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		printBackupList(catalog.describe)
+	},
+}
+
+var backupFindCmd = &cobra.Command{
+	Use:   "find <path|glob>...",
+	Short: "Show which backups contain a file and how it changed",
+	Long: `Searches every backup for paths matching the arguments (e.g. /etc/passwd, "/etc/postfix/*.cf" or "*.conf" to match by file name) and prints each file's history: size, hash and mtime in every backup that has it.
+Versions are marked + when first seen, * when the content changed and ~ when only permissions or ownership changed.
+Use it to pick the last good version of a tampered file, then restore it with qcd restore <archive> <path>.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog, err := loadCatalog(backupDest(), catalogRefresh)
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		if found := catalog.find(args); found == 0 {
+			fmt.Println(NewMessage(chalk.Yellow, "No backup contains "+strings.Join(args, ", ")))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupListCmd)
+	backupCmd.AddCommand(backupFindCmd)
+	backupListCmd.Flags().BoolVar(&catalogRefresh, "refresh", false, "Re-index every backup instead of using the cache")
+	backupFindCmd.Flags().BoolVar(&catalogRefresh, "refresh", false, "Re-index every backup instead of using the cache")
+}
+
+// catalogBackup is the indexed content of one backup.
+type catalogBackup struct {
+	Name        string          `json:"name"`
+	Time        time.Time       `json:"time"`
+	Size        int64           `json:"size"`
+	FileModTime time.Time       `json:"file_mtime"`
+	Incremental bool            `json:"incremental"`
+	Parent      string          `json:"parent,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Entries     []manifestEntry `json:"entries"`
+}
+
+// encrypted reports whether the backup is age encrypted. Its entries must not be
+// written to the plaintext cache.
+func (b *catalogBackup) encrypted() bool {
+	return strings.HasSuffix(b.Name, ".age")
+}
+
+// backupCatalog indexes the backups of one destination, keyed by archive path.
+type backupCatalog struct {
+	Version int                       `json:"version"`
+	Backups map[string]*catalogBackup `json:"backups"`
+
+	order  []*catalogBackup
+	byName map[string]*catalogBackup
+}
+
+// loadCatalog indexes every backup in dest, reusing cached entries for archives that
+// haven't changed since they were indexed.
+func loadCatalog(dest string, refresh bool) (*backupCatalog, error) {
+	backups, err := listBackups(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return nil, err
+	}
+	cachePath := filepath.Join(qcdStateDir(), catalogFileName)
+	cached := &backupCatalog{}
+	if !refresh {
+		if data, err := os.ReadFile(cachePath); err == nil {
+			if json.Unmarshal(data, cached) != nil || cached.Version != catalogVersion {
+				cached = &backupCatalog{}
+			}
+		}
+	}
+
+	catalog := &backupCatalog{
+		Version: catalogVersion,
+		Backups: make(map[string]*catalogBackup),
+		byName:  make(map[string]*catalogBackup),
+	}
+	// Keep other destinations' entries in the shared cache
+	for key, b := range cached.Backups {
+		if filepath.Dir(key) != absDest && !b.encrypted() {
+			catalog.Backups[key] = b
+		}
+	}
+
+	dirty := len(catalog.Backups) != len(cached.Backups)
+	for _, b := range backups {
+		info, err := os.Stat(b.Path)
+		if err != nil {
+			continue
+		}
+		key := filepath.Join(absDest, b.Name)
+		entry, ok := cached.Backups[key]
+		if !ok || entry.encrypted() || entry.Size != info.Size() || !entry.FileModTime.Equal(info.ModTime()) || entry.Error != "" {
+			entry = indexBackup(b, info)
+			dirty = true
+		}
+		catalog.Backups[key] = entry
+		catalog.order = append(catalog.order, entry)
+		catalog.byName[entry.Name] = entry
+	}
+
+	if dirty {
+		if err := writeStateJSON(catalogFileName, catalog.cacheable()); err != nil {
+			fmt.Println(NewMessage(chalk.Yellow, "Could not cache the backup catalog: "+err.Error()))
+		}
+	}
+	return catalog, nil
+}
+
+// indexBackup reads the entries of a backup from its manifest, falling back to reading a
+// full backup's archive.
+func indexBackup(b backupFile, info os.FileInfo) *catalogBackup {
+	entry := &catalogBackup{
+		Name:        b.Name,
+		Time:        b.Time,
+		Size:        info.Size(),
+		FileModTime: info.ModTime(),
+		Incremental: b.Incremental,
+	}
+
+	m, err := readManifest(b.Path)
+	if err == nil {
+		entry.Parent = m.Parent
+		entry.Entries = m.Entries
+	} else if b.Incremental {
+		entry.Error = "manifest unreadable: " + err.Error()
+	} else {
+		entry.Entries, err = indexArchive(b.Path)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+	}
+
+	for i := range entry.Entries {
+		// Not needed for searching and can be large
+		entry.Entries[i].Xattrs = nil
+	}
+	return entry
+}
+
+func indexArchive(archive string) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	err := walkArchive(archive, func(hdr *tar.Header, r io.Reader) error {
+		e := newManifestEntry(hdr)
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			e.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// cacheable returns the part of the catalog that may be written to the state dir.
+func (c *backupCatalog) cacheable() *backupCatalog {
+	cache := &backupCatalog{Version: c.Version, Backups: make(map[string]*catalogBackup)}
+	for key, b := range c.Backups {
+		if !b.encrypted() {
+			cache.Backups[key] = b
+		}
+	}
+	return cache
+}
+
+// describe is the backup list detail for one backup: its type and file count, or why it
+// couldn't be indexed.
+func (c *backupCatalog) describe(b backupFile) string {
+	kind := "full"
+	if b.Incremental {
+		kind = "incremental"
+	}
+	entry, ok := c.byName[b.Name]
+	switch {
+	case !ok:
+		return kind
+	case entry.Error != "":
+		return fmt.Sprintf("%-11s  %s", kind, chalk.Red.Color("("+entry.Error+")"))
+	}
+	return fmt.Sprintf("%-11s  %d files", kind, countFiles(entry.Entries))
+}
+
+func countFiles(entries []manifestEntry) int {
+	n := 0
+	for _, e := range entries {
+		if e.Type != "dir" {
+			n++
+		}
+	}
+	return n
+}
+
+// find prints the history of every path matching patterns and returns how many paths
+// matched.
+func (c *backupCatalog) find(patterns []string) int {
+	type version struct {
+		backup int
+		entry  *manifestEntry
+	}
+	history := make(map[string][]version)
+	for i, b := range c.order {
+		for j := range b.Entries {
+			if e := &b.Entries[j]; matchesFindPattern(e.Path, patterns) {
+				history[e.Path] = append(history[e.Path], version{i, e})
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(history))
+	for p := range history {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		fmt.Println(NewMessage(chalk.Blue, p))
+		var prev *manifestEntry
+		last := -1
+		for _, v := range history[p] {
+			if last >= 0 && v.backup != last+1 {
+				fmt.Printf("   %-34s  (missing from %d backup(s))\n", "", v.backup-last-1)
+			}
+			fmt.Printf(" %s %-34s  %s\n", versionMarker(prev, v.entry), c.order[v.backup].Name, describeVersion(v.entry))
+			prev, last = v.entry, v.backup
+		}
+		if last != len(c.order)-1 {
+			fmt.Println(NewMessage(chalk.Yellow, "   not in the latest backup"))
+		}
+	}
+	return len(paths)
+}
+
+// matchesFindPattern matches absolute entry paths against find arguments. Arguments
+// without a slash match the file name.
+func matchesFindPattern(p string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(p)); ok {
+				return true
+			}
+			continue
+		}
+		pattern = "/" + strings.Trim(filepath.ToSlash(pattern), "/")
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// versionMarker flags the first version of a file with "+" and content changes with "*".
+func versionMarker(prev, e *manifestEntry) string {
+	switch {
+	case prev == nil:
+		return "+"
+	case prev.SHA256 != e.SHA256 || prev.Link != e.Link || prev.Type != e.Type:
+		return "*"
+	case prev.Mode != e.Mode || prev.UID != e.UID || prev.GID != e.GID:
+		return "~"
+	}
+	return " "
+}
+
+func describeVersion(e *manifestEntry) string {
+	meta := fmt.Sprintf("%s %d:%d  mtime %s", e.Mode, e.UID, e.GID, e.ModTime.Local().Format(time.DateTime))
+	switch e.Type {
+	case "file":
+		sum := e.SHA256
+		if len(sum) > 12 {
+			sum = sum[:12]
+		}
+		return fmt.Sprintf("%9s  sha256 %s  %s", FormatBytes(e.Size), sum, meta)
+	case "symlink", "hardlink":
+		return e.Type + " -> " + e.Link + "  " + meta
+	}
+	return e.Type + "  " + meta
+}
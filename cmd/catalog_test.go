@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/spf13/viper"
+)
+
+func TestCatalogKeepsEncryptedBackupsOutOfCache(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	useConfig(t, map[string]interface{}{"backup.dest": dest})
+	writeTestBackup(t, dest)
+
+	// Only the second backup is encrypted
+	viper.Set("backup.encryption.mode", "recipients")
+	viper.Set("backup.encryption.recipients", []string{identity.Recipient().String()})
+	viper.Set("backup.encryption.identity_file", identityFile)
+	src := filepath.Join(t.TempDir(), "secret")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "db.key"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dest, fullBackupPrefix+"20240103_030405.tar.gz.age")
+	stats, err := writeArchive(encrypted, []string{src}, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(stats.Manifest, manifestPath(encrypted)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, refresh := range []bool{true, false} {
+		catalog, err := loadCatalog(dest, refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(catalog.order) != 2 {
+			t.Fatalf("catalog has %d backups, want 2", len(catalog.order))
+		}
+		if catalog.find([]string{"db.key"}) != 1 || catalog.find([]string{"conf"}) != 1 {
+			t.Errorf("find doesn't see the files of both backups")
+		}
+
+		cache, err := os.ReadFile(filepath.Join(qcdStateDir(), catalogFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(cache), "/app/conf") {
+			t.Errorf("plain backup missing from the cache")
+		}
+		for _, leak := range []string{"db.key", filepath.Base(encrypted), stats.Manifest.Entries[len(stats.Manifest.Entries)-1].SHA256} {
+			if strings.Contains(string(cache), leak) {
+				t.Errorf("cache leaks %q from the encrypted backup", leak)
+			}
+		}
+	}
+}
+
+func TestMatchesFindPattern(t *testing.T) {
+	tests := []struct {
+		path     string
+		patterns []string
+		want     bool
+	}{
+		{"/etc/passwd", []string{"/etc/passwd"}, true},
+		{"/etc/passwd", []string{"etc/passwd"}, true},
+		{"/etc/postfix/main.cf", []string{"/etc/postfix/*.cf"}, true},
+		{"/etc/postfix/main.cf", []string{"*.cf"}, true},
+		{"/etc/postfix/main.cf", []string{"/etc/*.cf"}, false},
+		{"/etc/shadow", []string{"passwd", "/etc/group"}, false},
+	}
+	for _, tt := range tests {
+		if got := matchesFindPattern(tt.path, tt.patterns); got != tt.want {
+			t.Errorf("matchesFindPattern(%q, %q) = %v, want %v", tt.path, tt.patterns, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func numberLines(from, to int, replace map[int]string) string {
+	var sb strings.Builder
+	for i := from; i <= to; i++ {
+		if r, ok := replace[i]; ok {
+			sb.WriteString(r + "\n")
+			continue
+		}
+		fmt.Fprintf(&sb, "%d\n", i)
+	}
+	return sb.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{name: "identical", a: "x\ny\n", b: "x\ny\n", want: ""},
+		{
+			name: "insert",
+			a:    "1\n2\n3\n4\n5\n",
+			b:    "1\n2\n2.5\n3\n4\n5\n",
+			want: "@@ -1,5 +1,6 @@\n 1\n 2\n+2.5\n 3\n 4\n 5\n",
+		},
+		{
+			name: "separate hunks",
+			a:    numberLines(1, 20, nil),
+			b:    numberLines(1, 20, map[int]string{2: "two", 18: "eighteen"}),
+			want: "@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20\n",
+		},
+		{
+			name: "shared context",
+			a:    numberLines(1, 10, nil),
+			b:    numberLines(1, 10, map[int]string{3: "three", 8: "eight"}),
+			want: "@@ -1,10 +1,10 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n",
+		},
+		{name: "from empty", a: "", b: "x\ny\n", want: "@@ -0,0 +1,2 @@\n+x\n+y\n"},
+		{name: "to empty", a: "x\ny\n", b: "", want: "@@ -1,2 +0,0 @@\n-x\n-y\n"},
+		{name: "missing final newline", a: "x\ny", b: "x\nz", want: "@@ -1,2 +1,2 @@\n x\n-y\n+z\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("a", "b", []byte(tt.a), []byte(tt.b))
+			want := tt.want
+			if want != "" {
+				want = "--- a\n+++ b\n" + want
+			}
+			if got != want {
+				t.Errorf("unifiedDiff:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want bool
+	}{
+		{[]byte("plain text\n"), true},
+		{[]byte{}, true},
+		{[]byte("ELF\x00\x01"), false},
+		{append([]byte(strings.Repeat("a", 9000)), 0), true},
+	}
+	for _, tt := range tests {
+		if got := isText(tt.data); got != tt.want {
+			t.Errorf("isText(%.20q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/ttacon/chalk"
+)
+
+var driftNoDiff bool
+
+var backupDiffCmd = &cobra.Command{
+	Use:   "diff <archive>|latest",
+	Short: "Compare the live filesystem against a backup",
+	Long: `Walks the paths in backup.targets and reports files added, removed, content-changed and permission/owner/xattr-changed since the given backup, with unified diffs for text files. Extended attributes are only compared when the backup captured them.
+Exits with status 1 when drift is found, so a known good backup can be used as a baseline for periodic tamper checks.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		archive, err := resolveBackup(args[0])
+		if CheckError(err) {
+			os.Exit(1)
+		}
+
+		fmt.Println(NewMessage(chalk.Blue, "Comparing live files against "+archive+"..."))
+		report, err := compareWithBackup(archive, backupTargets())
+		if CheckError(err) {
+			os.Exit(1)
+		}
+
+		report.print(!driftNoDiff)
+		if report.drifted() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupDiffCmd)
+	backupDiffCmd.Flags().BoolVar(&driftNoDiff, "no-diff", false, "Only list changed files, don't print diffs")
+}
+
+type driftChange struct {
+	Path   string
+	Detail string
+}
+
+type driftReport struct {
+	Added       []driftChange
+	Removed     []driftChange
+	Modified    []driftChange
+	MetaChanged []driftChange
+	Diffs       map[string]string
+	// Compare extended attributes, the backup captured them
+	xattrs bool
+}
+
+func (r *driftReport) drifted() bool {
+	return len(r.Added)+len(r.Removed)+len(r.Modified)+len(r.MetaChanged) > 0
+}
+
+func (r *driftReport) print(withDiffs bool) {
+	sections := []struct {
+		title   string
+		color   chalk.Color
+		changes []driftChange
+	}{
+		{"Added", chalk.Green, r.Added},
+		{"Removed", chalk.Red, r.Removed},
+		{"Content changed", chalk.Yellow, r.Modified},
+		{"Permissions/owner/xattrs changed", chalk.Magenta, r.MetaChanged},
+	}
+	for _, section := range sections {
+		if len(section.changes) == 0 {
+			continue
+		}
+		fmt.Println(NewMessage(section.color, fmt.Sprintf("%s (%d):", section.title, len(section.changes))))
+		for _, c := range section.changes {
+			if c.Detail != "" {
+				fmt.Println(" - " + c.Path + " (" + c.Detail + ")")
+			} else {
+				fmt.Println(" - " + c.Path)
+			}
+		}
+	}
+
+	if withDiffs {
+		for _, c := range r.Modified {
+			if diff := r.Diffs[c.Path]; diff != "" {
+				fmt.Print(diff)
+			}
+		}
+	}
+
+	if !r.drifted() {
+		fmt.Println(NewMessage(chalk.Green, "No drift detected"))
+		return
+	}
+	fmt.Println(NewMessage(chalk.Red, fmt.Sprintf("Drift detected: %d added, %d removed, %d changed, %d permission/owner/xattr changes",
+		len(r.Added), len(r.Removed), len(r.Modified), len(r.MetaChanged))))
+}
+
+// compareWithBackup diffs the live state of targets against the contents of archive.
+// Archive entries outside the current targets are ignored.
+func compareWithBackup(archive string, targets []string) (*driftReport, error) {
+	var roots []string
+	for _, t := range targets {
+		if abs, err := filepath.Abs(t); err == nil {
+			roots = append(roots, abs)
+		}
+	}
+
+	report := &driftReport{Diffs: make(map[string]string)}
+	if m, err := readManifest(archive); err == nil {
+		report.xattrs = m.Xattrs
+	}
+	seen := make(map[string]bool)
+	err := walkSnapshot(archive, func(hdr *tar.Header, rd io.Reader) error {
+		p := entryPath(hdr.Name)
+		if !underAny(p, roots) {
+			return nil
+		}
+		seen[p] = true
+		return report.compareEntry(p, hdr, rd)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exclude, _ := filepath.Abs(backupDest())
+	patterns := backupExcludes()
+	for _, root := range roots {
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if p == exclude || matchesExclude(p, patterns) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !seen[p] {
+				report.Added = append(report.Added, driftChange{Path: p})
+			}
+			return nil
+		})
+	}
+	return report, nil
+}
+
+func (r *driftReport) compareEntry(p string, hdr *tar.Header, rd io.Reader) error {
+	live, err := os.Lstat(p)
+	if err != nil {
+		r.Removed = append(r.Removed, driftChange{Path: p})
+		return nil
+	}
+
+	want := newManifestEntry(hdr)
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		if !live.Mode().IsRegular() {
+			r.Modified = append(r.Modified, driftChange{Path: p, Detail: "no longer a regular file"})
+			return nil
+		}
+
+		// Keep small files in memory so they can be diffed
+		var backupData []byte
+		h := sha256.New()
+		if hdr.Size <= maxRestoreDiffSize {
+			backupData, err = io.ReadAll(rd)
+			h.Write(backupData)
+		} else {
+			_, err = io.Copy(h, rd)
+		}
+		if err != nil {
+			return err
+		}
+		want.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+		liveSum, _, err := hashFile(p)
+		if err != nil {
+			r.Modified = append(r.Modified, driftChange{Path: p, Detail: "unreadable: " + err.Error()})
+			return nil
+		}
+		if liveSum != want.SHA256 {
+			r.Modified = append(r.Modified, driftChange{Path: p, Detail: fmt.Sprintf("%d -> %d bytes", hdr.Size, live.Size())})
+			r.Diffs[p] = fileDiff(p, backupData, live)
+		}
+	case tar.TypeSymlink:
+		if target, err := os.Readlink(p); err != nil || target != hdr.Linkname {
+			r.Modified = append(r.Modified, driftChange{Path: p, Detail: fmt.Sprintf("link %s -> %s", hdr.Linkname, target)})
+			return nil
+		}
+	case tar.TypeLink:
+		target, err := os.Lstat(entryPath(hdr.Linkname))
+		if err != nil || !os.SameFile(live, target) {
+			r.Modified = append(r.Modified, driftChange{Path: p, Detail: "no longer a hard link to " + entryPath(hdr.Linkname)})
+		}
+		return nil
+	case tar.TypeDir:
+		if !live.IsDir() {
+			r.Modified = append(r.Modified, driftChange{Path: p, Detail: "no longer a directory"})
+			return nil
+		}
+	}
+
+	if detail := r.metadataDrift(p, want, live); detail != "" {
+		r.MetaChanged = append(r.MetaChanged, driftChange{Path: p, Detail: detail})
+	}
+	return nil
+}
+
+// fileDiff renders a unified diff from the backed up content to the live file, if both
+// are small text files.
+func fileDiff(p string, backupData []byte, live os.FileInfo) string {
+	if backupData == nil || live.Size() > maxRestoreDiffSize || !isText(backupData) {
+		return ""
+	}
+	liveData, err := os.ReadFile(p)
+	if err != nil || !isText(liveData) {
+		return ""
+	}
+	return unifiedDiff(p+" (backup)", p+" (live)", backupData, liveData)
+}
+
+// metadataDrift describes permission, ownership and extended attribute differences, or
+// returns "".
+func (r *driftReport) metadataDrift(p string, want manifestEntry, live os.FileInfo) string {
+	got := liveManifestEntry(live)
+	var changes []string
+	if live.Mode()&os.ModeSymlink == 0 && want.Mode != got.Mode {
+		changes = append(changes, "mode "+want.Mode+" -> "+got.Mode)
+	}
+	if want.UID != got.UID || want.GID != got.GID {
+		changes = append(changes, fmt.Sprintf("owner %d:%d -> %d:%d", want.UID, want.GID, got.UID, got.GID))
+	}
+	if r.xattrs {
+		attrs, err := readXattrs(p)
+		if err != nil {
+			changes = append(changes, "xattrs unreadable: "+err.Error())
+		} else {
+			changes = append(changes, xattrChanges(want.Xattrs, attrs)...)
+		}
+	}
+	return strings.Join(changes, ", ")
+}
+
+// liveManifestEntry describes a file on disk the same way the archive headers are.
+func liveManifestEntry(info os.FileInfo) manifestEntry {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return manifestEntry{}
+	}
+	return newManifestEntry(hdr)
+}
+
+func underAny(p string, roots []string) bool {
+	for _, root := range roots {
+		if p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+	"golang.org/x/term"
+)
+
+// Every age encrypted file starts with this line, which lets readers decrypt
+// transparently regardless of the file name
+const ageMagic = "age-encryption.org/v1"
+
+// Environment variable checked for the backup passphrase before prompting
+const passphraseEnv = "QCD_BACKUP_PASSPHRASE"
+
+var keygenOutput string
+
+// Passphrase read from the terminal, cached so we only prompt once per run
+var cachedPassphrase string
+
+var backupKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a key pair for encrypted backups",
+	Long:  `Generates an X25519 identity for backup.encryption. The private identity is written to --output; add the printed public key to backup.encryption.recipients and keep the identity off the box (or at least out of backup.dest).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		identity, err := age.GenerateX25519Identity()
+		if CheckError(err) {
+			return
+		}
+
+		content := fmt.Sprintf("# public key: %s\n%s\n", identity.Recipient(), identity)
+		f, err := os.OpenFile(keygenOutput, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if CheckError(err) {
+			return
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); CheckError(err) {
+			return
+		}
+
+		fmt.Println(NewMessage(chalk.Green, "Identity written to "+keygenOutput))
+		fmt.Println(NewMessage(chalk.Blue, "Public key:").ThenColor(chalk.White, identity.Recipient().String()))
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupKeygenCmd)
+	backupKeygenCmd.Flags().StringVarP(&keygenOutput, "output", "o", "qcd-backup.key", "File to write the private identity to")
+}
+
+// backupEncrypted reports whether new backups should be encrypted.
+func backupEncrypted() bool {
+	mode := viper.GetString("backup.encryption.mode")
+	return mode != "" && mode != "none"
+}
+
+// backupRecipients returns the age recipients new backups are encrypted to, or nil if
+// backup encryption is disabled.
+func backupRecipients() ([]age.Recipient, error) {
+	switch mode := viper.GetString("backup.encryption.mode"); mode {
+	case "", "none":
+		return nil, nil
+	case "passphrase":
+		passphrase, err := backupPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	case "recipients":
+		keys := viper.GetStringSlice("backup.encryption.recipients")
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("backup.encryption.mode is recipients but backup.encryption.recipients is empty")
+		}
+		var recipients []age.Recipient
+		for _, key := range keys {
+			r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+			if err != nil {
+				return nil, fmt.Errorf("invalid backup recipient %q: %w", key, err)
+			}
+			recipients = append(recipients, r)
+		}
+		return recipients, nil
+	default:
+		return nil, fmt.Errorf("unknown backup.encryption.mode %q (expected none, passphrase or recipients)", mode)
+	}
+}
+
+// backupIdentities collects everything that might decrypt a backup: the configured
+// identity file and, if one can be found, the passphrase.
+func backupIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if path := viper.GetString("backup.encryption.identity_file"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open backup identity: %w", err)
+		}
+		defer f.Close()
+		ids, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse backup identity %s: %w", path, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	// Only prompt when there is nothing else to try
+	passphrase, err := backupPassphrase(len(identities) == 0)
+	if err != nil && len(identities) == 0 {
+		return nil, err
+	}
+	if passphrase != "" {
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, nil
+}
+
+// backupPassphrase looks for the passphrase in backup.encryption.passphrase_file, then
+// $QCD_BACKUP_PASSPHRASE, and finally asks on the terminal if prompt is set.
+func backupPassphrase(prompt bool) (string, error) {
+	if cachedPassphrase != "" {
+		return cachedPassphrase, nil
+	}
+
+	if path := viper.GetString("backup.encryption.passphrase_file"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		cachedPassphrase = strings.TrimSpace(string(data))
+	} else if env := os.Getenv(passphraseEnv); env != "" {
+		cachedPassphrase = env
+	} else if prompt {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", fmt.Errorf("no backup passphrase: set backup.encryption.passphrase_file or $%s", passphraseEnv)
+		}
+		fmt.Print(NewMessage(chalk.Yellow, "Backup passphrase: ").String())
+		data, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		cachedPassphrase = string(data)
+	}
+
+	if cachedPassphrase == "" && prompt {
+		return "", fmt.Errorf("backup passphrase is empty")
+	}
+	return cachedPassphrase, nil
+}
+
+// encryptBackup wraps w so everything written to it is encrypted to the configured
+// recipients. With encryption disabled the writes go straight to w.
+func encryptBackup(w io.Writer) (io.WriteCloser, error) {
+	recipients, err := backupRecipients()
+	if err != nil {
+		return nil, err
+	}
+	if recipients == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+// openBackupFile opens a backup archive or manifest, decrypting it if it is age
+// encrypted.
+func openBackupFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	if head, _ := br.Peek(len(ageMagic)); string(head) != ageMagic {
+		return readCloser{br, f}, nil
+	}
+
+	identities, err := backupIdentities()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := age.Decrypt(br, identities...)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return readCloser{r, f}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+//go:embed embedded/nft/ruleset.nft.tmpl
+var nftRulesetTemplate string
+
+// firewallProfile is one entry of firewall.profiles, keyed by system type: the service
+// ports that box has to keep open, and with egress filtering on, what it may open
+// outbound and which service accounts may not connect out at all.
+type firewallProfile struct {
+	TCPPorts        []string `mapstructure:"tcp_ports"`
+	UDPPorts        []string `mapstructure:"udp_ports"`
+	EgressTCPPorts  []string `mapstructure:"egress_tcp_ports"`
+	EgressUDPPorts  []string `mapstructure:"egress_udp_ports"`
+	EgressDenyUsers []string `mapstructure:"egress_deny_users"`
+}
+
+// Profile used when --sys isn't given: nothing but the management ports
+const genericFirewallProfile = "generic"
+
+// Profiles used for system types that firewall.profiles doesn't define
+var builtinFirewallProfiles = map[string]firewallProfile{
+	genericFirewallProfile: {},
+	"mail": {
+		TCPPorts: []string{"25", "465", "587", "143", "993", "110", "995"},
+		// Delivering mail to other servers
+		EgressTCPPorts: []string{"25"},
+	},
+	"splunk": {
+		TCPPorts:        []string{"8000", "9997", "8089"},
+		EgressDenyUsers: []string{"splunk"},
+	},
+	"web": {
+		TCPPorts:        []string{"80", "443"},
+		EgressDenyUsers: []string{"www-data", "apache", "nginx", "http"},
+	},
+	"ecommerce": {
+		TCPPorts:        []string{"80", "443"},
+		EgressDenyUsers: []string{"www-data", "apache", "nginx", "http"},
+	},
+	// Recursion to other name servers
+	"dns": {
+		TCPPorts:       []string{"53"},
+		UDPPorts:       []string{"53"},
+		EgressTCPPorts: []string{"53"},
+		EgressUDPPorts: []string{"53"},
+	},
+	// Passive mode needs the server's pasv port range added to firewall.tcp_ports
+	"ftp": {
+		TCPPorts:        []string{"20", "21"},
+		EgressDenyUsers: []string{"ftp", "vsftpd"},
+	},
+	"database": {
+		TCPPorts:        []string{"3306", "5432"},
+		EgressDenyUsers: []string{"mysql", "postgres"},
+	},
+	"ad": {
+		TCPPorts:       []string{"53", "88", "135", "389", "445", "464", "636", "3268", "3269", "49152-65535"},
+		UDPPorts:       []string{"53", "88", "123", "389", "464"},
+		EgressTCPPorts: []string{"53"},
+		EgressUDPPorts: []string{"53"},
+	},
+}
+
+// firewallPort is a port or an inclusive port range.
+type firewallPort struct {
+	From uint16
+	To   uint16
+}
+
+func (p firewallPort) String() string {
+	if p.From == p.To {
+		return strconv.Itoa(int(p.From))
+	}
+	return fmt.Sprintf("%d-%d", p.From, p.To)
+}
+
+// firewallRuleset is the host firewall independent of the tool that enforces it. Inbound
+// traffic is dropped unless it matches one of these rules.
+type firewallRuleset struct {
+	Profiles []string
+	// Service ports, reachable from Sources (anywhere if empty) and the scoring engine
+	TCPPorts []firewallPort
+	UDPPorts []firewallPort
+	Sources  []netip.Prefix
+	// Scoring engine addresses, always let through to the services and for ICMP
+	ScoringCIDRs []netip.Prefix
+	// TCP ports for administration (SSH), reachable from ManagementCIDRs or anywhere
+	ManagementPorts []firewallPort
+	ManagementCIDRs []netip.Prefix
+	// accept, limit (rate limited echo) or drop (only errors and neighbour discovery)
+	ICMP string
+	// Log dropped inbound packets
+	Log       bool
+	LogPrefix string
+	LogRate   string
+	// Outbound filtering, nil when outbound traffic is not restricted
+	Egress *firewallEgress
+}
+
+var logRatePattern = regexp.MustCompile(`^[0-9]+/(second|minute|hour|day)$`)
+
+// buildFirewallRuleset assembles the ruleset for the system types in sysType (comma
+// separated, generic if empty) from firewall.profiles, the built-in profiles and the
+// global firewall keys. Unknown system types are an error.
+func buildFirewallRuleset(sysType string) (*firewallRuleset, error) {
+	profiles, err := loadFirewallProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(sysType) == "" {
+		sysType = genericFirewallProfile
+	}
+
+	rs := &firewallRuleset{}
+	tcp := viper.GetStringSlice("firewall.tcp_ports")
+	udp := viper.GetStringSlice("firewall.udp_ports")
+	var selected []firewallProfile
+	for _, name := range strings.Split(sysType, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty system type in %q", sysType)
+		}
+		p, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("no firewall profile for system type %q (known: %s)", name, strings.Join(firewallProfileNames(profiles), ", "))
+		}
+		rs.Profiles = append(rs.Profiles, name)
+		selected = append(selected, p)
+		tcp = append(tcp, p.TCPPorts...)
+		udp = append(udp, p.UDPPorts...)
+	}
+
+	if rs.TCPPorts, err = parseFirewallPorts(tcp); err != nil {
+		return nil, fmt.Errorf("tcp ports: %w", err)
+	}
+	if rs.UDPPorts, err = parseFirewallPorts(udp); err != nil {
+		return nil, fmt.Errorf("udp ports: %w", err)
+	}
+
+	management := viper.GetStringSlice("firewall.management_ports")
+	if len(management) == 0 {
+		management = []string{"22"}
+	}
+	if rs.ManagementPorts, err = parseFirewallPorts(management); err != nil {
+		return nil, fmt.Errorf("firewall.management_ports: %w", err)
+	}
+	if rs.ManagementCIDRs, err = parseFirewallCIDRs(viper.GetStringSlice("firewall.management_cidrs")); err != nil {
+		return nil, fmt.Errorf("firewall.management_cidrs: %w", err)
+	}
+	if rs.Sources, err = parseFirewallCIDRs(viper.GetStringSlice("firewall.sources")); err != nil {
+		return nil, fmt.Errorf("firewall.sources: %w", err)
+	}
+	if rs.ScoringCIDRs, err = parseFirewallCIDRs(viper.GetStringSlice("firewall.scoring_cidrs")); err != nil {
+		return nil, fmt.Errorf("firewall.scoring_cidrs: %w", err)
+	}
+
+	rs.ICMP = viper.GetString("firewall.icmp")
+	switch rs.ICMP {
+	case "":
+		rs.ICMP = "accept"
+	case "accept", "limit", "drop":
+	default:
+		return nil, fmt.Errorf("firewall.icmp must be accept, limit or drop, not %q", rs.ICMP)
+	}
+
+	rs.Log = viper.GetBool("firewall.log")
+	if rs.LogPrefix, err = firewallLogPrefix("firewall.log_prefix", "qcd-drop: "); err != nil {
+		return nil, err
+	}
+	rs.LogRate = viper.GetString("firewall.log_rate")
+	if rs.LogRate == "" {
+		rs.LogRate = "10/minute"
+	}
+	if !logRatePattern.MatchString(rs.LogRate) {
+		return nil, fmt.Errorf("firewall.log_rate must look like 10/minute, not %q", rs.LogRate)
+	}
+
+	if viper.GetBool("firewall.egress.enabled") {
+		if rs.Egress, err = buildFirewallEgress(selected, rs.LogRate); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// firewallLogPrefix reads a log prefix, which ends up quoted in the rules.
+func firewallLogPrefix(key, fallback string) (string, error) {
+	prefix := viper.GetString(key)
+	if prefix == "" {
+		prefix = fallback
+	}
+	if strings.ContainsAny(prefix, "\"\\\n") || len(prefix) > 127 {
+		return "", fmt.Errorf("%s must be under 128 characters without quotes or backslashes", key)
+	}
+	return prefix, nil
+}
+
+// loadFirewallProfiles merges firewall.profiles over the built-in profiles.
+func loadFirewallProfiles() (map[string]firewallProfile, error) {
+	profiles := make(map[string]firewallProfile, len(builtinFirewallProfiles))
+	for name, p := range builtinFirewallProfiles {
+		profiles[name] = p
+	}
+
+	var configured map[string]firewallProfile
+	if err := viper.UnmarshalKey("firewall.profiles", &configured); err != nil {
+		return nil, fmt.Errorf("invalid firewall.profiles: %w", err)
+	}
+	for name, p := range configured {
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+func firewallProfileNames(profiles map[string]firewallProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseFirewallPorts parses ports and ranges like "443" or "8000-8100", dropping
+// duplicates.
+func parseFirewallPorts(values []string) ([]firewallPort, error) {
+	var ports []firewallPort
+	seen := make(map[firewallPort]bool)
+	for _, v := range values {
+		from, to, isRange := strings.Cut(strings.TrimSpace(v), "-")
+		if !isRange {
+			to = from
+		}
+		lo, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil || lo == 0 {
+			return nil, fmt.Errorf("invalid port %q", v)
+		}
+		hi, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid port range %q", v)
+		}
+		p := firewallPort{From: uint16(lo), To: uint16(hi)}
+		if !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].From < ports[j].From })
+	return ports, nil
+}
+
+// parseFirewallCIDRs parses addresses and networks. A bare address is a single host.
+func parseFirewallCIDRs(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", v)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// renderNftRuleset renders the ruleset as an nft script that replaces the whole ruleset.
+func renderNftRuleset(rs *firewallRuleset) (string, error) {
+	funcs := template.FuncMap{
+		"join": strings.Join,
+		"ports": func(ports []firewallPort) string {
+			s := make([]string, len(ports))
+			for i, p := range ports {
+				s[i] = p.String()
+			}
+			return strings.Join(s, ", ")
+		},
+		"ipv4": func(prefixes ...[]netip.Prefix) []string { return filterPrefixes(true, prefixes...) },
+		"ipv6": func(prefixes ...[]netip.Prefix) []string { return filterPrefixes(false, prefixes...) },
+	}
+	tmpl, err := template.New("ruleset.nft").Funcs(funcs).Parse(nftRulesetTemplate)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, rs); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// filterPrefixes returns the IPv4 or IPv6 networks of all lists.
+func filterPrefixes(v4 bool, lists ...[]netip.Prefix) []string {
+	var out []string
+	for _, list := range lists {
+		for _, p := range list {
+			switch {
+			case p.Addr().Is4() != v4:
+			case p.IsSingleIP():
+				out = append(out, p.Addr().String())
+			default:
+				out = append(out, p.String())
+			}
+		}
+	}
+	return out
+}
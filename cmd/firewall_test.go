@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFirewallPorts(t *testing.T) {
+	tests := []struct {
+		in      []string
+		want    []firewallPort
+		wantErr bool
+	}{
+		{[]string{"443", "80"}, []firewallPort{{80, 80}, {443, 443}}, false},
+		{[]string{" 8000-8100 ", "22"}, []firewallPort{{22, 22}, {8000, 8100}}, false},
+		{[]string{"53", "53", "53-53"}, []firewallPort{{53, 53}}, false},
+		{[]string{"65535"}, []firewallPort{{65535, 65535}}, false},
+		{nil, nil, false},
+		{[]string{"0"}, nil, true},
+		{[]string{"65536"}, nil, true},
+		{[]string{"ssh"}, nil, true},
+		{[]string{"100-90"}, nil, true},
+		{[]string{"100-"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFirewallPorts(tt.in)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFirewallPorts(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildFirewallRuleset(t *testing.T) {
+	tests := []struct {
+		sys      string
+		profiles []string
+		tcp      []firewallPort
+		udp      []firewallPort
+		wantErr  bool
+	}{
+		{sys: "", profiles: []string{genericFirewallProfile}},
+		{sys: " ", profiles: []string{genericFirewallProfile}},
+		{sys: "web", profiles: []string{"web"}, tcp: []firewallPort{{80, 80}, {443, 443}}},
+		{sys: "web,dns", profiles: []string{"web", "dns"}, tcp: []firewallPort{{53, 53}, {80, 80}, {443, 443}}, udp: []firewallPort{{53, 53}}},
+		{sys: "web, ecommerce", profiles: []string{"web", "ecommerce"}, tcp: []firewallPort{{80, 80}, {443, 443}}},
+		{sys: "webserver", wantErr: true},
+		{sys: "web,nosuch", wantErr: true},
+		{sys: "web,,dns", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sys, func(t *testing.T) {
+			useConfig(t, nil)
+			rs, err := buildFirewallRuleset(tt.sys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildFirewallRuleset(%q) error = %v, want error %v", tt.sys, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(rs.Profiles, tt.profiles) {
+				t.Errorf("profiles %v, want %v", rs.Profiles, tt.profiles)
+			}
+			if !reflect.DeepEqual(rs.TCPPorts, tt.tcp) || !reflect.DeepEqual(rs.UDPPorts, tt.udp) {
+				t.Errorf("ports tcp %v udp %v, want tcp %v udp %v", rs.TCPPorts, rs.UDPPorts, tt.tcp, tt.udp)
+			}
+			// SSH stays open whatever the profile
+			if want := []firewallPort{{22, 22}}; !reflect.DeepEqual(rs.ManagementPorts, want) {
+				t.Errorf("management ports %v, want %v", rs.ManagementPorts, want)
+			}
+		})
+	}
+}
+
+func TestBuiltinFirewallProfilesReachable(t *testing.T) {
+	for name := range builtinFirewallProfiles {
+		t.Run(name, func(t *testing.T) {
+			useConfig(t, nil)
+			rs, err := buildFirewallRuleset(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, backend := range []firewallBackend{nftablesBackend{}, iptablesBackend{}, firewalldBackend{}} {
+				if problems := checkChainsReachable(rs, renderedChains(t, backend, rs)); len(problems) > 0 {
+					t.Errorf("%s: %+v", backend.Name(), problems)
+				}
+			}
+		})
+	}
+}
+
+// testRuleset is a small ruleset the render tests start from.
+func testRuleset() *firewallRuleset {
+	return &firewallRuleset{
+		Profiles:        []string{"web"},
+		TCPPorts:        []firewallPort{{80, 80}, {443, 443}},
+		ManagementPorts: []firewallPort{{22, 22}},
+		ICMP:            "accept",
+		LogPrefix:       "qcd-drop: ",
+		LogRate:         "10/minute",
+	}
+}
+
+func TestRenderNftRuleset(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(rs *firewallRuleset)
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "defaults",
+			want: []string{
+				"type filter hook input priority 0; policy drop;",
+				"tcp dport { 22 } accept",
+				"tcp dport { 80, 443 } accept",
+				"ip protocol icmp accept",
+				"type filter hook output priority 0; policy accept;",
+			},
+			notWant: []string{"udp dport", "log prefix", "saddr"},
+		},
+		{
+			name: "sources and scoring",
+			modify: func(rs *firewallRuleset) {
+				rs.UDPPorts = []firewallPort{{53, 53}}
+				rs.Sources = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+				rs.ScoringCIDRs = []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")}
+			},
+			want: []string{
+				"ip saddr { 10.0.0.0/8, 192.0.2.10 } tcp dport { 80, 443 } accept",
+				"ip saddr { 10.0.0.0/8, 192.0.2.10 } udp dport { 53 } accept",
+				"ip6 saddr { fd00::/8 } tcp dport { 80, 443 } accept",
+				"ip saddr { 192.0.2.10 } ip protocol icmp accept",
+			},
+			notWant: []string{"\t\ttcp dport { 80, 443 } accept"},
+		},
+		{
+			name: "management networks",
+			modify: func(rs *firewallRuleset) {
+				rs.ManagementPorts = []firewallPort{{22, 22}, {2222, 2230}}
+				rs.ManagementCIDRs = []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}
+			},
+			want:    []string{"ip saddr { 172.16.0.0/12 } tcp dport { 22, 2222-2230 } accept"},
+			notWant: []string{"ip6 saddr", "\t\ttcp dport { 22"},
+		},
+		{
+			name:    "limited icmp with logging",
+			modify:  func(rs *firewallRuleset) { rs.ICMP = "limit"; rs.Log = true },
+			want:    []string{"icmp type echo-request limit rate 5/second accept", `limit rate 10/minute log prefix "qcd-drop: " level info`},
+			notWant: []string{"ip protocol icmp accept"},
+		},
+		{
+			name:    "icmp dropped",
+			modify:  func(rs *firewallRuleset) { rs.ICMP = "drop" },
+			want:    []string{"icmp type { destination-unreachable, time-exceeded, parameter-problem } accept"},
+			notWant: []string{"echo-request", "ip protocol icmp accept"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := testRuleset()
+			if tt.modify != nil {
+				tt.modify(rs)
+			}
+			out, err := renderNftRuleset(rs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("missing %q in:\n%s", want, out)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(out, notWant) {
+					t.Errorf("unexpected %q in:\n%s", notWant, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,697 @@
+package cmd
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+//go:embed embedded/iptables/rules.tmpl
+var iptablesRulesTemplate string
+
+//go:embed embedded/firewalld/zone.xml.tmpl
+var firewalldZoneTemplate string
+
+// Zone qcd installs and makes the default when firewalld manages the host
+const firewalldZone = "qcd"
+
+var firewalldZonePath = "/etc/firewalld/zones/" + firewalldZone + ".xml"
+
+// firewallBackend enforces a firewallRuleset with one of the host's firewall tools.
+type firewallBackend interface {
+	Name() string
+	// Render returns the rules in the tool's own format
+	Render(rs *firewallRuleset) (string, error)
+	// Check validates the rules with the tool without applying them
+	Check(rs *firewallRuleset) ([]firewallProblem, error)
+	Apply(rs *firewallRuleset) error
+	// Snapshot saves the active rules into dir, Restore puts them back
+	Snapshot(dir string) error
+	Restore(dir string) error
+	// Open stops all filtering, the last resort when Restore fails
+	Open() error
+}
+
+var firewallBackends = map[string]firewallBackend{
+	"nftables":  nftablesBackend{},
+	"iptables":  iptablesBackend{},
+	"firewalld": firewalldBackend{},
+}
+
+// selectFirewallBackend returns the backend named by firewall.backend, or detects one:
+// a running firewalld wins since it would fight rules loaded behind its back, then
+// nftables, then iptables.
+func selectFirewallBackend() (firewallBackend, error) {
+	name := viper.GetString("firewall.backend")
+	if name != "" && name != "auto" {
+		return firewallBackendByName(name)
+	}
+	if exec.Command("firewall-cmd", "--state").Run() == nil {
+		return firewallBackends["firewalld"], nil
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		return firewallBackends["nftables"], nil
+	}
+	if _, err := exec.LookPath("iptables-restore"); err == nil {
+		return firewallBackends["iptables"], nil
+	}
+	return nil, fmt.Errorf("no firewall tool found, install nftables or iptables or set firewall.backend")
+}
+
+func firewallBackendByName(name string) (firewallBackend, error) {
+	if b, ok := firewallBackends[name]; ok {
+		return b, nil
+	}
+	names := make([]string, 0, len(firewallBackends))
+	for n := range firewallBackends {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown firewall.backend %q (known: auto, %s)", name, strings.Join(names, ", "))
+}
+
+// writeTempFile writes content to a fresh temporary file and returns its name.
+func writeTempFile(pattern, content string) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// nftablesBackend loads the whole ruleset with nft -f.
+type nftablesBackend struct{}
+
+func (nftablesBackend) Name() string { return "nftables" }
+
+func (nftablesBackend) Render(rs *firewallRuleset) (string, error) {
+	return renderNftRuleset(rs)
+}
+
+func (nftablesBackend) Check(rs *firewallRuleset) ([]firewallProblem, error) {
+	rules, err := renderNftRuleset(rs)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := nftCheck(rules)
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, checkFirewallReachable(rs, rules)...), nil
+}
+
+func (nftablesBackend) Apply(rs *firewallRuleset) error {
+	rules, err := renderNftRuleset(rs)
+	if err != nil {
+		return err
+	}
+	// A fresh file so nft never loads a stale or planted one
+	path, err := writeTempFile("qcd-fallback-*.nft", rules)
+	if err != nil {
+		return fmt.Errorf("failed to write fallback rules: %w", err)
+	}
+	defer os.Remove(path)
+	if err := RunCommand("nft", "-f", path); err != nil {
+		return fmt.Errorf("failed to apply fallback rules: %w", err)
+	}
+	return nil
+}
+
+func (nftablesBackend) Snapshot(dir string) error {
+	ruleset, err := exec.Command("nft", "list", "ruleset").Output()
+	if err != nil {
+		return fmt.Errorf("could not save the current ruleset: %w", err)
+	}
+	// The listing only adds to what's loaded, flush first so a restore is exact
+	data := append([]byte("flush ruleset\n"), ruleset...)
+	return os.WriteFile(filepath.Join(dir, "ruleset.nft"), data, 0600)
+}
+
+func (nftablesBackend) Restore(dir string) error {
+	return RunCommand("nft", "-f", filepath.Join(dir, "ruleset.nft"))
+}
+
+func (nftablesBackend) Open() error {
+	return RunCommand("nft", "flush", "ruleset")
+}
+
+// iptablesBackend loads the filter table with iptables-restore and ip6tables-restore.
+type iptablesBackend struct{}
+
+// Filter table with nothing in it, restored when there was no filter table before
+const emptyIptablesFilter = "*filter\n:INPUT ACCEPT [0:0]\n:FORWARD ACCEPT [0:0]\n:OUTPUT ACCEPT [0:0]\nCOMMIT\n"
+
+// iptablesFamily is one of the two tool sets iptables needs.
+type iptablesFamily struct {
+	V6      bool
+	Restore string
+	Save    string
+	File    string
+}
+
+var iptablesFamilies = []iptablesFamily{
+	{V6: false, Restore: "iptables-restore", Save: "iptables-save", File: "rules.v4"},
+	{V6: true, Restore: "ip6tables-restore", Save: "ip6tables-save", File: "rules.v6"},
+}
+
+func (f iptablesFamily) available() bool {
+	_, err := exec.LookPath(f.Restore)
+	return err == nil
+}
+
+func (iptablesBackend) Name() string { return "iptables" }
+
+func (iptablesBackend) Render(rs *firewallRuleset) (string, error) {
+	var out strings.Builder
+	for _, f := range iptablesFamilies {
+		rules, err := renderIptablesRules(rs, f.V6)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&out, "# --- %s ---\n%s\n", f.Restore, rules)
+	}
+	return out.String(), nil
+}
+
+// Where iptables-restore says which line it choked on
+var iptablesErrorLinePattern = regexp.MustCompile(`(?i)line:? (\d+)`)
+
+func (iptablesBackend) Check(rs *firewallRuleset) ([]firewallProblem, error) {
+	var problems []firewallProblem
+	for _, f := range iptablesFamilies {
+		if !f.available() {
+			continue
+		}
+		rules, err := renderIptablesRules(rs, f.V6)
+		if err != nil {
+			return nil, err
+		}
+		path, err := writeTempFile("qcd-check-*."+f.File, rules)
+		if err != nil {
+			return nil, err
+		}
+		out, err := exec.Command(f.Restore, "--test", path).CombinedOutput()
+		os.Remove(path)
+		var exitErr *exec.ExitError
+		if err == nil {
+			continue
+		} else if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("could not run %s --test: %w", f.Restore, err)
+		}
+
+		p := firewallProblem{Message: f.Restore + ": " + strings.TrimSpace(string(out))}
+		if m := iptablesErrorLinePattern.FindStringSubmatch(string(out)); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			if lines := strings.Split(rules, "\n"); p.Line > 0 && p.Line <= len(lines) {
+				p.Source = lines[p.Line-1]
+			}
+		}
+		problems = append(problems, p)
+	}
+	if len(problems) > 0 {
+		return problems, nil
+	}
+
+	var chains []*nftChain
+	for _, f := range iptablesFamilies {
+		rules, err := renderIptablesRules(rs, f.V6)
+		if err != nil {
+			return nil, err
+		}
+		family := "ip"
+		if f.V6 {
+			family = "ip6"
+		}
+		chains = append(chains, parseIptablesRules(rules, family)...)
+	}
+	return checkChainsReachable(rs, chains), nil
+}
+
+func (iptablesBackend) Apply(rs *firewallRuleset) error {
+	for _, f := range iptablesFamilies {
+		if !f.available() {
+			if !f.V6 {
+				return fmt.Errorf("%s not found", f.Restore)
+			}
+			fmt.Println(NewMessage(chalk.Yellow, f.Restore+" not found, IPv6 is left unfiltered"))
+			continue
+		}
+		rules, err := renderIptablesRules(rs, f.V6)
+		if err != nil {
+			return err
+		}
+		path, err := writeTempFile("qcd-fallback-*."+f.File, rules)
+		if err != nil {
+			return err
+		}
+		err = RunCommand(f.Restore, path)
+		os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s rules: %w", f.File, err)
+		}
+	}
+	return nil
+}
+
+func (iptablesBackend) Snapshot(dir string) error {
+	for _, f := range iptablesFamilies {
+		if !f.available() {
+			continue
+		}
+		saved, err := exec.Command(f.Save).Output()
+		if err != nil {
+			return fmt.Errorf("could not save the current rules with %s: %w", f.Save, err)
+		}
+		// iptables-restore only replaces the tables it is given
+		if !bytes.Contains(saved, []byte("*filter\n")) {
+			saved = append(saved, emptyIptablesFilter...)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.File), saved, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iptablesBackend) Restore(dir string) error {
+	for _, f := range iptablesFamilies {
+		path := filepath.Join(dir, f.File)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := RunCommand(f.Restore, path); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", f.File, err)
+		}
+	}
+	return nil
+}
+
+// Open loads an empty filter table with ACCEPT policies for both families.
+func (iptablesBackend) Open() error {
+	var errs []error
+	for _, f := range iptablesFamilies {
+		if !f.available() {
+			continue
+		}
+		path, err := writeTempFile("qcd-open-*."+f.File, emptyIptablesFilter)
+		if err != nil {
+			return err
+		}
+		if err := RunCommand(f.Restore, path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Restore, err))
+		}
+		os.Remove(path)
+	}
+	return errors.Join(errs...)
+}
+
+// renderIptablesRules renders the iptables-restore input for one address family.
+func renderIptablesRules(rs *firewallRuleset, v6 bool) (string, error) {
+	data := struct {
+		*firewallRuleset
+		V6            bool
+		ICMPProto     string
+		ICMPTypeFlag  string
+		ICMPEssential []string
+	}{rs, v6, "icmp", "--icmp-type", []string{"destination-unreachable", "time-exceeded", "parameter-problem"}}
+	if v6 {
+		data.ICMPProto, data.ICMPTypeFlag = "ipv6-icmp", "--icmpv6-type"
+		data.ICMPEssential = []string{"destination-unreachable", "packet-too-big", "time-exceeded", "parameter-problem", "neighbour-solicitation", "neighbour-advertisement", "router-advertisement"}
+	}
+
+	funcs := template.FuncMap{
+		"join":  strings.Join,
+		"ports": multiportGroups,
+		"addrs": func(prefixes ...[]netip.Prefix) []string { return filterPrefixes(!v6, prefixes...) },
+	}
+	tmpl, err := template.New("rules").Funcs(funcs).Parse(iptablesRulesTemplate)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// multiportGroups splits ports into --dports lists, multiport takes 15 slots per rule
+// and a range uses two.
+func multiportGroups(ports []firewallPort) []string {
+	var groups []string
+	var cur []string
+	slots := 0
+	for _, p := range ports {
+		s, n := strconv.Itoa(int(p.From)), 1
+		if p.From != p.To {
+			s, n = fmt.Sprintf("%d:%d", p.From, p.To), 2
+		}
+		if slots+n > 15 {
+			groups = append(groups, strings.Join(cur, ","))
+			cur, slots = nil, 0
+		}
+		cur = append(cur, s)
+		slots += n
+	}
+	if len(cur) > 0 {
+		groups = append(groups, strings.Join(cur, ","))
+	}
+	return groups
+}
+
+// firewalldBackend installs the ruleset as a firewalld zone and makes it the default
+// zone for every interface.
+type firewalldBackend struct{}
+
+func (firewalldBackend) Name() string { return "firewalld" }
+
+func (firewalldBackend) Render(rs *firewallRuleset) (string, error) {
+	// Zones only filter inbound traffic and firewalld can't match on the sending user
+	if rs.Egress != nil {
+		return "", fmt.Errorf("firewall.egress isn't supported by the firewalld backend, use nftables or iptables")
+	}
+	data := struct {
+		*firewallRuleset
+		ICMPEssential []string
+	}{rs, []string{"destination-unreachable", "packet-too-big", "time-exceeded", "parameter-problem", "neighbour-solicitation", "neighbour-advertisement", "router-advertisement"}}
+
+	funcs := template.FuncMap{
+		"join": strings.Join,
+		"xml": func(s string) (string, error) {
+			var out strings.Builder
+			err := xml.EscapeText(&out, []byte(s))
+			return out.String(), err
+		},
+		"family": func(p netip.Prefix) string {
+			if p.Addr().Is4() {
+				return "ipv4"
+			}
+			return "ipv6"
+		},
+		"concat": func(lists ...[]netip.Prefix) []netip.Prefix {
+			var all []netip.Prefix
+			for _, l := range lists {
+				all = append(all, l...)
+			}
+			return all
+		},
+	}
+	tmpl, err := template.New("zone.xml").Funcs(funcs).Parse(firewalldZoneTemplate)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Check makes sure the zone is well formed XML and keeps the required ports reachable.
+// firewalld validates the rules itself with --check-config once the zone is in place.
+func (b firewalldBackend) Check(rs *firewallRuleset) ([]firewallProblem, error) {
+	zone, err := b.Render(rs)
+	if err != nil {
+		return nil, err
+	}
+	dec := xml.NewDecoder(strings.NewReader(zone))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			chains, err := parseFirewalldZone(zone)
+			if err != nil {
+				return nil, err
+			}
+			return checkChainsReachable(rs, chains), nil
+		}
+		var syntaxErr *xml.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			p := firewallProblem{Line: syntaxErr.Line, Message: syntaxErr.Msg}
+			if lines := strings.Split(zone, "\n"); p.Line > 0 && p.Line <= len(lines) {
+				p.Source = strings.TrimSpace(lines[p.Line-1])
+			}
+			return []firewallProblem{p}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (b firewalldBackend) Apply(rs *firewallRuleset) error {
+	zone, err := b.Render(rs)
+	if err != nil {
+		return err
+	}
+	if rs.Log {
+		fmt.Println(NewMessage(chalk.Yellow, "firewalld logs drops through LogDenied in firewalld.conf, firewall.log is ignored"))
+	}
+
+	previous, err := os.ReadFile(firewalldZonePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(firewalldZonePath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(firewalldZonePath, []byte(zone), 0644); err != nil {
+		return err
+	}
+	if err := RunCommand("firewall-cmd", "--check-config"); err != nil {
+		if previous != nil {
+			os.WriteFile(firewalldZonePath, previous, 0644)
+		} else {
+			os.Remove(firewalldZonePath)
+		}
+		return fmt.Errorf("firewalld rejected the zone: %w", err)
+	}
+
+	if err := RunCommand("firewall-cmd", "--reload"); err != nil {
+		return err
+	}
+	if err := RunCommand("firewall-cmd", "--set-default-zone="+firewalldZone); err != nil {
+		return err
+	}
+	// Interfaces bound to another zone (NetworkManager does this) don't follow the default.
+	// The permanent binding (passed on to NetworkManager for its connections) keeps them in
+	// the qcd zone after a reload or reboot.
+	for _, name := range firewalldInterfaces() {
+		for _, args := range [][]string{nil, {"--permanent"}} {
+			args = append(args, "--zone="+firewalldZone, "--change-interface="+name)
+			if err := RunCommand("firewall-cmd", args...); err != nil {
+				fmt.Println(NewMessage(chalk.Yellow, "Could not move "+name+" into the "+firewalldZone+" zone: "+err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// Where a firewalld snapshot keeps the runtime and permanent zone of each interface, ""
+// when it had none
+const (
+	firewalldInterfaceZonesFile          = "interface-zones.json"
+	firewalldPermanentInterfaceZonesFile = "permanent-interface-zones.json"
+)
+
+func (firewalldBackend) Snapshot(dir string) error {
+	zone, err := exec.Command("firewall-cmd", "--get-default-zone").Output()
+	if err != nil {
+		return fmt.Errorf("could not read the default zone: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "default-zone"), bytes.TrimSpace(zone), 0600); err != nil {
+		return err
+	}
+	// Apply moves every interface into the qcd zone, remember where each one was
+	zones, permanent := make(map[string]string), make(map[string]string)
+	for _, name := range firewalldInterfaces() {
+		zones[name] = firewalldZoneOf(name, false)
+		permanent[name] = firewalldZoneOf(name, true)
+	}
+	if err := writeJSONFile(filepath.Join(dir, firewalldInterfaceZonesFile), zones); err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(dir, firewalldPermanentInterfaceZonesFile), permanent); err != nil {
+		return err
+	}
+	previous, err := os.ReadFile(firewalldZonePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, firewalldZone+".xml"), previous, 0600)
+}
+
+// Restore puts back the qcd zone file as it was (or removes it), the default zone and
+// the runtime and permanent zone of every interface recorded in the snapshot.
+func (firewalldBackend) Restore(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "default-zone"))
+	if err != nil {
+		return err
+	}
+	zone := strings.TrimSpace(string(data))
+	previous, err := os.ReadFile(filepath.Join(dir, firewalldZone+".xml"))
+	hadZone := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if zone == firewalldZone && !hadZone {
+		// The qcd zone was the default but its file is gone, there is nothing to go back to
+		fmt.Println(NewMessage(chalk.Yellow, "The saved default zone "+firewalldZone+" has no saved zone file, using public instead"))
+		zone = "public"
+	}
+
+	zones, err := readInterfaceZones(dir, firewalldInterfaceZonesFile)
+	if err != nil {
+		return err
+	}
+	// Snapshots from before Apply bound interfaces permanently don't have these
+	permanent, err := readInterfaceZones(dir, firewalldPermanentInterfaceZonesFile)
+	if err != nil {
+		return err
+	}
+
+	if hadZone {
+		if err := os.WriteFile(firewalldZonePath, previous, 0644); err != nil {
+			return err
+		}
+		if err := RunCommand("firewall-cmd", "--reload"); err != nil {
+			return err
+		}
+	}
+	if err := RunCommand("firewall-cmd", "--set-default-zone="+zone); err != nil {
+		return err
+	}
+	if !hadZone {
+		if err := os.Remove(firewalldZonePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := RunCommand("firewall-cmd", "--reload"); err != nil {
+			return err
+		}
+	}
+
+	if zones == nil {
+		// Snapshots from before interface zones were recorded
+		zones = make(map[string]string)
+		for _, name := range firewalldInterfaces() {
+			zones[name] = zone
+		}
+	}
+	return errors.Join(restoreInterfaceZones(zones, false), restoreInterfaceZones(permanent, true))
+}
+
+// readInterfaceZones reads an interface to zone map from a snapshot, nil if the file
+// isn't there.
+func readInterfaceZones(dir, file string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var zones map[string]string
+	if err := json.Unmarshal(data, &zones); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", file, err)
+	}
+	return zones, nil
+}
+
+// restoreInterfaceZones binds every interface in zones back to its zone, or unbinds it
+// when the zone is "", in the runtime or the permanent configuration.
+func restoreInterfaceZones(zones map[string]string, permanent bool) error {
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		var args []string
+		if permanent {
+			args = append(args, "--permanent")
+		}
+		want, now := zones[name], firewalldZoneOf(name, permanent)
+		switch {
+		case want == now:
+			continue
+		case want == "":
+			args = append(args, "--zone="+now, "--remove-interface="+name)
+		default:
+			args = append(args, "--zone="+want, "--change-interface="+name)
+		}
+		if err := RunCommand("firewall-cmd", args...); err != nil {
+			errs = append(errs, fmt.Errorf("interface %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// firewalldZoneOf returns the zone an interface is bound to in the runtime or the
+// permanent configuration, "" when it has none.
+func firewalldZoneOf(name string, permanent bool) string {
+	args := []string{"--get-zone-of-interface=" + name}
+	if permanent {
+		args = append([]string{"--permanent"}, args...)
+	}
+	out, err := exec.Command("firewall-cmd", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Open moves every interface into the trusted zone until the next reload, leaving the
+// saved configuration alone.
+func (firewalldBackend) Open() error {
+	RunCommand("firewall-cmd", "--panic-off")
+	var errs []error
+	for _, name := range firewalldInterfaces() {
+		if err := RunCommand("firewall-cmd", "--zone=trusted", "--change-interface="+name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// firewalldInterfaces lists the interfaces that are up, except loopback.
+func firewalldInterfaces() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
+			names = append(names, iface.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,346 @@
+package cmd
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Stands in for firewall-cmd: the zone of each interface is a file in $FIREWALLD_STATE,
+// perm-iface-<name> for the permanent configuration, and every call is logged to
+// $FIREWALLD_STATE/log.
+const fakeFirewallCmd = `#!/bin/sh
+state=$FIREWALLD_STATE
+echo "$*" >> "$state/log"
+zone=
+prefix=iface-
+for arg; do
+	case $arg in
+	--permanent) prefix=perm-iface- ;;
+	--zone=*) zone=${arg#--zone=} ;;
+	--get-zone-of-interface=*)
+		f="$state/$prefix${arg#*=}"
+		[ -f "$f" ] || { echo "no zone" >&2; exit 2; }
+		cat "$f" ;;
+	--change-interface=*) echo "$zone" > "$state/$prefix${arg#*=}" ;;
+	--remove-interface=*) rm -f "$state/$prefix${arg#*=}" ;;
+	--set-default-zone=*) echo "${arg#*=}" > "$state/default" ;;
+	--get-default-zone) cat "$state/default" ;;
+	esac
+done
+`
+
+// useFakeFirewalld puts fakeFirewallCmd first in PATH with the given runtime and
+// permanent interface zones and returns its state directory.
+func useFakeFirewalld(t *testing.T, defaultZone string, zones, permanent map[string]string) string {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "firewall-cmd"), []byte(fakeFirewallCmd), 0755); err != nil {
+		t.Fatal(err)
+	}
+	state := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FIREWALLD_STATE", state)
+	if err := os.WriteFile(filepath.Join(state, "default"), []byte(defaultZone+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for prefix, m := range map[string]map[string]string{"iface-": zones, "perm-iface-": permanent} {
+		for name, zone := range m {
+			if err := os.WriteFile(filepath.Join(state, prefix+name), []byte(zone+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	oldPath := firewalldZonePath
+	firewalldZonePath = filepath.Join(t.TempDir(), firewalldZone+".xml")
+	t.Cleanup(func() { firewalldZonePath = oldPath })
+	return state
+}
+
+// fakeFirewalldZones reads back the zones of names from the fake's state, prefix picks
+// the runtime (iface-) or permanent (perm-iface-) configuration.
+func fakeFirewalldZones(state, prefix string, names []string) map[string]string {
+	zones := make(map[string]string)
+	for _, name := range names {
+		if data, err := os.ReadFile(filepath.Join(state, prefix+name)); err == nil {
+			zones[name] = strings.TrimSpace(string(data))
+		}
+	}
+	return zones
+}
+
+func TestFirewalldRestoreInterfaceZones(t *testing.T) {
+	allQcd := map[string]string{"eth0": firewalldZone, "eth1": firewalldZone, "eth2": firewalldZone}
+	tests := []struct {
+		name        string
+		defaultZone string
+		savedZone   string
+		zones       string
+		// Empty for snapshots taken before the permanent zones were recorded
+		permanent     string
+		wantDefault   string
+		wantZones     map[string]string
+		wantPermanent map[string]string
+	}{
+		{
+			name:          "zones before qcd",
+			defaultZone:   "public",
+			zones:         `{"eth0": "internal", "eth1": "", "eth2": "public"}`,
+			permanent:     `{"eth0": "internal", "eth1": "", "eth2": ""}`,
+			wantDefault:   "public",
+			wantZones:     map[string]string{"eth0": "internal", "eth2": "public"},
+			wantPermanent: map[string]string{"eth0": "internal"},
+		},
+		{
+			name:          "qcd was already the default",
+			defaultZone:   firewalldZone,
+			savedZone:     "<zone/>",
+			zones:         `{"eth0": "qcd", "eth1": "trusted", "eth2": ""}`,
+			permanent:     `{"eth0": "qcd", "eth1": "", "eth2": "trusted"}`,
+			wantDefault:   firewalldZone,
+			wantZones:     map[string]string{"eth0": firewalldZone, "eth1": "trusted"},
+			wantPermanent: map[string]string{"eth0": firewalldZone, "eth2": "trusted"},
+		},
+		{
+			name:          "qcd default without a saved zone",
+			defaultZone:   firewalldZone,
+			zones:         `{"eth0": "", "eth1": "", "eth2": ""}`,
+			permanent:     `{"eth0": "", "eth1": "", "eth2": ""}`,
+			wantDefault:   "public",
+			wantZones:     map[string]string{},
+			wantPermanent: map[string]string{},
+		},
+		{
+			name:          "no permanent zones in the snapshot",
+			defaultZone:   "public",
+			zones:         `{"eth0": "public", "eth1": "public", "eth2": "public"}`,
+			wantDefault:   "public",
+			wantZones:     map[string]string{"eth0": "public", "eth1": "public", "eth2": "public"},
+			wantPermanent: allQcd,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Everything is in the qcd zone, like after harden applied it
+			state := useFakeFirewalld(t, firewalldZone, allQcd, allQcd)
+			if err := os.WriteFile(firewalldZonePath, []byte("<zone>new</zone>"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot := t.TempDir()
+			files := map[string]string{
+				"default-zone":                       tt.defaultZone,
+				firewalldInterfaceZonesFile:          tt.zones,
+				firewalldPermanentInterfaceZonesFile: tt.permanent,
+				firewalldZone + ".xml":               tt.savedZone,
+			}
+			for name, content := range files {
+				if content == "" {
+					continue
+				}
+				if err := os.WriteFile(filepath.Join(snapshot, name), []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := (firewalldBackend{}).Restore(snapshot); err != nil {
+				t.Fatal(err)
+			}
+
+			def, _ := os.ReadFile(filepath.Join(state, "default"))
+			if got := strings.TrimSpace(string(def)); got != tt.wantDefault {
+				t.Errorf("default zone = %q, want %q", got, tt.wantDefault)
+			}
+			names := []string{"eth0", "eth1", "eth2"}
+			if got := fakeFirewalldZones(state, "iface-", names); !reflect.DeepEqual(got, tt.wantZones) {
+				t.Errorf("interface zones = %v, want %v", got, tt.wantZones)
+			}
+			if got := fakeFirewalldZones(state, "perm-iface-", names); !reflect.DeepEqual(got, tt.wantPermanent) {
+				t.Errorf("permanent interface zones = %v, want %v", got, tt.wantPermanent)
+			}
+			zone, err := os.ReadFile(firewalldZonePath)
+			switch {
+			case tt.savedZone == "" && err == nil:
+				t.Errorf("qcd zone file left behind: %s", zone)
+			case tt.savedZone != "" && string(zone) != tt.savedZone:
+				t.Errorf("qcd zone file = %q, %v, want %q", zone, err, tt.savedZone)
+			}
+		})
+	}
+}
+
+func TestFirewalldApplyBindsInterfacesPermanently(t *testing.T) {
+	names := firewalldInterfaces()
+	if len(names) == 0 {
+		t.Skip("no interfaces up besides loopback")
+	}
+	state := useFakeFirewalld(t, "public", nil, nil)
+	if err := (firewalldBackend{}).Apply(testRuleset()); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for _, name := range names {
+		want[name] = firewalldZone
+	}
+	if got := fakeFirewalldZones(state, "iface-", names); !reflect.DeepEqual(got, want) {
+		t.Errorf("interface zones = %v, want %v", got, want)
+	}
+	if got := fakeFirewalldZones(state, "perm-iface-", names); !reflect.DeepEqual(got, want) {
+		t.Errorf("permanent interface zones = %v, want %v", got, want)
+	}
+}
+
+func TestMultiportGroups(t *testing.T) {
+	many := make([]firewallPort, 17)
+	for i := range many {
+		many[i] = firewallPort{uint16(1000 + i), uint16(1000 + i)}
+	}
+	tests := []struct {
+		name  string
+		ports []firewallPort
+		want  []string
+	}{
+		{"none", nil, nil},
+		{"single", []firewallPort{{22, 22}}, []string{"22"}},
+		{"range", []firewallPort{{80, 80}, {8000, 8100}}, []string{"80,8000:8100"}},
+		{"split after 15", many, []string{
+			"1000,1001,1002,1003,1004,1005,1006,1007,1008,1009,1010,1011,1012,1013,1014",
+			"1015,1016",
+		}},
+		{"range doesn't fit", append(many[:14:14], firewallPort{2000, 2010}), []string{
+			"1000,1001,1002,1003,1004,1005,1006,1007,1008,1009,1010,1011,1012,1013",
+			"2000:2010",
+		}},
+	}
+	for _, tt := range tests {
+		if got := multiportGroups(tt.ports); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: multiportGroups = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderIptablesRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		v6      bool
+		modify  func(rs *firewallRuleset)
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "defaults",
+			want: []string{
+				":INPUT DROP [0:0]",
+				":OUTPUT ACCEPT [0:0]",
+				"-A INPUT -i lo -j ACCEPT",
+				"-A INPUT -p tcp -m multiport --dports 22 -j ACCEPT",
+				"-A INPUT -p tcp -m multiport --dports 80,443 -j ACCEPT",
+				"-A INPUT -p icmp -j ACCEPT",
+				"COMMIT",
+			},
+			notWant: []string{"-A OUTPUT", "-s ", "LOG"},
+		},
+		{
+			name: "ipv6 sources",
+			v6:   true,
+			modify: func(rs *firewallRuleset) {
+				rs.Sources = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+				rs.ICMP = "drop"
+			},
+			want: []string{
+				"-A INPUT -s fd00::/8 -p tcp -m multiport --dports 80,443 -j ACCEPT",
+				"-A INPUT -p ipv6-icmp --icmpv6-type neighbour-solicitation -j ACCEPT",
+			},
+			notWant: []string{"10.0.0.0/8", "-A INPUT -p ipv6-icmp -j ACCEPT"},
+		},
+		{
+			name: "management networks and logging",
+			modify: func(rs *firewallRuleset) {
+				rs.ManagementCIDRs = []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}
+				rs.Log = true
+			},
+			want: []string{
+				"-A INPUT -s 172.16.0.0/12 -p tcp -m multiport --dports 22 -j ACCEPT",
+				`-A INPUT -m limit --limit 10/minute -j LOG --log-prefix "qcd-drop: " --log-level info`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := testRuleset()
+			if tt.modify != nil {
+				tt.modify(rs)
+			}
+			out, err := renderIptablesRules(rs, tt.v6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRendered(t, out, tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestRenderFirewalldZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(rs *firewallRuleset)
+		want    []string
+		notWant []string
+		wantErr bool
+	}{
+		{
+			name:    "defaults",
+			want:    []string{`<zone target="DROP">`, `<port protocol="tcp" port="22"/>`, `<port protocol="tcp" port="443"/>`, `<protocol value="icmp"/>`},
+			notWant: []string{"<source"},
+		},
+		{
+			name: "sources",
+			modify: func(rs *firewallRuleset) {
+				rs.Sources = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+				rs.Profiles = []string{"web & <mail>"}
+			},
+			want: []string{
+				`<rule family="ipv4"><source address="10.0.0.0/8"/><port protocol="tcp" port="80"/><accept/></rule>`,
+				`<rule family="ipv6"><source address="fd00::/8"/><port protocol="tcp" port="443"/><accept/></rule>`,
+				"web &amp; &lt;mail&gt;",
+			},
+			notWant: []string{"\n  <port protocol=\"tcp\" port=\"80\"/>"},
+		},
+		{
+			name:    "egress",
+			modify:  func(rs *firewallRuleset) { rs.Egress = &firewallEgress{} },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := testRuleset()
+			if tt.modify != nil {
+				tt.modify(rs)
+			}
+			out, err := firewalldBackend{}.Render(rs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Render error = %v, want error %v", err, tt.wantErr)
+			}
+			checkRendered(t, out, tt.want, tt.notWant)
+		})
+	}
+}
+
+func checkRendered(t *testing.T, out string, want, notWant []string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("missing %q in:\n%s", w, out)
+		}
+	}
+	for _, w := range notWant {
+		if strings.Contains(out, w) {
+			t.Errorf("unexpected %q in:\n%s", w, out)
+		}
+	}
+}
@@ -0,0 +1,843 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/ttacon/chalk"
+)
+
+var checkFile string
+var checkLive bool
+
+var hardenCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate the firewall ruleset without applying it",
+	Long: `Validates the rules generated for --sys with the firewall backend's own tool (nft -c, iptables-restore --test, or the zone XML for firewalld). It also checks that the management ports and the service ports of the system type stay reachable from where they have to be (firewall.management_cidrs, firewall.sources and firewall.scoring_cidrs). Rules the check doesn't understand (jumps to other chains, rate limits, named sets) are reported when they could change the outcome, since it can't tell either way.
+--file checks an nftables ruleset file instead, --live checks reachability through the ruleset that is loaded right now (anything nft can list, including iptables-nft and firewalld rules). Exits with status 1 on any problem.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rs, err := buildFirewallRuleset(systemType)
+		if CheckError(err) {
+			os.Exit(1)
+		}
+
+		var problems []firewallProblem
+		switch {
+		case checkLive:
+			rules, err := liveFirewallRuleset()
+			if CheckError(err) {
+				os.Exit(1)
+			}
+			problems = checkFirewallReachable(rs, rules)
+		case checkFile != "":
+			data, err := os.ReadFile(checkFile)
+			if CheckError(err) {
+				os.Exit(1)
+			}
+			if problems, err = nftCheck(string(data)); CheckError(err) {
+				os.Exit(1)
+			}
+			problems = append(problems, checkFirewallReachable(rs, string(data))...)
+		default:
+			backend, err := selectFirewallBackend()
+			if CheckError(err) {
+				os.Exit(1)
+			}
+			fmt.Println(NewMessage(chalk.Blue, "Checking the "+backend.Name()+" rules..."))
+			if problems, err = backend.Check(rs); CheckError(err) {
+				os.Exit(1)
+			}
+		}
+
+		if len(problems) > 0 {
+			printFirewallProblems(problems)
+			fmt.Println(NewMessage(chalk.Red, fmt.Sprintf("%d problem(s) found", len(problems))))
+			os.Exit(1)
+		}
+		fmt.Println(NewMessage(chalk.Green, "Ruleset is valid and keeps the required ports reachable"))
+	},
+}
+
+func init() {
+	hardenCmd.AddCommand(hardenCheckCmd)
+	hardenCheckCmd.Flags().StringVar(&checkFile, "file", "", "Check this ruleset file instead of the generated one")
+	hardenCheckCmd.Flags().BoolVar(&checkLive, "live", false, "Check the loaded ruleset instead of the generated one")
+}
+
+// firewallProblem is one finding of the pre-flight check, with the ruleset line it is
+// about when there is one.
+type firewallProblem struct {
+	Line    int
+	Message string
+	Source  string
+}
+
+func printFirewallProblems(problems []firewallProblem) {
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Println(NewMessage(chalk.Red, fmt.Sprintf("line %d:", p.Line)).ThenColor(chalk.White, p.Message))
+		} else {
+			fmt.Println(NewMessage(chalk.Red, p.Message))
+		}
+		if p.Source != "" {
+			fmt.Println("    " + p.Source)
+		}
+	}
+}
+
+// preflightFirewall refuses rules the backend won't load or that cut off the management
+// or service ports.
+func preflightFirewall(backend firewallBackend, rs *firewallRuleset) error {
+	problems, err := backend.Check(rs)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		printFirewallProblems(problems)
+		return fmt.Errorf("ruleset failed the pre-flight check with %d problem(s), see qcd harden check", len(problems))
+	}
+	return nil
+}
+
+// liveFirewallRuleset lists the loaded ruleset with numeric ports and addresses.
+func liveFirewallRuleset() (string, error) {
+	out, err := exec.Command("nft", "-nn", "list", "ruleset").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not list the loaded ruleset: %w", err)
+	}
+	return string(out), nil
+}
+
+// Location prefix nft puts on errors: file:line:column[-column]: Error: message
+var nftErrorPattern = regexp.MustCompile(`^.*:(\d+):\d+(?:-\d+)?: Error: (.*)$`)
+
+// nftCheck has nft parse and validate the ruleset without loading it and returns the
+// errors it reports.
+func nftCheck(rules string) ([]firewallProblem, error) {
+	path, err := writeTempFile("qcd-check-*.nft", rules)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	out, err := exec.Command("nft", "-c", "-f", path).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return nil, nil
+	} else if !errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("could not run nft -c: %w", err)
+	}
+
+	lines := strings.Split(rules, "\n")
+	var problems []firewallProblem
+	for _, l := range strings.Split(string(out), "\n") {
+		m := nftErrorPattern.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		p := firewallProblem{Message: m[2]}
+		p.Line, _ = strconv.Atoi(m[1])
+		if p.Line > 0 && p.Line <= len(lines) {
+			p.Source = strings.TrimSpace(lines[p.Line-1])
+		}
+		problems = append(problems, p)
+	}
+	if len(problems) == 0 {
+		problems = append(problems, firewallProblem{Message: "nft -c failed: " + strings.TrimSpace(string(out))})
+	}
+	return problems, nil
+}
+
+// firewallRequirement is traffic the ruleset has to let in.
+type firewallRequirement struct {
+	Proto  string
+	Port   firewallPort
+	Source netip.Prefix
+	Role   string
+}
+
+func (r firewallRequirement) String() string {
+	from := r.Source.String()
+	if r.Source.Bits() == 0 {
+		from = "anywhere (IPv4)"
+		if r.Source.Addr().Is6() {
+			from = "anywhere (IPv6)"
+		}
+	}
+	return fmt.Sprintf("%s/%s (%s) from %s", r.Proto, r.Port, r.Role, from)
+}
+
+var anywhere = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// firewallRequirements lists what has to stay reachable: the management ports from the
+// management networks, the service ports from the allowed sources and the scoring engine.
+func firewallRequirements(rs *firewallRuleset) []firewallRequirement {
+	var reqs []firewallRequirement
+	add := func(proto, role string, ports []firewallPort, sources []netip.Prefix) {
+		for _, port := range ports {
+			for _, src := range sources {
+				reqs = append(reqs, firewallRequirement{Proto: proto, Port: port, Source: src, Role: role})
+			}
+		}
+	}
+
+	management := rs.ManagementCIDRs
+	if len(management) == 0 {
+		management = anywhere
+	}
+	add("tcp", "management", rs.ManagementPorts, management)
+
+	services := anywhere
+	if len(rs.Sources) > 0 {
+		services = append(slices.Clone(rs.Sources), rs.ScoringCIDRs...)
+	}
+	add("tcp", "service", rs.TCPPorts, services)
+	add("udp", "service", rs.UDPPorts, services)
+	return reqs
+}
+
+// checkFirewallReachable walks every input filter chain of the ruleset for each
+// requirement and reports the ones a rule or chain policy would drop.
+func checkFirewallReachable(rs *firewallRuleset, rules string) []firewallProblem {
+	return checkChainsReachable(rs, parseNftRuleset(rules))
+}
+
+// checkChainsReachable checks the requirements against parsed input chains, whichever
+// tool they came from. Rules the parser didn't understand are reported as unverifiable
+// when they could change the outcome.
+func checkChainsReachable(rs *firewallRuleset, chains []*nftChain) []firewallProblem {
+	var problems []firewallProblem
+	for _, req := range firewallRequirements(rs) {
+		for _, c := range chains {
+			if !c.appliesTo(req) {
+				continue
+			}
+			rule, unsure := c.verdict(req)
+			accepted := rule == nil && c.Policy != "drop" || rule != nil && rule.Verdict == "accept"
+			if unsure != nil && !(unsure.Verdict == "accept" && accepted) && !(unsure.Verdict == "drop" && !accepted) {
+				problems = append(problems, firewallProblem{
+					Line:    unsure.Line,
+					Message: fmt.Sprintf("cannot verify %s, this rule in %s %s isn't understood", req, c.Table, c.Name),
+					Source:  unsure.Text,
+				})
+				break
+			}
+			if accepted {
+				continue
+			}
+			if rule == nil {
+				problems = append(problems, firewallProblem{Message: fmt.Sprintf("%s is dropped by the policy of %s %s", req, c.Table, c.Name)})
+				break
+			}
+			problems = append(problems, firewallProblem{
+				Line:    rule.Line,
+				Message: fmt.Sprintf("%s is dropped by this rule in %s %s", req, c.Table, c.Name),
+				Source:  rule.Text,
+			})
+			break
+		}
+	}
+	return problems
+}
+
+// nftChain is a base chain of a ruleset, as far as the reachability check needs it.
+type nftChain struct {
+	Family string
+	Table  string
+	Name   string
+	Type   string
+	Hook   string
+	Policy string
+	Rules  []nftRule
+}
+
+// nftRule is a rule reduced to what it matches on. Rules that can't match new inbound
+// TCP or UDP connections, or don't end in a verdict, have no Verdict and are skipped.
+// Rules with a verdict that match on something the parser doesn't know are Unverifiable,
+// with Family, Proto, Ports and Sources holding what was understood.
+type nftRule struct {
+	Line         int
+	Text         string
+	Family       string
+	Proto        string
+	Ports        []firewallPort
+	Sources      []netip.Prefix
+	Verdict      string
+	Unverifiable bool
+}
+
+func (c *nftChain) appliesTo(req firewallRequirement) bool {
+	if c.Type != "filter" || c.Hook != "input" {
+		return false
+	}
+	switch c.Family {
+	case "inet":
+		return true
+	case "ip":
+		return req.Source.Addr().Is4()
+	case "ip6":
+		return req.Source.Addr().Is6()
+	}
+	return false
+}
+
+// verdict returns the first rule deciding about req, nil when the policy does, and the
+// first unverifiable rule before it that might have decided instead.
+func (c *nftChain) verdict(req firewallRequirement) (*nftRule, *nftRule) {
+	var unsure *nftRule
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		switch {
+		case r.Verdict == "":
+		case r.Unverifiable:
+			if unsure == nil && r.overlaps(req) {
+				unsure = r
+			}
+		case r.matches(req):
+			return r, unsure
+		}
+	}
+	return nil, unsure
+}
+
+// matches reports whether the rule covers all of req, so that a rule about part of a
+// network or port range doesn't decide for the rest of it.
+func (r *nftRule) matches(req firewallRequirement) bool {
+	if r.Family != "" && (r.Family == "ip") != req.Source.Addr().Is4() {
+		return false
+	}
+	if r.Proto != "" && r.Proto != req.Proto {
+		return false
+	}
+	if r.Ports != nil && !slices.ContainsFunc(r.Ports, func(p firewallPort) bool {
+		return p.From <= req.Port.From && req.Port.To <= p.To
+	}) {
+		return false
+	}
+	if r.Sources != nil && !slices.ContainsFunc(r.Sources, func(p netip.Prefix) bool {
+		return p.Addr().Is4() == req.Source.Addr().Is4() && p.Bits() <= req.Source.Bits() && p.Contains(req.Source.Addr())
+	}) {
+		return false
+	}
+	return true
+}
+
+// overlaps reports whether the rule could match any of req.
+func (r *nftRule) overlaps(req firewallRequirement) bool {
+	if r.Family != "" && (r.Family == "ip") != req.Source.Addr().Is4() {
+		return false
+	}
+	if r.Proto != "" && r.Proto != req.Proto {
+		return false
+	}
+	if r.Ports != nil && !slices.ContainsFunc(r.Ports, func(p firewallPort) bool {
+		return p.From <= req.Port.To && req.Port.From <= p.To
+	}) {
+		return false
+	}
+	if r.Sources != nil && !slices.ContainsFunc(r.Sources, func(p netip.Prefix) bool {
+		return p.Addr().Is4() == req.Source.Addr().Is4() && p.Overlaps(req.Source)
+	}) {
+		return false
+	}
+	return true
+}
+
+// parseNftRuleset picks the base chains and their rules out of nft syntax, either a
+// script like the generated one or nft list ruleset output.
+func parseNftRuleset(rules string) []*nftChain {
+	var chains []*nftChain
+	var family, table string
+	var chain *nftChain
+	// Blocks we are in: table, chain or anything else (sets, maps, multi-line elements)
+	var blocks []string
+
+	for i, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		depth := strings.Count(line, "{") - strings.Count(line, "}")
+		inside := ""
+		if len(blocks) > 0 {
+			inside = blocks[len(blocks)-1]
+		}
+
+		switch {
+		case inside == "" && fields[0] == "table" && len(fields) >= 3 && depth > 0:
+			// The family is optional and defaults to ip
+			family, table = fields[1], fields[2]
+			if table == "{" {
+				family, table = "ip", fields[1]
+			}
+			blocks = append(blocks, "table")
+			continue
+		case inside == "table" && fields[0] == "chain" && len(fields) >= 2 && depth > 0:
+			chain = &nftChain{Family: family, Table: family + " " + table, Name: fields[1], Policy: "accept"}
+			chains = append(chains, chain)
+			blocks = append(blocks, "chain")
+			continue
+		case line == "}" && len(blocks) > 0:
+			blocks = blocks[:len(blocks)-1]
+			continue
+		case inside == "chain" && depth == 0:
+			if fields[0] == "type" || fields[0] == "policy" {
+				parseNftChainHeader(chain, fields)
+			} else {
+				chain.Rules = append(chain.Rules, parseNftRule(i+1, line))
+			}
+			continue
+		}
+
+		for ; depth > 0; depth-- {
+			blocks = append(blocks, "other")
+		}
+		for ; depth < 0 && len(blocks) > 0; depth++ {
+			blocks = blocks[:len(blocks)-1]
+		}
+	}
+
+	var base []*nftChain
+	for _, c := range chains {
+		if c.Hook != "" {
+			base = append(base, c)
+		}
+	}
+	return base
+}
+
+// parseNftChainHeader reads "type filter hook input priority 0; policy drop;".
+func parseNftChainHeader(c *nftChain, fields []string) {
+	for i := 0; i+1 < len(fields); i++ {
+		value := strings.TrimSuffix(fields[i+1], ";")
+		switch fields[i] {
+		case "type":
+			c.Type = value
+		case "hook":
+			c.Hook = value
+		case "policy":
+			c.Policy = value
+		}
+	}
+}
+
+// parseNftRule reduces one rule of an nft chain to an nftRule.
+func parseNftRule(line int, text string) nftRule {
+	r := nftRule{Line: line, Text: text}
+	// What is returned for rules that can't affect new TCP or UDP connections
+	skipped := r
+	unknown := false
+	tokens := nftTokens(text)
+	for i := 0; i < len(tokens) && r.Verdict == ""; i++ {
+		t, next := tokens[i], ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+
+		switch {
+		case (t == "ip" || t == "ip6") && next == "saddr":
+			values, n := nftValues(tokens[i+2:])
+			sources, err := parseFirewallCIDRs(values)
+			if values == nil || err != nil {
+				unknown = true
+				break
+			}
+			r.Family, r.Sources = t, sources
+			i += 1 + n
+		case (t == "iif" || t == "iifname") && next != "":
+			values, n := nftValues(tokens[i+1:])
+			// Loopback traffic never comes from the networks the check is about
+			if len(values) == 1 && strings.Trim(values[0], `"`) == "lo" {
+				return skipped
+			}
+			unknown = true
+			i += n
+		case (t == "ip" && next == "protocol") || (t == "meta" && next == "l4proto"):
+			values, n := nftValues(tokens[i+2:])
+			if len(values) != 1 {
+				unknown = true
+				break
+			}
+			if t == "ip" {
+				r.Family = "ip"
+			}
+			r.Proto = values[0]
+			i += 1 + n
+		case (t == "icmp" || t == "icmpv6") && next == "type":
+			r.Proto = "icmp"
+			_, n := nftValues(tokens[i+2:])
+			i += 1 + n
+		case (t == "tcp" || t == "udp" || t == "th") && next == "dport":
+			values, n := nftValues(tokens[i+2:])
+			ports, err := parseFirewallPorts(values)
+			if values == nil || err != nil {
+				unknown = true
+				break
+			}
+			if t != "th" {
+				r.Proto = t
+			}
+			r.Ports = ports
+			i += 1 + n
+		case t == "ct" && next == "state":
+			values, n := nftValues(tokens[i+2:])
+			if values == nil {
+				unknown = true
+				break
+			}
+			// Only rules that see new connections decide whether they get through
+			if !slices.Contains(values, "new") {
+				return skipped
+			}
+			i += 1 + n
+		case t == "counter":
+			for i+2 < len(tokens) && (tokens[i+1] == "packets" || tokens[i+1] == "bytes") {
+				i += 2
+			}
+		case t == "comment":
+			i++
+		case t == "log":
+			for i+2 < len(tokens) && slices.Contains([]string{"prefix", "level", "group", "flags"}, tokens[i+1]) {
+				i += 2
+			}
+		case t == "accept" || t == "drop":
+			r.Verdict = t
+		case t == "reject":
+			r.Verdict = "drop"
+		case t == "jump" || t == "goto" || t == "queue" || t == "return":
+			// The check doesn't follow other chains
+			r.Verdict = t
+			unknown = true
+		default:
+			unknown = true
+		}
+	}
+	return finishRule(r, skipped, unknown)
+}
+
+// finishRule decides what a parsed rule means for the check: skipped when it has no
+// verdict or can't be about TCP and UDP, unverifiable when part of it wasn't understood.
+func finishRule(r, skipped nftRule, unknown bool) nftRule {
+	if r.Verdict == "" || r.Proto != "" && r.Proto != "tcp" && r.Proto != "udp" {
+		return skipped
+	}
+	r.Unverifiable = unknown
+	return r
+}
+
+// nftValues reads a single value or an anonymous set, returning nil for negations and
+// named sets it can't see into.
+func nftValues(tokens []string) ([]string, int) {
+	if len(tokens) == 0 || tokens[0] == "!=" || strings.HasPrefix(tokens[0], "@") || strings.HasPrefix(tokens[0], "$") {
+		return nil, 0
+	}
+	if tokens[0] != "{" {
+		return strings.Split(tokens[0], ","), 1
+	}
+	var values []string
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i] == "}" {
+			return values, i + 1
+		}
+		values = append(values, tokens[i])
+	}
+	return nil, 0
+}
+
+// nftTokens splits a rule into words, keeping quoted strings whole and making braces
+// and the elements between them their own tokens.
+func nftTokens(text string) []string {
+	var tokens []string
+	var cur strings.Builder
+	quoted := false
+	inSet := false
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, c := range text {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			cur.WriteRune(c)
+		case quoted:
+			cur.WriteRune(c)
+		case c == '{' || c == '}':
+			flush()
+			tokens = append(tokens, string(c))
+			inSet = c == '{'
+		case c == ' ' || c == '\t' || (c == ',' && inSet):
+			flush()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// parseIptablesRules picks the INPUT chain of the filter table out of iptables-restore
+// input, for the family ("ip" or "ip6") the rules are for.
+func parseIptablesRules(rules, family string) []*nftChain {
+	tool := "iptables"
+	if family == "ip6" {
+		tool = "ip6tables"
+	}
+	var input *nftChain
+	table := ""
+	for i, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case table != "filter":
+		case fields[0] == ":INPUT" && len(fields) >= 2:
+			input = &nftChain{Family: family, Table: tool + " filter", Name: "INPUT", Type: "filter", Hook: "input", Policy: strings.ToLower(fields[1])}
+		case input != nil && fields[0] == "-A" && len(fields) >= 2 && fields[1] == "INPUT":
+			input.Rules = append(input.Rules, parseIptablesRule(i+1, line))
+		}
+	}
+	if input == nil {
+		return nil
+	}
+	return []*nftChain{input}
+}
+
+// parseIptablesRule reduces one -A INPUT line to an nftRule.
+func parseIptablesRule(line int, text string) nftRule {
+	r := nftRule{Line: line, Text: text}
+	skipped := r
+	unknown := false
+	tokens := nftTokens(text)
+	for i := 2; i < len(tokens); i++ {
+		t, next := tokens[i], ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+
+		switch t {
+		case "-i", "--in-interface":
+			if next == "lo" {
+				return skipped
+			}
+			unknown = true
+			i++
+		case "-s", "--source":
+			sources, err := parseFirewallCIDRs(strings.Split(next, ","))
+			if err != nil {
+				unknown = true
+			}
+			r.Sources = sources
+			i++
+		case "-p", "--protocol":
+			switch next {
+			case "tcp", "udp":
+				r.Proto = next
+			case "icmp", "ipv6-icmp", "icmpv6":
+				r.Proto = "icmp"
+			default:
+				unknown = true
+			}
+			i++
+		case "-m", "--match":
+			if !slices.Contains([]string{"tcp", "udp", "multiport", "conntrack", "state", "comment", "icmp", "icmp6"}, next) {
+				unknown = true
+			}
+			i++
+		case "--dport", "--dports", "--destination-port", "--destination-ports":
+			ports, err := parseFirewallPorts(strings.Split(strings.ReplaceAll(next, ":", "-"), ","))
+			if err != nil {
+				unknown = true
+			}
+			r.Ports = ports
+			i++
+		case "--ctstate", "--state":
+			// Only rules that see new connections decide whether they get through
+			if !slices.Contains(strings.Split(next, ","), "NEW") {
+				return skipped
+			}
+			i++
+		case "--icmp-type", "--icmpv6-type", "--comment", "--log-prefix", "--log-level", "--reject-with":
+			i++
+		case "-j", "--jump", "-g", "--goto":
+			switch next {
+			case "ACCEPT":
+				r.Verdict = "accept"
+			case "DROP", "REJECT":
+				r.Verdict = "drop"
+			case "LOG":
+				// Logs and carries on
+			default:
+				// The check doesn't follow other chains
+				r.Verdict = strings.ToLower(next)
+				unknown = true
+			}
+			i++
+		default:
+			unknown = true
+		}
+	}
+	return finishRule(r, skipped, unknown)
+}
+
+// firewalldZoneRule is a rich rule of a zone, the parts of it the check understands.
+type firewalldZoneRule struct {
+	Family string `xml:"family,attr"`
+	Source *struct {
+		Address string `xml:"address,attr"`
+		Invert  string `xml:"invert,attr"`
+	} `xml:"source"`
+	Port *struct {
+		Protocol string `xml:"protocol,attr"`
+		Port     string `xml:"port,attr"`
+	} `xml:"port"`
+	Protocol *struct {
+		Value string `xml:"value,attr"`
+	} `xml:"protocol"`
+	ICMPType *struct{} `xml:"icmp-type"`
+	Accept   *struct {
+		Limit *struct{} `xml:"limit"`
+	} `xml:"accept"`
+	Drop   *struct{} `xml:"drop"`
+	Reject *struct{} `xml:"reject"`
+	Other  []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// parseFirewalldZone turns a zone file into a single input chain: plain ports and rich
+// rules in the order they appear, with the zone target as the policy.
+func parseFirewalldZone(zone string) ([]*nftChain, error) {
+	c := &nftChain{Family: "inet", Table: "firewalld zone", Name: firewalldZone, Type: "filter", Hook: "input", Policy: "drop"}
+	lines := strings.Split(zone, "\n")
+	dec := xml.NewDecoder(strings.NewReader(zone))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			// firewalld runs deny rules before allow rules, wherever they are in the file
+			slices.SortStableFunc(c.Rules, func(a, b nftRule) int {
+				return cmpBool(a.Verdict != "drop", b.Verdict != "drop")
+			})
+			return []*nftChain{c}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch el := tok.(type) {
+		case xml.EndElement:
+			depth--
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				for _, a := range el.Attr {
+					// default rejects what the zone doesn't allow, like DROP and REJECT
+					if a.Name.Local == "target" && a.Value == "ACCEPT" {
+						c.Policy = "accept"
+					}
+				}
+				continue
+			}
+			if depth != 2 {
+				continue
+			}
+			line, _ := dec.InputPos()
+			r := nftRule{Line: line}
+			if line > 0 && line <= len(lines) {
+				r.Text = strings.TrimSpace(lines[line-1])
+			}
+			switch el.Name.Local {
+			case "port":
+				var port struct {
+					Protocol string `xml:"protocol,attr"`
+					Port     string `xml:"port,attr"`
+				}
+				if err := dec.DecodeElement(&port, &el); err != nil {
+					return nil, err
+				}
+				depth--
+				r.Proto, r.Verdict = port.Protocol, "accept"
+				var perr error
+				if r.Ports, perr = parseFirewallPorts([]string{port.Port}); perr != nil {
+					r.Unverifiable = true
+				}
+				c.Rules = append(c.Rules, finishRule(r, nftRule{Line: line, Text: r.Text}, r.Unverifiable))
+			case "rule":
+				var rule firewalldZoneRule
+				if err := dec.DecodeElement(&rule, &el); err != nil {
+					return nil, err
+				}
+				depth--
+				c.Rules = append(c.Rules, rule.nftRule(r))
+			case "short", "description", "interface", "icmp-block", "icmp-block-inversion", "masquerade", "forward":
+			default:
+				// Services, sources, forwards and the like
+				r.Verdict, r.Unverifiable = "accept", true
+				c.Rules = append(c.Rules, r)
+				dec.Skip()
+				depth--
+			}
+		}
+	}
+}
+
+// nftRule reduces a rich rule to an nftRule, keeping r's line and text.
+func (z *firewalldZoneRule) nftRule(r nftRule) nftRule {
+	skipped := r
+	unknown := len(z.Other) > 0
+	switch z.Family {
+	case "ipv4":
+		r.Family = "ip"
+	case "ipv6":
+		r.Family = "ip6"
+	}
+	if z.Source != nil {
+		sources, err := parseFirewallCIDRs([]string{z.Source.Address})
+		unknown = unknown || err != nil || z.Source.Invert == "true" || z.Source.Invert == "yes"
+		r.Sources = sources
+	}
+	if z.Port != nil {
+		ports, err := parseFirewallPorts([]string{z.Port.Port})
+		unknown = unknown || err != nil
+		r.Proto, r.Ports = z.Port.Protocol, ports
+	}
+	if z.Protocol != nil {
+		r.Proto = z.Protocol.Value
+	}
+	if z.ICMPType != nil {
+		r.Proto = "icmp"
+	}
+	switch {
+	case z.Accept != nil:
+		r.Verdict = "accept"
+		unknown = unknown || z.Accept.Limit != nil
+	case z.Drop != nil || z.Reject != nil:
+		r.Verdict = "drop"
+	}
+	return finishRule(r, skipped, unknown)
+}
+
+func cmpBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
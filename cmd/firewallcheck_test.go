@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNftRule(t *testing.T) {
+	tests := []struct {
+		text string
+		want nftRule
+	}{
+		{`tcp dport { 22, 80 } accept`, nftRule{Proto: "tcp", Ports: []firewallPort{{22, 22}, {80, 80}}, Verdict: "accept"}},
+		{`ip saddr { 10.0.0.0/8, 192.0.2.1 } udp dport 53 counter packets 4 bytes 240 accept`, nftRule{
+			Family: "ip", Proto: "udp", Ports: []firewallPort{{53, 53}}, Verdict: "accept",
+			Sources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.1/32")},
+		}},
+		{`ip6 saddr fd00::/8 tcp dport 8000-8100 reject with tcp reset`, nftRule{
+			Family: "ip6", Proto: "tcp", Ports: []firewallPort{{8000, 8100}}, Verdict: "drop",
+			Sources: []netip.Prefix{netip.MustParsePrefix("fd00::/8")},
+		}},
+		{`ct state new tcp dport 22 log prefix "ssh: " level info accept`, nftRule{Proto: "tcp", Ports: []firewallPort{{22, 22}}, Verdict: "accept"}},
+		{`meta l4proto tcp drop`, nftRule{Proto: "tcp", Verdict: "drop"}},
+		{`th dport 53 accept comment "dns"`, nftRule{Ports: []firewallPort{{53, 53}}, Verdict: "accept"}},
+		// Can't affect new TCP or UDP connections
+		{`iif "lo" accept`, nftRule{}},
+		{`ct state established,related accept`, nftRule{}},
+		{`ct state invalid drop`, nftRule{}},
+		{`ip protocol icmp accept`, nftRule{}},
+		{`icmp type echo-request limit rate 5/second accept`, nftRule{}},
+		{`limit rate 10/minute log prefix "qcd-drop: " level info`, nftRule{}},
+		{`counter`, nftRule{}},
+		// Not understood
+		{`tcp dport 22 limit rate 5/minute accept`, nftRule{Proto: "tcp", Ports: []firewallPort{{22, 22}}, Verdict: "accept", Unverifiable: true}},
+		{`ip saddr @blocklist drop`, nftRule{Verdict: "drop", Unverifiable: true}},
+		{`ip saddr != 10.0.0.0/8 tcp dport 22 drop`, nftRule{Proto: "tcp", Ports: []firewallPort{{22, 22}}, Verdict: "drop", Unverifiable: true}},
+		{`iifname "eth0" tcp dport 22 accept`, nftRule{Proto: "tcp", Ports: []firewallPort{{22, 22}}, Verdict: "accept", Unverifiable: true}},
+		{`jump filter_INPUT_ZONES`, nftRule{Verdict: "jump", Unverifiable: true}},
+		{`ct state new,untracked jump input_public`, nftRule{Verdict: "jump", Unverifiable: true}},
+	}
+	for _, tt := range tests {
+		got := parseNftRule(7, tt.text)
+		tt.want.Line, tt.want.Text = 7, tt.text
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseNftRule(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFirewallReachable(t *testing.T) {
+	const header = "table inet filter {\n\tchain input {\n\t\ttype filter hook input priority 0; policy drop;\n"
+	const footer = "\t}\n}\n"
+	tests := []struct {
+		name     string
+		rules    string
+		problems []string
+	}{
+		{
+			name:  "everything allowed",
+			rules: header + "\t\tiif \"lo\" accept\n\t\tct state established,related accept\n\t\ttcp dport { 22, 80, 443 } accept\n" + footer,
+		},
+		{
+			name:     "port missing",
+			rules:    header + "\t\ttcp dport { 22, 80 } accept\n" + footer,
+			problems: []string{"tcp/443 (service) from anywhere (IPv4) is dropped by the policy of inet filter input", "tcp/443 (service) from anywhere (IPv6) is dropped by the policy"},
+		},
+		{
+			name:     "dropped by a rule",
+			rules:    header + "\t\ttcp dport 80 drop\n\t\ttcp dport { 22, 80, 443 } accept\n" + footer,
+			problems: []string{"tcp/80 (service) from anywhere (IPv4) is dropped by this rule", "tcp/80 (service) from anywhere (IPv6) is dropped by this rule"},
+		},
+		{
+			name:     "accepted only from part of the network",
+			rules:    header + "\t\tip saddr 10.0.0.0/8 tcp dport { 22, 80, 443 } accept\n\t\tip6 saddr ::/0 tcp dport { 22, 80, 443 } accept\n" + footer,
+			problems: []string{"tcp/22 (management) from anywhere (IPv4) is dropped", "tcp/80 (service) from anywhere (IPv4) is dropped", "tcp/443 (service) from anywhere (IPv4) is dropped"},
+		},
+		{
+			name:     "rate limited accept in a drop policy chain",
+			rules:    header + "\t\ttcp dport 22 limit rate 5/minute accept\n\t\ttcp dport { 80, 443 } accept\n" + footer,
+			problems: []string{"cannot verify tcp/22 (management) from anywhere (IPv4)", "cannot verify tcp/22 (management) from anywhere (IPv6)"},
+		},
+		{
+			name:     "jump before the accept",
+			rules:    header + "\t\tjump input_zones\n\t\ttcp dport { 22, 80, 443 } accept\n" + footer,
+			problems: []string{"cannot verify tcp/22", "cannot verify tcp/22", "cannot verify tcp/80", "cannot verify tcp/80", "cannot verify tcp/443", "cannot verify tcp/443"},
+		},
+		{
+			name:  "unknown accept before a full accept",
+			rules: header + "\t\tiifname \"eth0\" tcp dport 22 accept\n\t\ttcp dport { 22, 80, 443 } accept\n" + footer,
+		},
+		{
+			name:  "unknown rule about other ports",
+			rules: header + "\t\ttcp dport 3306 limit rate 1/second accept\n\t\ttcp dport { 22, 80, 443 } accept\n" + footer,
+		},
+		{
+			name:     "unknown drop in an accept policy chain",
+			rules:    "table ip filter {\n\tchain input {\n\t\ttype filter hook input priority 0; policy accept;\n\t\tip saddr @blocklist drop\n" + footer,
+			problems: []string{"cannot verify tcp/22 (management) from anywhere (IPv4)", "cannot verify tcp/80", "cannot verify tcp/443"},
+		},
+		{
+			name:  "other hooks",
+			rules: "table inet filter {\n\tchain output {\n\t\ttype filter hook output priority 0; policy drop;\n\t}\n}\n",
+		},
+	}
+	rs := testRuleset()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := checkFirewallReachable(rs, tt.rules)
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("got %d problems, want %d: %+v", len(problems), len(tt.problems), problems)
+			}
+			for i, want := range tt.problems {
+				if !strings.Contains(problems[i].Message, want) {
+					t.Errorf("problem %d = %q, want it to contain %q", i, problems[i].Message, want)
+				}
+			}
+		})
+	}
+}
+
+// Every backend's own rendering of a ruleset has to pass its reachability check.
+func TestRenderedRulesetsReachable(t *testing.T) {
+	rulesets := map[string]func(rs *firewallRuleset){
+		"defaults": func(rs *firewallRuleset) {},
+		"sources": func(rs *firewallRuleset) {
+			rs.UDPPorts = []firewallPort{{53, 53}}
+			rs.Sources = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+			rs.ScoringCIDRs = []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")}
+		},
+		"management and limits": func(rs *firewallRuleset) {
+			rs.ManagementCIDRs = []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12"), netip.MustParsePrefix("2001:db8::/32")}
+			rs.TCPPorts = append(rs.TCPPorts, firewallPort{8000, 8100})
+			rs.ICMP = "limit"
+			rs.Log = true
+		},
+	}
+	for name, modify := range rulesets {
+		rs := testRuleset()
+		modify(rs)
+		for _, backend := range []firewallBackend{nftablesBackend{}, iptablesBackend{}, firewalldBackend{}} {
+			chains := renderedChains(t, backend, rs)
+			if len(chains) == 0 {
+				t.Errorf("%s %s: no input chain found", name, backend.Name())
+			}
+			if problems := checkChainsReachable(rs, chains); len(problems) > 0 {
+				t.Errorf("%s %s: %+v", name, backend.Name(), problems)
+			}
+		}
+	}
+}
+
+// renderedChains renders rs with backend and parses the result back the way that
+// backend's Check does, both address families for iptables.
+func renderedChains(t *testing.T, backend firewallBackend, rs *firewallRuleset) []*nftChain {
+	t.Helper()
+	rules, err := backend.Render(rs)
+	if err != nil {
+		t.Fatalf("%s: %v", backend.Name(), err)
+	}
+	var chains []*nftChain
+	switch backend.(type) {
+	case nftablesBackend:
+		chains = parseNftRuleset(rules)
+	case iptablesBackend:
+		for _, v6 := range []bool{false, true} {
+			family := "ip"
+			if v6 {
+				family = "ip6"
+			}
+			r, err := renderIptablesRules(rs, v6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chains = append(chains, parseIptablesRules(r, family)...)
+		}
+	case firewalldBackend:
+		if chains, err = parseFirewalldZone(rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return chains
+}
+
+func TestParseIptablesRules(t *testing.T) {
+	rules := `*nat
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -p tcp --dport 80 -j REDIRECT --to-ports 8080
+COMMIT
+*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+-A INPUT -i lo -j ACCEPT
+-A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+-A INPUT -s 10.0.0.0/8,192.0.2.1 -p tcp -m multiport --dports 22,8000:8100 -j ACCEPT
+-A INPUT -p udp --dport 53 -j REJECT --reject-with icmp-port-unreachable
+-A INPUT -m limit --limit 10/minute -j LOG --log-prefix "qcd drop: " --log-level info
+-A INPUT -p tcp -m recent --name ssh --set -j ACCEPT
+-A INPUT -j f2b-sshd
+-A FORWARD -p tcp -j ACCEPT
+COMMIT
+`
+	chains := parseIptablesRules(rules, "ip")
+	if len(chains) != 1 || chains[0].Policy != "drop" || chains[0].Family != "ip" || chains[0].Hook != "input" {
+		t.Fatalf("chains = %+v, want one ip input chain with policy drop", chains)
+	}
+	var got []string
+	for _, r := range chains[0].Rules {
+		got = append(got, summarizeRule(r))
+	}
+	want := []string{
+		"skipped",
+		"skipped",
+		"accept tcp 22,8000-8100 from 10.0.0.0/8,192.0.2.1/32",
+		"drop udp 53",
+		"skipped",
+		"accept tcp (unverifiable)",
+		"f2b-sshd (unverifiable)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestParseFirewalldZone(t *testing.T) {
+	zone := `<?xml version="1.0" encoding="utf-8"?>
+<zone target="default">
+  <short>qcd</short>
+  <service name="ssh"/>
+  <port protocol="tcp" port="80"/>
+  <rule family="ipv4"><source address="10.0.0.0/8"/><port protocol="tcp" port="443"/><accept/></rule>
+  <rule family="ipv4"><source address="10.9.0.0/16"/><port protocol="tcp" port="443"/><reject/></rule>
+  <rule><icmp-type name="echo-request"/><accept><limit value="5/s"/></accept></rule>
+</zone>`
+	chains, err := parseFirewalldZone(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 1 || chains[0].Policy != "drop" {
+		t.Fatalf("chains = %+v, want one chain with policy drop", chains)
+	}
+	rules := chains[0].Rules
+	if len(rules) != 5 {
+		t.Fatalf("got %d rules, want 5: %+v", len(rules), rules)
+	}
+	// Deny rules go first, like firewalld orders them
+	if rules[0].Verdict != "drop" || rules[0].Line != 7 || !strings.Contains(rules[0].Text, "reject") {
+		t.Errorf("first rule = %+v, want the reject rule from line 7", rules[0])
+	}
+	if !rules[1].Unverifiable || rules[1].Line != 4 {
+		t.Errorf("service rule = %+v, want it unverifiable", rules[1])
+	}
+	if rules[2].Proto != "tcp" || fmtPorts(rules[2].Ports) != "80" || rules[2].Verdict != "accept" {
+		t.Errorf("port rule = %+v", rules[2])
+	}
+	if rules[3].Family != "ip" || len(rules[3].Sources) != 1 || rules[3].Verdict != "accept" {
+		t.Errorf("rich rule = %+v", rules[3])
+	}
+	if rules[4].Verdict != "" {
+		t.Errorf("icmp rule = %+v, want it skipped", rules[4])
+	}
+}
+
+func fmtPorts(ports []firewallPort) string {
+	s := make([]string, len(ports))
+	for i, p := range ports {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// summarizeRule describes what the check made of a rule in one line.
+func summarizeRule(r nftRule) string {
+	if r.Verdict == "" {
+		return "skipped"
+	}
+	parts := []string{r.Verdict}
+	if r.Proto != "" {
+		parts = append(parts, r.Proto)
+	}
+	if r.Ports != nil {
+		parts = append(parts, fmtPorts(r.Ports))
+	}
+	if r.Sources != nil {
+		sources := make([]string, len(r.Sources))
+		for i, p := range r.Sources {
+			sources[i] = p.String()
+		}
+		parts = append(parts, "from "+strings.Join(sources, ","))
+	}
+	if r.Unverifiable {
+		parts = append(parts, "(unverifiable)")
+	}
+	return strings.Join(parts, " ")
+}
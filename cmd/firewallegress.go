@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// firewallEgress is the outbound half of the ruleset: new connections are dropped unless
+// one of Rules allows them, and DenyUsers can't open any except through exempt rules.
+// Replies to inbound connections always get out.
+type firewallEgress struct {
+	Rules     []firewallEgressRule
+	DenyUsers []firewallEgressUser
+	Log       bool
+	LogPrefix string
+	LogRate   string
+}
+
+// firewallEgressRule allows outbound connections to Ports, at Dests or anywhere when
+// Dests is empty.
+type firewallEgressRule struct {
+	Name  string
+	Proto string
+	Ports []firewallPort
+	Dests []netip.Prefix
+	// Also open to DenyUsers, rendered ahead of the deny rules
+	Exempt bool
+}
+
+type firewallEgressUser struct {
+	Name string
+	UID  int
+}
+
+// buildFirewallEgress assembles the outbound rules from firewall.egress and the egress
+// parts of the selected profiles.
+func buildFirewallEgress(profiles []firewallProfile, logRate string) (*firewallEgress, error) {
+	eg := &firewallEgress{LogRate: logRate}
+	eg.Log = !viper.IsSet("firewall.egress.log") || viper.GetBool("firewall.egress.log")
+	var err error
+	if eg.LogPrefix, err = firewallLogPrefix("firewall.egress.log_prefix", "qcd-egress-drop: "); err != nil {
+		return nil, err
+	}
+
+	resolverValues := viper.GetStringSlice("firewall.egress.resolvers")
+	if len(resolverValues) == 0 {
+		resolverValues = systemResolvers()
+	}
+	resolvers, err := parseFirewallCIDRs(resolverValues)
+	if err != nil {
+		return nil, fmt.Errorf("firewall.egress.resolvers: %w", err)
+	}
+	if len(resolvers) > 0 {
+		eg.add("DNS to resolvers", "udp", []firewallPort{{53, 53}}, resolvers)
+		eg.add("DNS to resolvers", "tcp", []firewallPort{{53, 53}}, resolvers)
+	}
+
+	ntp, err := resolveEgressDests(viper.GetStringSlice("firewall.egress.ntp"))
+	if err != nil {
+		return nil, fmt.Errorf("firewall.egress.ntp: %w", err)
+	}
+	eg.add("NTP", "udp", []firewallPort{{123, 123}}, ntp)
+
+	mirrors, err := resolveEgressDests(viper.GetStringSlice("firewall.egress.mirrors"))
+	if err != nil {
+		return nil, fmt.Errorf("firewall.egress.mirrors: %w", err)
+	}
+	if len(mirrors) > 0 {
+		eg.add("package mirrors", "tcp", []firewallPort{{80, 80}, {443, 443}}, mirrors)
+	}
+
+	indexers, err := resolveEgressDests(viper.GetStringSlice("firewall.egress.splunk_indexers"))
+	if err != nil {
+		return nil, fmt.Errorf("firewall.egress.splunk_indexers: %w", err)
+	}
+	if len(indexers) > 0 {
+		values := viper.GetStringSlice("firewall.egress.splunk_ports")
+		if len(values) == 0 {
+			values = []string{"9997"}
+		}
+		ports, err := parseFirewallPorts(values)
+		if err != nil {
+			return nil, fmt.Errorf("firewall.egress.splunk_ports: %w", err)
+		}
+		// The splunk profile denies the splunk user, which is the one forwarding
+		eg.Rules = append(eg.Rules, firewallEgressRule{Name: "Splunk forwarding", Proto: "tcp", Ports: ports, Dests: indexers, Exempt: true})
+	}
+
+	if err := eg.addReplicas(); err != nil {
+		return nil, err
+	}
+
+	tcp := viper.GetStringSlice("firewall.egress.tcp_ports")
+	udp := viper.GetStringSlice("firewall.egress.udp_ports")
+	users := viper.GetStringSlice("firewall.egress.deny_users")
+	for _, p := range profiles {
+		tcp = append(tcp, p.EgressTCPPorts...)
+		udp = append(udp, p.EgressUDPPorts...)
+		users = append(users, p.EgressDenyUsers...)
+	}
+	tcpPorts, err := parseFirewallPorts(tcp)
+	if err != nil {
+		return nil, fmt.Errorf("egress tcp ports: %w", err)
+	}
+	if len(tcpPorts) > 0 {
+		eg.add("outbound services", "tcp", tcpPorts, nil)
+	}
+	udpPorts, err := parseFirewallPorts(udp)
+	if err != nil {
+		return nil, fmt.Errorf("egress udp ports: %w", err)
+	}
+	if len(udpPorts) > 0 {
+		eg.add("outbound services", "udp", udpPorts, nil)
+	}
+
+	for _, name := range users {
+		// Service accounts differ between distributions, only deny the ones that exist
+		u, err := user.Lookup(name)
+		if err != nil {
+			continue
+		}
+		uid, err := strconv.Atoi(u.Uid)
+		if err != nil || slices.ContainsFunc(eg.DenyUsers, func(d firewallEgressUser) bool { return d.UID == uid }) {
+			continue
+		}
+		eg.DenyUsers = append(eg.DenyUsers, firewallEgressUser{Name: name, UID: uid})
+	}
+	return eg, nil
+}
+
+func (eg *firewallEgress) add(name, proto string, ports []firewallPort, dests []netip.Prefix) {
+	eg.Rules = append(eg.Rules, firewallEgressRule{Name: name, Proto: proto, Ports: ports, Dests: dests})
+}
+
+// addReplicas allows the uploads to backup.replicas: SSH for sftp replicas, the port
+// of the URL for qcd peers.
+func (eg *firewallEgress) addReplicas() error {
+	replicas, err := loadReplicas()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			return err
+		}
+		port := u.Port()
+		if port == "" {
+			switch {
+			case r.Type == "sftp":
+				port = "22"
+			case u.Scheme == "http":
+				port = "80"
+			default:
+				port = "443"
+			}
+		}
+		ports, err := parseFirewallPorts([]string{port})
+		if err != nil {
+			return fmt.Errorf("replica %s: %w", r.Name, err)
+		}
+		dests, err := resolveEgressDests([]string{u.Hostname()})
+		if err != nil {
+			return fmt.Errorf("replica %s: %w", r.Name, err)
+		}
+		eg.add("backup replica "+r.Name, "tcp", ports, dests)
+	}
+	return nil
+}
+
+// ExemptRules lists the rules that go before the deny rules for the templates.
+func (eg *firewallEgress) ExemptRules() []firewallEgressRule {
+	var rules []firewallEgressRule
+	for _, r := range eg.Rules {
+		if r.Exempt {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// OtherRules lists the rules that go after the deny rules for the templates.
+func (eg *firewallEgress) OtherRules() []firewallEgressRule {
+	var rules []firewallEgressRule
+	for _, r := range eg.Rules {
+		if !r.Exempt {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// DenyUIDs lists the denied users' UIDs for the templates.
+func (eg *firewallEgress) DenyUIDs() []string {
+	uids := make([]string, len(eg.DenyUsers))
+	for i, u := range eg.DenyUsers {
+		uids[i] = strconv.Itoa(u.UID)
+	}
+	return uids
+}
+
+// DenyNames lists the denied users' names for the templates.
+func (eg *firewallEgress) DenyNames() []string {
+	names := make([]string, len(eg.DenyUsers))
+	for i, u := range eg.DenyUsers {
+		names[i] = u.Name
+	}
+	return names
+}
+
+// resolveEgressDests parses addresses and networks, looking up host names. Names are
+// resolved once, when the rules are generated.
+func resolveEgressDests(values []string) ([]netip.Prefix, error) {
+	var dests []netip.Prefix
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if p, err := parseFirewallCIDRs([]string{v}); err == nil {
+			dests = append(dests, p...)
+			continue
+		}
+		ips, err := net.LookupIP(v)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %q: %w", v, err)
+		}
+		for _, ip := range ips {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addr = addr.Unmap()
+				dests = append(dests, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+	}
+	return dests, nil
+}
+
+var (
+	resolvConfPath = "/etc/resolv.conf"
+	// The upstream servers when /etc/resolv.conf points at the systemd-resolved stub
+	resolvedConfPath = "/run/systemd/resolve/resolv.conf"
+)
+
+// Address of the systemd-resolved stub listener
+const resolvedStub = "127.0.0.53"
+
+// systemResolvers reads the name servers from /etc/resolv.conf. The systemd-resolved stub
+// is reached over loopback, which is always allowed, but resolved itself has to reach
+// its upstream servers, so those are added from its own resolv.conf.
+func systemResolvers() []string {
+	servers := readNameservers(resolvConfPath)
+	if slices.Contains(servers, resolvedStub) {
+		for _, s := range readNameservers(resolvedConfPath) {
+			if !slices.Contains(servers, s) {
+				servers = append(servers, s)
+			}
+		}
+	}
+	return servers
+}
+
+// readNameservers returns the nameserver entries of a resolv.conf file.
+func readNameservers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			// Drop IPv6 zones like fe80::1%eth0
+			addr, _, _ := strings.Cut(fields[1], "%")
+			servers = append(servers, addr)
+		}
+	}
+	return servers
+}
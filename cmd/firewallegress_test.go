@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSystemResolvers(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolv   string
+		resolved string
+		want     []string
+	}{
+		{"plain", "search example.com\nnameserver 192.0.2.53\nnameserver fe80::1%eth0\n", "nameserver 198.51.100.1\n", []string{"192.0.2.53", "fe80::1"}},
+		{"resolved stub", "nameserver 127.0.0.53\noptions edns0 trust-ad\n", "# upstreams\nnameserver 198.51.100.1\nnameserver 2001:db8::53\n", []string{"127.0.0.53", "198.51.100.1", "2001:db8::53"}},
+		{"stub and a server", "nameserver 127.0.0.53\nnameserver 198.51.100.1\n", "nameserver 198.51.100.1\n", []string{"127.0.0.53", "198.51.100.1"}},
+		{"stub without resolved", "nameserver 127.0.0.53\n", "", []string{"127.0.0.53"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			oldResolv, oldResolved := resolvConfPath, resolvedConfPath
+			t.Cleanup(func() { resolvConfPath, resolvedConfPath = oldResolv, oldResolved })
+			resolvConfPath = filepath.Join(dir, "resolv.conf")
+			resolvedConfPath = filepath.Join(dir, "resolved.conf")
+			if err := os.WriteFile(resolvConfPath, []byte(tt.resolv), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.resolved != "" {
+				if err := os.WriteFile(resolvedConfPath, []byte(tt.resolved), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := systemResolvers(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("systemResolvers() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirewallEgressReplicas(t *testing.T) {
+	useConfig(t, map[string]interface{}{
+		"firewall.egress.resolvers": []string{"192.0.2.53"},
+		"backup.replicas": []interface{}{
+			map[string]interface{}{"name": "sftp", "url": "sftp://qcd@192.0.2.7/srv/backups"},
+			map[string]interface{}{"name": "sftp port", "url": "sftp://qcd@192.0.2.7:2222/srv/backups"},
+			map[string]interface{}{"name": "peer", "url": "https://192.0.2.8:7443", "token": "t"},
+			map[string]interface{}{"name": "peer v6", "url": "https://[2001:db8::8]", "token": "t"},
+			map[string]interface{}{"name": "plain", "url": "http://192.0.2.9", "token": "t", "allow_insecure": true},
+		},
+	})
+	eg, err := buildFirewallEgress(nil, "10/minute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]firewallEgressRule{
+		"backup replica sftp":      {Proto: "tcp", Ports: []firewallPort{{22, 22}}, Dests: []netip.Prefix{netip.MustParsePrefix("192.0.2.7/32")}},
+		"backup replica sftp port": {Proto: "tcp", Ports: []firewallPort{{2222, 2222}}, Dests: []netip.Prefix{netip.MustParsePrefix("192.0.2.7/32")}},
+		"backup replica peer":      {Proto: "tcp", Ports: []firewallPort{{7443, 7443}}, Dests: []netip.Prefix{netip.MustParsePrefix("192.0.2.8/32")}},
+		"backup replica peer v6":   {Proto: "tcp", Ports: []firewallPort{{443, 443}}, Dests: []netip.Prefix{netip.MustParsePrefix("2001:db8::8/128")}},
+		"backup replica plain":     {Proto: "tcp", Ports: []firewallPort{{80, 80}}, Dests: []netip.Prefix{netip.MustParsePrefix("192.0.2.9/32")}},
+	}
+	got := make(map[string]firewallEgressRule)
+	for _, r := range eg.Rules {
+		if strings.HasPrefix(r.Name, "backup replica ") {
+			name := r.Name
+			r.Name = ""
+			got[name] = r
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replica rules = %v, want %v", got, want)
+	}
+}
+
+func TestFirewallEgressExemptBeforeDeny(t *testing.T) {
+	useConfig(t, map[string]interface{}{
+		"firewall.egress.resolvers":       []string{"192.0.2.53"},
+		"firewall.egress.splunk_indexers": []string{"192.0.2.20"},
+		"firewall.egress.deny_users":      []string{"root"},
+	})
+	eg, err := buildFirewallEgress(nil, "10/minute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eg.DenyUsers) != 1 {
+		t.Fatalf("deny users = %v, want root", eg.DenyUsers)
+	}
+	rs := testRuleset()
+	rs.Egress = eg
+
+	nft, err := renderNftRuleset(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, err := renderIptablesRules(rs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name                  string
+		out                   string
+		indexers, deny, other string
+	}{
+		{"nftables", nft, "ip daddr { 192.0.2.20 } tcp dport { 9997 } accept", "meta skuid { 0 } drop", "ip daddr { 192.0.2.53 } udp dport { 53 } accept"},
+		{"iptables", v4, "-A OUTPUT -d 192.0.2.20 -p tcp -m multiport --dports 9997 -j ACCEPT", "-A OUTPUT -m owner --uid-owner 0 -j DROP", "-A OUTPUT -d 192.0.2.53 -p udp -m multiport --dports 53 -j ACCEPT"},
+	}
+	for _, tt := range tests {
+		indexers, deny, other := strings.Index(tt.out, tt.indexers), strings.Index(tt.out, tt.deny), strings.Index(tt.out, tt.other)
+		if indexers < 0 || deny < 0 || other < 0 {
+			t.Errorf("%s: missing rules in:\n%s", tt.name, tt.out)
+			continue
+		}
+		if indexers > deny || other < deny {
+			t.Errorf("%s: want the indexers before the deny rule and DNS after it:\n%s", tt.name, tt.out)
+		}
+		if strings.Count(tt.out, tt.indexers) != 1 {
+			t.Errorf("%s: indexer rule rendered more than once:\n%s", tt.name, tt.out)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Used when firewall.confirm_timeout isn't in the config
+const defaultFirewallConfirmTimeout = 120
+
+const firewallPendingFile = "pending.json"
+const firewallSnapshotDir = "previous"
+
+// Names the backend that took the snapshot, so a later rollback uses the same one
+const firewallSnapshotBackendFile = "backend"
+
+var confirmTimeout int
+
+// firewallPending is an applied ruleset that hasn't been confirmed yet. The rollback
+// timer restores the snapshot directory once Deadline passes, unless the file is gone or
+// belongs to a newer apply by then.
+type firewallPending struct {
+	ID       string    `json:"id"`
+	Applied  time.Time `json:"applied"`
+	Deadline time.Time `json:"deadline"`
+	Snapshot string    `json:"snapshot"`
+}
+
+var hardenConfirmCmd = &cobra.Command{
+	Use:   "confirm",
+	Short: "Keep the firewall applied by harden and cancel the automatic rollback",
+	Run: func(cmd *cobra.Command, args []string) {
+		pending, err := confirmFirewall()
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		if pending == nil {
+			fmt.Println(NewMessage(chalk.Yellow, "No firewall change is waiting for confirmation"))
+			return
+		}
+		fmt.Println(NewMessage(chalk.Green, "Firewall applied at "+pending.Applied.Local().Format(time.DateTime)+" confirmed, rollback cancelled"))
+	},
+}
+
+var hardenRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Restore the ruleset that was active before the last harden",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := rollbackFirewall(""); CheckError(err) {
+			os.Exit(1)
+		}
+		fmt.Println(NewMessage(chalk.Green, "Previous firewall ruleset restored"))
+	},
+}
+
+// Started detached by harden, waits for the deadline and rolls back unless confirmed
+var hardenRollbackTimerCmd = &cobra.Command{
+	Use:    "rollback-timer <id>",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runFirewallRollbackTimer(args[0]); CheckError(err) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	hardenCmd.AddCommand(hardenConfirmCmd)
+	hardenCmd.AddCommand(hardenRollbackCmd)
+	hardenCmd.AddCommand(hardenRollbackTimerCmd)
+	hardenCmd.Flags().IntVar(&confirmTimeout, "confirm-timeout", 0, "Seconds to wait for qcd harden confirm before restoring the old ruleset, 0 to apply without rollback (default firewall.confirm_timeout)")
+}
+
+func firewallStateDir() string {
+	return filepath.Join(qcdStateDir(), "firewall")
+}
+
+// firewallConfirmTimeout is how long an applied ruleset may go unconfirmed, zero when
+// the dead-man switch is off.
+func firewallConfirmTimeout(cmd *cobra.Command) time.Duration {
+	seconds := defaultFirewallConfirmTimeout
+	if cmd.Flags().Changed("confirm-timeout") {
+		seconds = confirmTimeout
+	} else if viper.IsSet("firewall.confirm_timeout") {
+		seconds = viper.GetInt("firewall.confirm_timeout")
+	}
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// lockFirewallState serializes harden, confirm and the rollback timer.
+func lockFirewallState() (*os.File, error) {
+	dir := firewallStateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func readFirewallPending() (*firewallPending, error) {
+	pending := &firewallPending{}
+	err := readStateJSON(filepath.Join("firewall", firewallPendingFile), pending)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// armFirewallRollback has the backend snapshot the live rules and starts the rollback
+// timer before new rules go in. While an earlier apply is still unconfirmed its snapshot
+// is kept, so a rollback always returns to the last confirmed rules.
+func armFirewallRollback(backend firewallBackend, timeout time.Duration) (*firewallPending, error) {
+	lock, err := lockFirewallState()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	previous, err := readFirewallPending()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := filepath.Join(firewallStateDir(), firewallSnapshotDir)
+	if previous != nil {
+		fmt.Println(NewMessage(chalk.Yellow, "The firewall applied at "+previous.Applied.Local().Format(time.DateTime)+" was never confirmed, a rollback will restore the ruleset from before it"))
+		snapshot = previous.Snapshot
+	} else {
+		if err := os.RemoveAll(snapshot); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(snapshot, 0700); err != nil {
+			return nil, err
+		}
+		if err := backend.Snapshot(snapshot); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(snapshot, firewallSnapshotBackendFile), []byte(backend.Name()), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	pending := &firewallPending{
+		ID:       hex.EncodeToString(id),
+		Applied:  time.Now(),
+		Deadline: time.Now().Add(timeout),
+		Snapshot: snapshot,
+	}
+	if err := writeJSONFile(filepath.Join(firewallStateDir(), firewallPendingFile), pending); err != nil {
+		return nil, err
+	}
+	if err := startFirewallRollbackTimer(pending.ID); err != nil {
+		os.Remove(filepath.Join(firewallStateDir(), firewallPendingFile))
+		return nil, fmt.Errorf("could not start the rollback timer: %w", err)
+	}
+	return pending, nil
+}
+
+// startFirewallRollbackTimer runs the rollback timer in its own session so it outlives
+// harden and the SSH connection harden may have just cut off.
+func startFirewallRollbackTimer(id string) error {
+	command, err := selfCommand()
+	if err != nil {
+		return err
+	}
+	command = append(command, "harden", "rollback-timer", id)
+
+	log, err := os.OpenFile(filepath.Join(firewallStateDir(), "rollback.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	c := exec.Command(command[0], command[1:]...)
+	c.Stdout = log
+	c.Stderr = log
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Process.Release()
+}
+
+// extendFirewallRollback restarts the countdown once the new ruleset is in, so slow
+// nftbuild downloads don't eat into the time to confirm.
+func extendFirewallRollback(pending *firewallPending, timeout time.Duration) error {
+	lock, err := lockFirewallState()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	current, err := readFirewallPending()
+	if err != nil {
+		return err
+	}
+	if current == nil || current.ID != pending.ID {
+		return fmt.Errorf("the rollback was cancelled or replaced while applying")
+	}
+	pending.Deadline = time.Now().Add(timeout)
+	return writeJSONFile(filepath.Join(firewallStateDir(), firewallPendingFile), pending)
+}
+
+func confirmFirewall() (*firewallPending, error) {
+	lock, err := lockFirewallState()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	pending, err := readFirewallPending()
+	if err != nil || pending == nil {
+		return nil, err
+	}
+	// The timer notices the file is gone and exits
+	if err := os.Remove(filepath.Join(firewallStateDir(), firewallPendingFile)); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// rollbackFirewall restores the saved ruleset and drops the pending apply. With an id it
+// only acts if that apply is still the pending one. If the saved ruleset can't be
+// restored the firewall is opened, so an unconfirmed apply never stays in place.
+func rollbackFirewall(id string) error {
+	lock, err := lockFirewallState()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	pending, err := readFirewallPending()
+	if err != nil {
+		return err
+	}
+	if id != "" && (pending == nil || pending.ID != id) {
+		return nil
+	}
+	snapshot := filepath.Join(firewallStateDir(), firewallSnapshotDir)
+	if pending != nil {
+		snapshot = pending.Snapshot
+	}
+	name, err := os.ReadFile(filepath.Join(snapshot, firewallSnapshotBackendFile))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no saved ruleset to restore in %s", snapshot)
+	} else if err != nil {
+		return err
+	}
+	backend, err := firewallBackendByName(string(name))
+	if err != nil {
+		return err
+	}
+
+	if err := backend.Restore(snapshot); err != nil {
+		// Rules that were never confirmed may lock everyone out, an open firewall doesn't
+		fmt.Println(NewMessage(chalk.Red, "Failed to restore "+snapshot+": "+err.Error()).ThenColor(chalk.White, "(opening the firewall instead)"))
+		if openErr := backend.Open(); openErr != nil {
+			return fmt.Errorf("failed to restore %s: %w, and failed to open the firewall: %w", snapshot, err, openErr)
+		}
+		if pending != nil {
+			os.Remove(filepath.Join(firewallStateDir(), firewallPendingFile))
+		}
+		return fmt.Errorf("failed to restore %s, the firewall was opened instead and the host is unfiltered: %w", snapshot, err)
+	}
+	if pending != nil {
+		if err := os.Remove(filepath.Join(firewallStateDir(), firewallPendingFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runFirewallRollbackTimer waits until the pending apply id is confirmed, replaced or
+// past its deadline, rolling back in the last case.
+func runFirewallRollbackTimer(id string) error {
+	for {
+		pending, err := readFirewallPending()
+		if err != nil {
+			return err
+		}
+		if pending == nil || pending.ID != id {
+			fmt.Println(NewMessage(chalk.Green, "Firewall apply "+id+" confirmed or replaced, rollback timer exiting"))
+			return nil
+		}
+		if time.Now().After(pending.Deadline) {
+			fmt.Println(NewMessage(chalk.Red, "Firewall apply "+id+" was not confirmed by "+pending.Deadline.Local().Format(time.DateTime)+", restoring "+pending.Snapshot))
+			if err := rollbackFirewall(id); err != nil {
+				return err
+			}
+			fmt.Println(NewMessage(chalk.Green, "Previous firewall ruleset restored"))
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
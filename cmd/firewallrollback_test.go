@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFirewall records which of Restore and Open ran.
+type fakeFirewall struct {
+	restoreErr error
+	openErr    error
+	calls      *[]string
+}
+
+func (fakeFirewall) Name() string                                         { return "fake" }
+func (fakeFirewall) Render(rs *firewallRuleset) (string, error)           { return "", nil }
+func (fakeFirewall) Check(rs *firewallRuleset) ([]firewallProblem, error) { return nil, nil }
+func (fakeFirewall) Apply(rs *firewallRuleset) error                      { return nil }
+func (fakeFirewall) Snapshot(dir string) error                            { return nil }
+
+func (f fakeFirewall) Restore(dir string) error {
+	*f.calls = append(*f.calls, "restore")
+	return f.restoreErr
+}
+
+func (f fakeFirewall) Open() error {
+	*f.calls = append(*f.calls, "open")
+	return f.openErr
+}
+
+func TestRollbackFirewallFailsOpen(t *testing.T) {
+	tests := []struct {
+		name        string
+		restoreErr  error
+		openErr     error
+		calls       string
+		wantErr     string
+		keepPending bool
+	}{
+		{name: "restored", calls: "restore"},
+		{name: "restore fails", restoreErr: errors.New("nft: syntax error"), calls: "restore open", wantErr: "opened instead"},
+		{name: "open fails too", restoreErr: errors.New("nft: syntax error"), openErr: errors.New("nft: not found"), calls: "restore open", wantErr: "failed to open", keepPending: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			var calls []string
+			firewallBackends["fake"] = fakeFirewall{restoreErr: tt.restoreErr, openErr: tt.openErr, calls: &calls}
+			t.Cleanup(func() { delete(firewallBackends, "fake") })
+
+			snapshot := filepath.Join(firewallStateDir(), firewallSnapshotDir)
+			if err := os.MkdirAll(snapshot, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(snapshot, firewallSnapshotBackendFile), []byte("fake"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			pending := &firewallPending{ID: "abc", Applied: time.Now(), Deadline: time.Now(), Snapshot: snapshot}
+			if err := writeJSONFile(filepath.Join(firewallStateDir(), firewallPendingFile), pending); err != nil {
+				t.Fatal(err)
+			}
+
+			err := rollbackFirewall("abc")
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("rollbackFirewall() = %v, want error containing %q", err, tt.wantErr)
+			}
+			if got := strings.Join(calls, " "); got != tt.calls {
+				t.Errorf("calls = %q, want %q", got, tt.calls)
+			}
+			left, err := readFirewallPending()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (left != nil) != tt.keepPending {
+				t.Errorf("pending apply left = %v, want %v", left != nil, tt.keepPending)
+			}
+		})
+	}
+}
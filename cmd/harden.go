@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -15,25 +16,57 @@ import (
 //go:embed embedded/audit.rules
 var auditRules string
 
-//go:embed embedded/nft/mail-fallback.nft
-var mailFallbackNft string
-
-//go:embed embedded/nft/splunk-fallback.nft
-var splunkFallbackNft string
-
 var firewallOnly bool
 var noNftBuild bool
+var printFirewallRules bool
 
 var hardenCmd = &cobra.Command{
 	Use:   "harden",
 	Short: "Harden the system and apply firewall rules",
-	Long:  `Applies various hardening measures including firewall rules, locking down cron/at, and enforcing nologin shells.`,
+	Long: `Applies various hardening measures including firewall rules, locking down cron/at, and enforcing nologin shells.
+The rules go in with nftables, iptables-restore/ip6tables-restore or as a firewalld zone, per firewall.backend (auto picks firewalld when it is running, then nftables, then iptables).
+With the nftables backend harden first runs nftbuild, which has to match firewall.nftbuild.sha256: a qcd built with -tags nftbuild_embed runs its embedded copy, otherwise the cached copy at firewall.nftbuild.path (default under state_dir) or a fresh download from firewall.nftbuild.url is used. Without a pinned checksum nftbuild is refused.
+Without nftbuild the firewall is rendered from the firewall.profiles entry for --sys (built in: mail, web, ecommerce, dns, ftp, database, ad, splunk, and generic for no --sys, which only opens the management ports) plus the global firewall settings:
+  tcp_ports/udp_ports       extra service ports (e.g. ["8443", "6000-6010"])
+  sources                   only allow the service ports from these networks (default anywhere)
+  scoring_cidrs             scoring engine addresses, always allowed to the services and ICMP
+  management_ports/_cidrs   SSH and other admin ports, and who may reach them
+  icmp                      accept, limit or drop
+  log, log_prefix, log_rate log dropped inbound packets
+With firewall.egress.enabled outbound connections are dropped too, except replies and what firewall.egress allows (nftables and iptables only):
+  resolvers                 DNS servers (default the nameservers in /etc/resolv.conf, and systemd-resolved's upstreams when that is its stub)
+  ntp, mirrors              NTP servers (default anywhere) and package mirrors, names are resolved when the rules are generated
+  splunk_indexers/_ports    where forwarders send to (default port 9997), allowed even for deny_users
+  tcp_ports/udp_ports       other outbound ports, added to the profile's egress_tcp_ports/egress_udp_ports
+  deny_users                service accounts that may not open connections at all, added to the profile's egress_deny_users
+  log, log_prefix           log dropped outbound packets
+The hosts in backup.replicas are always allowed, on the SFTP port or the port of the receiver's URL.
+Use --print-rules to see the generated ruleset without applying it. Before anything is applied the ruleset goes through the backend's own check (nft -c, iptables-restore --test, XML) and, for nftables, a check that the management and service ports stay reachable (see harden check); nftbuild's result is checked after it runs and replaced by the generated rules if it fails.
+The ruleset from before is saved first and restored automatically unless 'qcd harden confirm' is run within firewall.confirm_timeout seconds (--confirm-timeout, 0 turns this off), so a ruleset that locks you out undoes itself. 'qcd harden rollback' restores it by hand. If the old ruleset can't be restored, the firewall is opened instead of leaving the unconfirmed rules in place.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		// Rendered up front so a bad --sys or firewall config stops before anything changes
+		rs, err := buildFirewallRuleset(systemType)
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		backend, err := selectFirewallBackend()
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		rules, err := backend.Render(rs)
+		if CheckError(err) {
+			os.Exit(1)
+		}
+		if printFirewallRules {
+			fmt.Print(rules)
+			return
+		}
+
 		fmt.Println(NewMessage(chalk.Green, "Starting System Hardening..."))
 
 		// Firewall Logic
-		fmt.Println(NewMessage(chalk.Blue, "Applying Firewall Rules..."))
-		if err := applyFirewall(); err != nil {
+		fmt.Println(NewMessage(chalk.Blue, "Applying Firewall Rules with "+backend.Name()+"..."))
+		if err := applyFirewall(backend, rs, firewallConfirmTimeout(cmd)); err != nil {
 			fmt.Println(NewMessage(chalk.Red, "Error applying firewall: "+err.Error()))
 		} else {
 			fmt.Println(NewMessage(chalk.Green, "Firewall Applied Successfully!"))
@@ -65,59 +98,77 @@ func init() {
 	rootCmd.AddCommand(hardenCmd)
 	hardenCmd.Flags().BoolVarP(&firewallOnly, "firewall-only", "f", false, "Only run firewall logic")
 	hardenCmd.Flags().BoolVarP(&noNftBuild, "no-nftbuild", "n", false, "Do not attempt to use nftbuild script (use embedded fallback rules only)")
+	hardenCmd.Flags().BoolVarP(&printFirewallRules, "print-rules", "p", false, "Print the generated firewall ruleset and exit")
 }
 
-func applyFirewall() error {
-	// 1. Attempt to download nftbuild
-	nftBuildUrl := "https://github.com/UWStout-CCDC/CCDC-scripts/raw/refs/heads/master/firewall/host_firewall/nftbuild"
-	nftBuildPath := "/tmp/nftbuild"
+// applyFirewall checks the ruleset and installs it behind the dead-man switch: unless
+// confirmed in time the ruleset from before is restored.
+func applyFirewall(backend firewallBackend, rs *firewallRuleset, timeout time.Duration) error {
+	fmt.Println(NewMessage(chalk.Blue, "Checking the ruleset..."))
+	if err := preflightFirewall(backend, rs); err != nil {
+		return err
+	}
+	if timeout == 0 {
+		return installFirewall(backend, rs)
+	}
 
-	if !noNftBuild {
-		fmt.Println(NewMessage(chalk.Yellow, "Attempting to download nftbuild script..."))
-		err := DownloadFile(nftBuildPath, nftBuildUrl)
+	pending, err := armFirewallRollback(backend, timeout)
+	if err != nil {
+		return fmt.Errorf("%w (use --confirm-timeout 0 to apply without a rollback)", err)
+	}
+	if err := installFirewall(backend, rs); err != nil {
+		fmt.Println(NewMessage(chalk.Yellow, "Restoring the previous ruleset..."))
+		if rerr := rollbackFirewall(pending.ID); rerr != nil {
+			fmt.Println(NewMessage(chalk.Red, "Rollback failed: "+rerr.Error()))
+		}
+		return err
+	}
+	if err := extendFirewallRollback(pending, timeout); err != nil {
+		return err
+	}
+	fmt.Println(NewMessage(chalk.Yellow, fmt.Sprintf("Run 'qcd harden confirm' within %s to keep these rules, otherwise the previous ruleset comes back at %s", timeout, pending.Deadline.Local().Format(time.TimeOnly))))
+	return nil
+}
+
+func installFirewall(backend firewallBackend, rs *firewallRuleset) error {
+	// 1. Attempt to run a verified nftbuild
+	if noNftBuild {
+		fmt.Println(NewMessage(chalk.Yellow, "Skipping nftbuild download/execution"))
+	} else if backend.Name() != "nftables" {
+		fmt.Println(NewMessage(chalk.Yellow, "Skipping nftbuild, it only works with the nftables backend"))
+	} else {
+		nftBuild, err := prepareNftBuild()
 		if err == nil {
-			// Download successful
-			err = os.Chmod(nftBuildPath, 0755)
+			fmt.Println(NewMessage(chalk.Green, "Executing "+nftBuild+"..."))
+			err = RunCommand(nftBuild, "-sys", systemType)
 			if err == nil {
-				fmt.Println(NewMessage(chalk.Green, "nftbuild downloaded. Executing..."))
-				err = RunCommand(nftBuildPath, "-sys", systemType)
-				if err == nil {
-					return nil
-				}
-				fmt.Println(NewMessage(chalk.Red, "nftbuild execution failed: "+err.Error()))
-			} else {
-				fmt.Println(NewMessage(chalk.Red, "Failed to chmod nftbuild: "+err.Error()))
+				err = checkNftBuild(rs)
 			}
+			if err == nil {
+				return nil
+			}
+			fmt.Println(NewMessage(chalk.Red, "nftbuild execution failed: "+err.Error()))
 		} else {
-			fmt.Println(NewMessage(chalk.Red, "Failed to download nftbuild: "+err.Error()))
+			fmt.Println(NewMessage(chalk.Red, "Not running nftbuild: "+err.Error()))
 		}
-	} else {
-		fmt.Println(NewMessage(chalk.Yellow, "Skipping nftbuild download/execution"))
 	}
 
-	fmt.Println(NewMessage(chalk.Yellow, "Falling back to internal nftables rules..."))
+	// 2. Fallback to the rules generated from the firewall config
+	fmt.Println(NewMessage(chalk.Yellow, "Falling back to internal "+backend.Name()+" rules..."))
+	return backend.Apply(rs)
+}
 
-	// 2. Fallback to embedded nft rules
-	fallbackPath := "/tmp/fallback.nft"
-	switch systemType {
-	case "mail":
-		{
-			if err := os.WriteFile(fallbackPath, []byte(mailFallbackNft), 0600); err != nil {
-				return fmt.Errorf("failed to write fallback rules: %w", err)
-			}
-		}
-	case "splunk":
-		{
-			if err := os.WriteFile(fallbackPath, []byte(splunkFallbackNft), 0600); err != nil {
-				return fmt.Errorf("failed to write fallback rules: %w", err)
-			}
-		}
+// checkNftBuild makes sure what nftbuild loaded still lets the required ports in, it
+// can't be checked before it runs.
+func checkNftBuild(rs *firewallRuleset) error {
+	live, err := liveFirewallRuleset()
+	if err != nil {
+		return err
 	}
-
-	if err := RunCommand("nft", "-f", fallbackPath); err != nil {
-		return fmt.Errorf("failed to apply fallback rules: %w", err)
+	if problems := checkFirewallReachable(rs, live); len(problems) > 0 {
+		printFirewallProblems(problems)
+		return fmt.Errorf("its ruleset cuts off %d required port(s)", len(problems))
 	}
-
 	return nil
 }
 
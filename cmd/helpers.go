@@ -25,6 +25,9 @@ func DownloadFile(filepath string, url string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
 
 	// Create the file
 	out, err := os.Create(filepath)
@@ -73,5 +76,25 @@ func RunCommand(executable string, args ...string) error {
 	stat := <-envCmd.Start()
 	// Wait for goroutine to print everything
 	<-doneChan
-	return stat.Error
+	if stat.Error != nil {
+		return stat.Error
+	}
+	// go-cmd only sets Error when the command couldn't run, not when it failed
+	if stat.Exit != 0 {
+		return fmt.Errorf("%s exited with status %d", executable, stat.Exit)
+	}
+	return nil
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// useConfig resets viper to just settings for the duration of the test, with the state
+// directory in a temporary directory.
+func useConfig(t *testing.T, settings map[string]interface{}) {
+	t.Helper()
+	reset := func() {
+		viper.Reset()
+		cachedBackupPlan = nil
+	}
+	reset()
+	t.Cleanup(reset)
+	viper.Set("state_dir", t.TempDir())
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+}
+
+func TestRunCommandExitStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"success", []string{"sh", "-c", "exit 0"}, false},
+		{"non-zero exit", []string{"sh", "-c", "echo failing >&2; exit 3"}, true},
+		{"not found", []string{"qcd-no-such-command"}, true},
+	}
+	for _, tt := range tests {
+		if err := RunCommand(tt.args[0], tt.args[1:]...); (err != nil) != tt.wantErr {
+			t.Errorf("%s: RunCommand error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
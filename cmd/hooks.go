@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Used when a hook doesn't set its own timeout
+const defaultHookTimeout = 5 * time.Minute
+
+// backupHook is one entry of backup.hooks.pre or backup.hooks.post, or of a backup
+// profile's hooks.
+type backupHook struct {
+	Name    string `mapstructure:"name"`
+	Command string `mapstructure:"command"`
+	// File in backup.hooks.dir that receives the command's stdout (pre hooks only)
+	Output   string `mapstructure:"output"`
+	Timeout  string `mapstructure:"timeout"`
+	Required bool   `mapstructure:"required"`
+}
+
+// hookResult records how a hook went, for the summary printed after each stage.
+type hookResult struct {
+	Hook     backupHook
+	Err      error
+	Duration time.Duration
+}
+
+func loadHooks(stage string) ([]backupHook, error) {
+	var hooks []backupHook
+	if err := viper.UnmarshalKey("backup.hooks."+stage, &hooks); err != nil {
+		return nil, fmt.Errorf("invalid backup.hooks.%s: %w", stage, err)
+	}
+	plan, err := resolveBackupPlan()
+	if err != nil {
+		return nil, err
+	}
+	if stage == "pre" {
+		hooks = append(hooks, plan.PreHooks...)
+	} else {
+		hooks = append(hooks, plan.PostHooks...)
+	}
+	for i, h := range hooks {
+		if h.Command == "" {
+			return nil, fmt.Errorf("%s-backup hook %d has no command", stage, i+1)
+		}
+		if h.Name == "" {
+			hooks[i].Name = fmt.Sprintf("%s-%d", stage, i+1)
+		}
+		if h.Output != "" && (filepath.IsAbs(h.Output) || strings.Contains(h.Output, "..")) {
+			return nil, fmt.Errorf("hook %s: output must be a file name inside backup.hooks.dir", hooks[i].Name)
+		}
+	}
+	return hooks, nil
+}
+
+// backupHookDir is where pre hooks write their dumps. It is backed up with the targets.
+func backupHookDir() string {
+	if dir := viper.GetString("backup.hooks.dir"); dir != "" {
+		return dir
+	}
+	return "/var/lib/qcd/hooks"
+}
+
+// hookTargets returns the hook output directory if any pre hook writes into it.
+func hookTargets() []string {
+	hooks, err := loadHooks("pre")
+	if err != nil {
+		return nil
+	}
+	for _, h := range hooks {
+		if h.Output != "" {
+			return []string{backupHookDir()}
+		}
+	}
+	return nil
+}
+
+// runBackupHooks runs every hook of a stage in order. Failures are reported as they
+// happen; the returned error is set only if a required hook failed.
+func runBackupHooks(stage string, env []string) error {
+	hooks, err := loadHooks(stage)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	fmt.Println(NewMessage(chalk.Blue, fmt.Sprintf("Running %d %s-backup hook(s)...", len(hooks), stage)))
+	var failedRequired []string
+	for _, h := range hooks {
+		res := runHook(stage, h, env)
+		if res.Err == nil {
+			fmt.Println(NewMessage(chalk.Green, "Hook "+h.Name+" finished").ThenColor(chalk.White, "("+res.Duration.Round(time.Millisecond).String()+")"))
+			continue
+		}
+
+		color := chalk.Yellow
+		if h.Required {
+			color = chalk.Red
+			failedRequired = append(failedRequired, h.Name)
+		}
+		fmt.Println(NewMessage(color, "Hook "+h.Name+" failed: "+res.Err.Error()))
+	}
+
+	if len(failedRequired) > 0 {
+		return fmt.Errorf("required %s-backup hook(s) failed: %s", stage, strings.Join(failedRequired, ", "))
+	}
+	return nil
+}
+
+func runHook(stage string, h backupHook, env []string) hookResult {
+	start := time.Now()
+	res := hookResult{Hook: h}
+
+	timeout := defaultHookTimeout
+	if h.Timeout != "" {
+		d, err := time.ParseDuration(h.Timeout)
+		if err != nil {
+			res.Err = fmt.Errorf("invalid timeout %q: %w", h.Timeout, err)
+			return res
+		}
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	c.Env = append(os.Environ(), "QCD_BACKUP_STAGE="+stage, "QCD_HOOKS_DIR="+backupHookDir())
+	c.Env = append(c.Env, env...)
+	// Run in its own process group so a timeout also kills whatever the shell started
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+
+	var out *os.File
+	var outPath string
+	if h.Output != "" && stage == "pre" {
+		dir := backupHookDir()
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			res.Err = err
+			return res
+		}
+		outPath = filepath.Join(dir, h.Output)
+		f, err := os.CreateTemp(dir, "."+h.Output+"-*")
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		defer os.Remove(f.Name())
+		out = f
+		c.Stdout = f
+		// Hooks that write the file themselves get the staging file too, so the last
+		// good dump stays in place until this run has succeeded
+		c.Env = append(c.Env, "QCD_HOOK_OUTPUT="+f.Name())
+	} else {
+		c.Stdout = &stderr
+	}
+
+	err := c.Run()
+	res.Duration = time.Since(start)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	} else if err != nil {
+		if msg := lastLines(stderr.String(), 5); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+	}
+
+	if out != nil {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(out.Name(), outPath)
+		} else if _, serr := os.Stat(outPath); serr == nil {
+			fmt.Println(NewMessage(chalk.Yellow, "Keeping the previous hook output "+outPath))
+		}
+	}
+	res.Err = err
+	return res
+}
+
+// lastLines returns up to n trailing non-empty lines of s, joined with " | ".
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.TrimSpace(strings.Join(lines, " | "))
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunHookKeepsLastGoodDump(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    backupHook
+		wantErr bool
+		want    string
+	}{
+		{name: "stdout", hook: backupHook{Command: "echo fresh"}, want: "fresh\n"},
+		{name: "writes the output file", hook: backupHook{Command: `echo fresh > "$QCD_HOOK_OUTPUT"`}, want: "fresh\n"},
+		{name: "fails", hook: backupHook{Command: "echo partial; exit 3"}, wantErr: true, want: "good\n"},
+		{name: "fails after writing the file", hook: backupHook{Command: `echo partial > "$QCD_HOOK_OUTPUT"; exit 1`}, wantErr: true, want: "good\n"},
+		{name: "times out", hook: backupHook{Command: "echo partial; sleep 5", Timeout: "100ms"}, wantErr: true, want: "good\n"},
+		{name: "bad timeout", hook: backupHook{Command: "echo fresh", Timeout: "soon"}, wantErr: true, want: "good\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			useConfig(t, map[string]interface{}{"backup.hooks.dir": dir})
+			out := filepath.Join(dir, "dump.sql")
+			if err := os.WriteFile(out, []byte("good\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.hook.Name = "test"
+			tt.hook.Output = "dump.sql"
+			res := runHook("pre", tt.hook, nil)
+			if (res.Err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", res.Err, tt.wantErr)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("dump contains %q, want %q", data, tt.want)
+			}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), ".dump.sql-") {
+					t.Errorf("staging file %s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"", 3, ""},
+		{"one\n", 3, "one"},
+		{"a\nb\nc\nd\n", 2, "c | d"},
+		{"  a\nb  \n\n", 5, "a | b"},
+	}
+	for _, tt := range tests {
+		if got := lastLines(tt.in, tt.n); got != tt.want {
+			t.Errorf("lastLines(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// captureBaseline collects the current host state. A section that can't be collected is
+// recorded in Errors instead of failing the whole capture.
+func captureBaseline() *hostBaseline {
+	b := &hostBaseline{Version: baselineVersion, Captured: time.Now().UTC(), Errors: make(map[string]string)}
+	b.Hostname, _ = os.Hostname()
+
+	collect := func(name string, fn func() error) {
+		if err := fn(); err != nil {
+			b.Errors[name] = err.Error()
+		}
+	}
+	collect("users", func() (err error) { b.Users, err = collectUsers(); return })
+	collect("groups", func() (err error) { b.Groups, err = collectGroups(); return })
+	collect("sudoers", func() (err error) { b.Sudoers, err = collectSudoers(); return })
+	collect("suid", func() (err error) { b.SUID, err = collectSUID(); return })
+	collect("listening", func() (err error) { b.Listening, err = collectListening(); return })
+	collect("services", func() (err error) { b.Services, err = collectServices(); return })
+	collect("cron", func() (err error) { b.Cron, err = collectCron(); return })
+	collect("authorized_keys", func() (err error) { b.AuthorizedKeys, err = collectAuthorizedKeys(b.Users); return })
+	collect("modules", func() (err error) { b.Modules, err = collectModules(); return })
+	collect("packages", func() (err error) { b.Packages, err = collectPackages(); return })
+	return b
+}
+
+// readColonFile splits the lines of /etc/passwd style files into their fields.
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		records = append(records, strings.Split(line, ":"))
+	}
+	return records, scanner.Err()
+}
+
+func collectUsers() ([]baselineUser, error) {
+	records, err := readColonFile("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	var users []baselineUser
+	for _, r := range records {
+		if len(r) < 7 {
+			continue
+		}
+		users = append(users, baselineUser{Name: r[0], UID: r[2], GID: r[3], Home: r[5], Shell: r[6]})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func collectGroups() ([]baselineGroup, error) {
+	records, err := readColonFile("/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	var groups []baselineGroup
+	for _, r := range records {
+		if len(r) < 4 {
+			continue
+		}
+		g := baselineGroup{Name: r[0], GID: r[2]}
+		if r[3] != "" {
+			g.Members = strings.Split(r[3], ",")
+			sort.Strings(g.Members)
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+// configLines returns the non-empty, non-comment lines of path with whitespace collapsed.
+func configLines(path string) ([]baselineLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []baselineLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.Join(strings.Fields(scanner.Text()), " ")
+		// sudoers directives like #include look like comments
+		if line == "" || (strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "#include")) {
+			continue
+		}
+		lines = append(lines, baselineLine{File: path, Line: line})
+	}
+	return lines, scanner.Err()
+}
+
+// dirFiles lists the regular files in dir, or nothing if it doesn't exist.
+func dirFiles(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return files
+}
+
+func collectSudoers() ([]baselineLine, error) {
+	lines, err := configLines("/etc/sudoers")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, path := range dirFiles("/etc/sudoers.d") {
+		more, err := configLines(path)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, more...)
+	}
+	return lines, nil
+}
+
+// collectSUID finds setuid and setgid files under baseline.suid_roots, staying off
+// pseudo filesystems.
+func collectSUID() ([]baselineSUIDFile, error) {
+	roots := viper.GetStringSlice("baseline.suid_roots")
+	if len(roots) == 0 {
+		roots = []string{"/"}
+	}
+	skip := map[string]bool{"/proc": true, "/sys": true, "/dev": true, "/run": true}
+
+	var files []baselineSUIDFile
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Unreadable directories are skipped, not fatal
+				return nil
+			}
+			if d.IsDir() {
+				if skip[path] {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.Mode()&(fs.ModeSetuid|fs.ModeSetgid) == 0 {
+				return nil
+			}
+			f := baselineSUIDFile{Path: path, Mode: info.Mode().String()}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				f.UID, f.GID = int(st.Uid), int(st.Gid)
+			}
+			f.SHA256, _, _ = hashFile(path)
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// collectListening reads listening TCP and bound UDP sockets from /proc/net and finds the
+// process owning each.
+func collectListening() ([]baselineSocket, error) {
+	owners := socketOwners()
+	seen := make(map[string]bool)
+	var sockets []baselineSocket
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open("/proc/net/" + proto)
+		if os.IsNotExist(err) {
+			// No IPv6
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			// 0A is TCP_LISTEN, 07 is an unconnected UDP socket
+			if (strings.HasPrefix(proto, "tcp") && fields[3] != "0A") || (strings.HasPrefix(proto, "udp") && fields[3] != "07") {
+				continue
+			}
+			addr, err := parseProcNetAddr(fields[1])
+			if err != nil {
+				continue
+			}
+			s := baselineSocket{Proto: strings.TrimSuffix(proto, "6"), Address: addr, Process: owners[fields[9]]}
+			if key := s.Proto + " " + s.Address; !seen[key] {
+				seen[key] = true
+				sockets = append(sockets, s)
+			}
+		}
+		f.Close()
+	}
+	sort.Slice(sockets, func(i, j int) bool {
+		if sockets[i].Proto != sockets[j].Proto {
+			return sockets[i].Proto < sockets[j].Proto
+		}
+		return sockets[i].Address < sockets[j].Address
+	})
+	return sockets, nil
+}
+
+// parseProcNetAddr decodes "0100007F:0016" style addresses from /proc/net. The address is
+// stored as 32 bit words in host (little endian) byte order.
+func parseProcNetAddr(s string) (string, error) {
+	hexIP, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %q", s)
+	}
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)), nil
+}
+
+// socketOwners maps socket inodes to the name of a process holding them.
+func socketOwners() map[string]string {
+	owners := make(map[string]string)
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return owners
+	}
+	for _, p := range procs {
+		if !isNumeric(p.Name()) {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		var comm string
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if comm == "" {
+				data, _ := os.ReadFile(filepath.Join("/proc", p.Name(), "comm"))
+				comm = strings.TrimSpace(string(data))
+			}
+			owners[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = comm
+		}
+	}
+	return owners
+}
+
+// collectServices lists enabled systemd units from the .wants/.requires links under
+// /etc/systemd/system and SysV start links, without needing a running systemd.
+func collectServices() ([]string, error) {
+	var services []string
+	dirs, _ := filepath.Glob("/etc/systemd/system/*.wants")
+	requires, _ := filepath.Glob("/etc/systemd/system/*.requires")
+	for _, dir := range append(dirs, requires...) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			services = append(services, filepath.Base(dir)+"/"+e.Name())
+		}
+	}
+	sysv, _ := filepath.Glob("/etc/rc[2-5].d/S*")
+	for _, link := range sysv {
+		services = append(services, strings.TrimPrefix(link, "/etc/"))
+	}
+	if len(services) == 0 {
+		if _, err := os.Stat("/etc/systemd/system"); err != nil {
+			return nil, fmt.Errorf("no systemd or SysV service links found")
+		}
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// collectCron records crontab lines and the scripts in the periodic cron directories.
+func collectCron() ([]baselineLine, error) {
+	files := []string{"/etc/crontab", "/etc/anacrontab"}
+	files = append(files, dirFiles("/etc/cron.d")...)
+	files = append(files, dirFiles("/var/spool/cron")...)
+	files = append(files, dirFiles("/var/spool/cron/crontabs")...)
+
+	var lines []baselineLine
+	for _, path := range files {
+		more, err := configLines(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		lines = append(lines, more...)
+	}
+
+	// Scripts run by run-parts are tracked by content, not line by line
+	for _, period := range []string{"hourly", "daily", "weekly", "monthly"} {
+		for _, path := range dirFiles("/etc/cron." + period) {
+			sum, _, err := hashFile(path)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, baselineLine{File: path, Line: "sha256 " + sum})
+		}
+	}
+	return lines, nil
+}
+
+// collectAuthorizedKeys fingerprints every key in the users' authorized_keys files.
+func collectAuthorizedKeys(users []baselineUser) ([]baselineKey, error) {
+	var keys []baselineKey
+	seen := make(map[string]bool)
+	for _, u := range users {
+		if u.Home == "" || u.Home == "/" {
+			continue
+		}
+		for _, name := range []string{"authorized_keys", "authorized_keys2"} {
+			path := filepath.Join(u.Home, ".ssh", name)
+			// Users sharing a home directory would list the same file twice
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			for rest := data; len(rest) > 0; {
+				pub, comment, options, next, err := ssh.ParseAuthorizedKey(rest)
+				if err != nil {
+					break
+				}
+				keys = append(keys, baselineKey{
+					User:        u.Name,
+					File:        path,
+					Type:        pub.Type(),
+					Fingerprint: ssh.FingerprintSHA256(pub),
+					Comment:     comment,
+					Options:     strings.Join(options, ","),
+				})
+				rest = next
+			}
+		}
+	}
+	return keys, nil
+}
+
+func collectModules() ([]string, error) {
+	f, err := os.Open("/proc/modules")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var modules []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			modules = append(modules, fields[0])
+		}
+	}
+	sort.Strings(modules)
+	return modules, scanner.Err()
+}
+
+// collectPackages asks rpm or dpkg for the installed packages.
+func collectPackages() ([]baselinePackage, error) {
+	var out []byte
+	var err error
+	if _, lookErr := exec.LookPath("rpm"); lookErr == nil {
+		out, err = exec.Command("rpm", "-qa", "--qf", `%{NAME}.%{ARCH} %{EPOCHNUM}:%{VERSION}-%{RELEASE}\n`).Output()
+	} else if _, lookErr := exec.LookPath("dpkg-query"); lookErr == nil {
+		out, err = exec.Command("dpkg-query", "-W", "-f", `${Package}:${Architecture} ${Version} ${db:Status-Abbrev}\n`).Output()
+	} else {
+		return nil, fmt.Errorf("neither rpm nor dpkg-query is available")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []baselinePackage
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// dpkg also lists removed packages whose config files are still around
+		if len(fields) > 2 && !strings.HasPrefix(fields[2], "ii") {
+			continue
+		}
+		packages = append(packages, baselinePackage{Name: fields[0], Version: fields[1]})
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+	return packages, nil
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// incrementalBase picks the backup a new incremental builds on: the latest backup, as
+// long as its manifest is readable and its chain is shorter than backup.full_every.
+func incrementalBase(dest string) (*backupManifest, error) {
+	backups, err := listBackups(dest)
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no previous backup to build on")
+	}
+
+	latest := len(backups) - 1
+	chain := backupChain(backups, latest)
+	if limit := viper.GetInt("backup.full_every"); limit > 0 && len(chain)-1 >= limit {
+		return nil, fmt.Errorf("chain already has %d incremental backups (backup.full_every is %d)", len(chain)-1, limit)
+	}
+
+	m, err := readManifest(backups[latest].Path)
+	if err != nil {
+		return nil, fmt.Errorf("latest backup has no usable manifest: %w", err)
+	}
+	return m, nil
+}
+
+// backupChain returns the indexes of the backups needed to restore backups[i]: the full
+// backup that started its chain, every incremental since, and i itself.
+func backupChain(backups []backupFile, i int) []int {
+	start := i
+	for start > 0 && backups[start].Incremental {
+		start--
+	}
+
+	chain := make([]int, 0, i-start+1)
+	for j := start; j <= i; j++ {
+		chain = append(chain, j)
+	}
+	return chain
+}
+
+// previousState indexes a manifest by path, resolving every entry to the archive that
+// actually holds its content.
+func previousState(m *backupManifest) map[string]manifestEntry {
+	state := make(map[string]manifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		if e.Archive == "" {
+			e.Archive = m.Archive
+		}
+		state[e.Path] = e
+	}
+	return state
+}
+
+// walkSnapshot streams the complete state captured by a backup to fn. For a full backup
+// that is just its archive. For an incremental the entries are collected from every
+// archive in its chain, oldest first, with ownership, mode and mtime taken from the
+// manifest.
+func walkSnapshot(archive string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	_, incremental, _ := parseBackupName(filepath.Base(archive))
+	if !incremental {
+		return walkArchive(archive, fn)
+	}
+
+	m, err := readManifest(archive)
+	if err != nil {
+		return fmt.Errorf("incremental backup needs its manifest: %w", err)
+	}
+	m.Archive = filepath.Base(archive)
+	state := previousState(m)
+
+	holders := make(map[string]bool)
+	for _, e := range state {
+		holders[e.Archive] = true
+	}
+	var names []string
+	for name := range holders {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ti, _, _ := parseBackupName(names[i])
+		tj, _, _ := parseBackupName(names[j])
+		return ti.Before(tj)
+	})
+
+	dir := filepath.Dir(archive)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("backup chain is broken, %s is missing", name)
+		}
+
+		err := walkArchive(path, func(hdr *tar.Header, r io.Reader) error {
+			p := entryPath(hdr.Name)
+			e, ok := state[p]
+			if !ok || e.Archive != name {
+				return nil
+			}
+			delete(state, p)
+			applyManifestEntry(hdr, e)
+			return fn(hdr, r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(state) > 0 {
+		return fmt.Errorf("%d entries are missing from the backup chain", len(state))
+	}
+	return nil
+}
+
+// applyManifestEntry overwrites the metadata and extended attributes in hdr with the manifest's, which is newer
+// when the content was carried over from an earlier archive.
+func applyManifestEntry(hdr *tar.Header, e manifestEntry) {
+	if mode, err := strconv.ParseInt(e.Mode, 8, 64); err == nil {
+		hdr.Mode = hdr.Mode&^07777 | mode
+	}
+	hdr.Uid, hdr.Gid = e.UID, e.GID
+	hdr.Uname, hdr.Gname = e.Owner, e.Group
+	hdr.ModTime = e.ModTime
+	setHeaderXattrs(hdr, e.Xattrs)
+}
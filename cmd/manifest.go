@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Version 2 added incremental backups, version 3 the MAC
+const manifestVersion = 3
+
+var errManifestUnsigned = errors.New("manifest has no MAC")
+
+// backupManifest is the sidecar written next to every backup archive. It records what
+// went into the archive so it can be verified without trusting the archive itself.
+// Incremental backups list the complete state of the targets; entries whose content is
+// stored in an earlier archive name that archive.
+type backupManifest struct {
+	Version       int       `json:"version"`
+	Archive       string    `json:"archive"`
+	Created       time.Time `json:"created"`
+	Incremental   bool      `json:"incremental,omitempty"`
+	Parent        string    `json:"parent,omitempty"`
+	ArchiveSize   int64     `json:"archive_size"`
+	ArchiveSHA256 string    `json:"archive_sha256"`
+	// Extended attributes were captured, so an entry without any really had none
+	Xattrs  bool            `json:"xattrs,omitempty"`
+	Entries []manifestEntry `json:"entries"`
+	// HMAC-SHA256 of the manifest with this field empty, keyed with manifestKey. Without
+	// it anyone able to change the archive could write a matching manifest.
+	MAC string `json:"mac,omitempty"`
+}
+
+type manifestEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	Owner   string    `json:"owner,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	ModTime time.Time `json:"mtime"`
+	Link    string    `json:"link,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Archive string    `json:"archive,omitempty"`
+	// Extended attributes by name, e.g. security.selinux
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// manifestPath returns the sidecar manifest path for an archive. Manifests of encrypted
+// archives are encrypted too, and named to match.
+func manifestPath(archive string) string {
+	if strings.HasSuffix(archive, ".age") {
+		return strings.TrimSuffix(archive, ".age") + ".manifest.json.age"
+	}
+	return archive + ".manifest.json"
+}
+
+// newManifestEntry describes a tar header. The hash is filled in by the caller for
+// regular files.
+func newManifestEntry(hdr *tar.Header) manifestEntry {
+	return manifestEntry{
+		Path:    entryPath(hdr.Name),
+		Type:    entryType(hdr.Typeflag),
+		Size:    hdr.Size,
+		Mode:    fmt.Sprintf("%04o", hdr.Mode&07777),
+		UID:     hdr.Uid,
+		GID:     hdr.Gid,
+		Owner:   hdr.Uname,
+		Group:   hdr.Gname,
+		ModTime: hdr.ModTime.UTC(),
+		Link:    hdr.Linkname,
+		Xattrs:  headerXattrs(hdr),
+	}
+}
+
+// entryPath turns a tar entry name back into the absolute path it was archived from.
+func entryPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func entryType(flag byte) string {
+	switch flag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar, tar.TypeBlock:
+		return "device"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return "other"
+	}
+}
+
+// manifestKeyPath is the key manifests are signed with, backup.manifest_key_file or
+// manifest.key in the state directory. Keep it out of backup.dest, which is what it
+// protects.
+func manifestKeyPath() string {
+	if p := viper.GetString("backup.manifest_key_file"); p != "" {
+		return p
+	}
+	return filepath.Join(qcdStateDir(), "manifest.key")
+}
+
+// manifestKey reads the manifest signing key, generating it first when create is set.
+func manifestKey(create bool) ([]byte, error) {
+	keyPath := manifestKeyPath()
+	data, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < 16 {
+		return nil, fmt.Errorf("invalid manifest key in %s", keyPath)
+	}
+	return key, nil
+}
+
+func manifestMAC(m *backupManifest, key []byte) (string, error) {
+	unsigned := *m
+	unsigned.MAC = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// checkManifestMAC verifies m was signed with key.
+func checkManifestMAC(m *backupManifest, key []byte) error {
+	if m.MAC == "" {
+		return errManifestUnsigned
+	}
+	want, err := manifestMAC(m, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(want), []byte(m.MAC)) {
+		return fmt.Errorf("manifest MAC does not match, it was modified or signed with another key")
+	}
+	return nil
+}
+
+func writeManifest(m *backupManifest, dest string) error {
+	key, err := manifestKey(true)
+	if err != nil {
+		return fmt.Errorf("could not load the manifest key: %w", err)
+	}
+	if m.MAC, err = manifestMAC(m, key); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(dest, ".age") {
+		enc, err := encryptBackup(f)
+		if err != nil {
+			return err
+		}
+		if _, err := enc.Write(data); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+func readManifest(archive string) (*backupManifest, error) {
+	f, err := openBackupFile(manifestPath(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest for %s: %w", archive, err)
+	}
+
+	var m backupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s: %w", archive, err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest for %s has unsupported version %d", archive, m.Version)
+	}
+	// Restores trust the manifest's metadata, so a signed one has to check out. Hosts
+	// without the key, e.g. restoring from a replica, can still read it; verify insists.
+	if m.MAC != "" {
+		if key, err := manifestKey(false); err == nil {
+			if err := checkManifestMAC(&m, key); err != nil {
+				return nil, fmt.Errorf("%s: %w", manifestPath(archive), err)
+			}
+		}
+	}
+	return &m, nil
+}
+
+// hashFile returns the hex SHA-256 and size of the file at path.
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -18,7 +18,7 @@ var monitorInterval int
 var monitorCmd = &cobra.Command{
 	Use:   "monitor",
 	Short: "Monitor system for changes",
-	Long:  `Continuously checks for new processes, socket connections, and file changes.`,
+	Long:  `Continuously checks for new processes, socket connections, and file changes, and reports anything that opens, changes or removes files in the backup store.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if useTmux {
 			// Check if tmux is installed
@@ -66,6 +66,7 @@ var monitorCmd = &cobra.Command{
 		// Initial baseline
 		knownProcs := getRunningProcesses()
 		fmt.Println(NewMessage(chalk.Blue, fmt.Sprintf("Baseline taken: %d processes.", len(knownProcs))))
+		store := newStoreWatch()
 
 		ticker := time.NewTicker(time.Duration(monitorInterval) * time.Second)
 		defer ticker.Stop()
@@ -87,6 +88,9 @@ var monitorCmd = &cobra.Command{
 
 			// Check critical file modification times
 			checkFileChanges()
+
+			// Check nothing tampers with the backups
+			store.check()
 		}
 	},
 }
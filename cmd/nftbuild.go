@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Used when firewall.nftbuild.url isn't in the config. It follows master, so a change
+// upstream fails the firewall.nftbuild.sha256 check until the new script is reviewed;
+// point firewall.nftbuild.url at a commit to stay on a vetted version.
+const defaultNftBuildURL = "https://github.com/UWStout-CCDC/CCDC-scripts/raw/refs/heads/master/firewall/host_firewall/nftbuild"
+
+// nftBuildPath is where the verified copy of nftbuild is kept and run from.
+func nftBuildPath() string {
+	if p := viper.GetString("firewall.nftbuild.path"); p != "" {
+		return p
+	}
+	return filepath.Join(qcdStateDir(), "nftbuild", "nftbuild")
+}
+
+// nftBuildChecksum is the pinned SHA-256 of nftbuild, empty when none is configured.
+func nftBuildChecksum() (string, error) {
+	sum := strings.ToLower(strings.TrimSpace(viper.GetString("firewall.nftbuild.sha256")))
+	if sum == "" {
+		return "", nil
+	}
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid SHA-256 %q in firewall.nftbuild.sha256", sum)
+	}
+	return sum, nil
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// prepareNftBuild returns the path of an nftbuild script that is safe to run: the copy
+// built into qcd with the nftbuild_embed tag, the cached copy, or a fresh download. Only
+// the embedded copy may go unpinned, anything read from disk or the network has to match
+// firewall.nftbuild.sha256 before it is made executable.
+func prepareNftBuild() (string, error) {
+	want, err := nftBuildChecksum()
+	if err != nil {
+		return "", err
+	}
+	dest := nftBuildPath()
+
+	if len(embeddedNftBuild) > 0 {
+		if got := sha256Hex(embeddedNftBuild); want != "" && got != want {
+			return "", fmt.Errorf("embedded nftbuild has SHA-256 %s but firewall.nftbuild.sha256 is %s, refusing to run it", got, want)
+		}
+		fmt.Println(NewMessage(chalk.Green, "Using the nftbuild embedded in qcd"))
+		return dest, installNftBuild(dest, embeddedNftBuild)
+	}
+
+	url := viper.GetString("firewall.nftbuild.url")
+	if url == "" {
+		url = defaultNftBuildURL
+	}
+	if want == "" {
+		return "", fmt.Errorf("firewall.nftbuild.sha256 isn't set, refusing to run an unpinned nftbuild from %s", url)
+	}
+
+	if cached, err := os.ReadFile(dest); err == nil {
+		if sha256Hex(cached) == want {
+			fmt.Println(NewMessage(chalk.Green, "Using the cached nftbuild at "+dest))
+			return dest, installNftBuild(dest, cached)
+		}
+		fmt.Println(NewMessage(chalk.Yellow, "Cached nftbuild at "+dest+" doesn't match firewall.nftbuild.sha256, downloading it again"))
+	}
+
+	fmt.Println(NewMessage(chalk.Yellow, "Downloading nftbuild from "+url+"..."))
+	script, err := downloadArtifact(url)
+	if err != nil {
+		return "", err
+	}
+	if got := sha256Hex(script); got != want {
+		return "", fmt.Errorf("checksum mismatch for nftbuild from %s: expected %s, got %s, refusing to run it", url, want, got)
+	}
+	fmt.Println(NewMessage(chalk.Green, "Checksum verified for nftbuild"))
+	return dest, installNftBuild(dest, script)
+}
+
+// installNftBuild writes the verified script to dest. It is rewritten even when cached so
+// the file that runs is always the one just checked, with a fresh owner and mode.
+func installNftBuild(dest string, script []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	return installBinary(dest, script)
+}
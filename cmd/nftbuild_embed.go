@@ -0,0 +1,18 @@
+//go:build nftbuild_embed
+
+package cmd
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Built with -tags nftbuild_embed, qcd carries a vetted nftbuild and never downloads it.
+// Put the reviewed script at embedded/nftbuild/nftbuild before building (build.sh does
+// this with NFTBUILD=<path>). The directory is embedded rather than the file so the tag
+// still builds without it, the README keeps the pattern matching.
+//
+//go:embed embedded/nftbuild
+var embeddedNftBuildDir embed.FS
+
+var embeddedNftBuild, _ = fs.ReadFile(embeddedNftBuildDir, "embedded/nftbuild/nftbuild")
@@ -0,0 +1,7 @@
+//go:build !nftbuild_embed
+
+package cmd
+
+// Without the nftbuild_embed tag nftbuild is downloaded and checked against
+// firewall.nftbuild.sha256.
+var embeddedNftBuild []byte
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPrepareNftBuild(t *testing.T) {
+	good := []byte("#!/bin/sh\necho vetted\n")
+	evil := []byte("#!/bin/sh\necho owned\n")
+	stale := []byte("#!/bin/sh\necho old\n")
+	tests := []struct {
+		name      string
+		embedded  []byte
+		cached    []byte
+		pin       string
+		served    []byte
+		wantErr   bool
+		downloads int32
+		// Content of dest afterwards, nil when it mustn't exist
+		want []byte
+	}{
+		{name: "no pin", served: good, wantErr: true},
+		{name: "no pin with a cached copy", cached: good, served: good, wantErr: true, want: good},
+		{name: "wrong checksum", pin: sha256Hex(good), served: evil, wantErr: true, downloads: 1},
+		{name: "wrong checksum over a stale copy", cached: stale, pin: sha256Hex(good), served: evil, wantErr: true, downloads: 1, want: stale},
+		{name: "stale cached copy", cached: stale, pin: sha256Hex(good), served: good, downloads: 1, want: good},
+		{name: "cached copy matches", cached: good, pin: sha256Hex(good), served: evil, want: good},
+		{name: "download matches", pin: sha256Hex(good), served: good, downloads: 1, want: good},
+		{name: "embedded copy mismatch", embedded: evil, pin: sha256Hex(good), served: good, wantErr: true},
+		{name: "embedded copy matches", embedded: good, pin: sha256Hex(good), served: evil, want: good},
+		{name: "embedded copy unpinned", embedded: good, served: evil, want: good},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var downloads atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				downloads.Add(1)
+				w.Write(tt.served)
+			}))
+			defer srv.Close()
+
+			dest := filepath.Join(t.TempDir(), "nftbuild", "nftbuild")
+			useConfig(t, map[string]interface{}{
+				"firewall.nftbuild.path":   dest,
+				"firewall.nftbuild.url":    srv.URL + "/nftbuild",
+				"firewall.nftbuild.sha256": tt.pin,
+			})
+			oldEmbedded := embeddedNftBuild
+			embeddedNftBuild = tt.embedded
+			t.Cleanup(func() { embeddedNftBuild = oldEmbedded })
+			if tt.cached != nil {
+				if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(dest, tt.cached, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			path, err := prepareNftBuild()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareNftBuild() = %q, %v, want error %v", path, err, tt.wantErr)
+			}
+			if got := downloads.Load(); got != tt.downloads {
+				t.Errorf("%d downloads, want %d", got, tt.downloads)
+			}
+			data, err := os.ReadFile(dest)
+			switch {
+			case tt.want == nil && err == nil:
+				t.Errorf("dest written with %q", data)
+			case tt.want != nil && !bytes.Equal(data, tt.want):
+				t.Errorf("dest = %q, %v, want %q", data, err, tt.want)
+			}
+			if !tt.wantErr {
+				if path != dest {
+					t.Errorf("path %q, want %q", path, dest)
+				}
+				if info, err := os.Stat(dest); err != nil || info.Mode().Perm()&0100 == 0 {
+					t.Errorf("installed nftbuild isn't executable: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Profile applied on every box in addition to the selected ones
+const commonBackupProfile = "common"
+
+// backupProfile is one entry of backup.profiles, keyed by system type.
+type backupProfile struct {
+	Targets  []string `mapstructure:"targets"`
+	Excludes []string `mapstructure:"excludes"`
+	// Paths whose presence means this service runs here, used when --sys isn't given
+	Detect []string `mapstructure:"detect"`
+	Hooks  struct {
+		Pre  []backupHook `mapstructure:"pre"`
+		Post []backupHook `mapstructure:"post"`
+	} `mapstructure:"hooks"`
+}
+
+// Profiles used for system types that backup.profiles doesn't define
+var builtinBackupProfiles = map[string]backupProfile{
+	"mail": {
+		Targets: []string{"/etc/postfix", "/etc/dovecot", "/var/mail", "/var/spool/mail"},
+		Detect:  []string{"/etc/postfix", "/etc/dovecot"},
+	},
+	"web": {
+		Targets:  []string{"/var/www", "/etc/httpd", "/etc/apache2", "/etc/nginx", "/etc/php", "/etc/php.ini"},
+		Excludes: []string{"*.log", "/var/www/*/cache"},
+		Detect:   []string{"/etc/httpd", "/etc/apache2", "/etc/nginx"},
+	},
+	"splunk": {
+		// Everything but the indexes
+		Targets:  []string{"/opt/splunk"},
+		Excludes: []string{"/opt/splunk/var"},
+		Detect:   []string{"/opt/splunk"},
+	},
+	"dns": {
+		Targets: []string{"/etc/bind", "/etc/named", "/etc/named.conf", "/var/named"},
+		Detect:  []string{"/etc/bind", "/etc/named.conf"},
+	},
+}
+
+// backupPlan is what a backup run covers on this box.
+type backupPlan struct {
+	Profiles  []string
+	Targets   []string
+	Excludes  []string
+	PreHooks  []backupHook
+	PostHooks []backupHook
+}
+
+// Resolved once per run, detection prints what it found
+var cachedBackupPlan *backupPlan
+
+// resolveBackupPlan picks the backup profiles for this box: the ones named by --sys, or
+// every profile whose detect paths exist. The profiles add to backup.targets, which is
+// always backed up, as are the common profile and the global backup.excludes and
+// backup.hooks.
+func resolveBackupPlan() (*backupPlan, error) {
+	if cachedBackupPlan != nil {
+		return cachedBackupPlan, nil
+	}
+
+	profiles, err := loadBackupProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	if systemType != "" {
+		for _, name := range strings.Split(systemType, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := profiles[name]; !ok {
+				// Firewall-only types like ftp or ad are covered by backup.targets
+				fmt.Println(NewMessage(chalk.Yellow, "No backup profile for system type "+name+" (known: "+strings.Join(profileNames(profiles), ", ")+"), only backup.targets is backed up for it"))
+				continue
+			}
+			selected = append(selected, name)
+		}
+	} else {
+		for _, name := range profileNames(profiles) {
+			if name != commonBackupProfile && detectProfile(profiles[name]) {
+				selected = append(selected, name)
+			}
+		}
+		if len(selected) > 0 {
+			fmt.Println(NewMessage(chalk.Blue, "Detected services:").ThenColor(chalk.White, strings.Join(selected, ", ")))
+		}
+	}
+
+	plan := &backupPlan{Excludes: viper.GetStringSlice("backup.excludes")}
+	configured := viper.GetStringSlice("backup.targets")
+	if len(configured) == 0 {
+		// Fallback if config is missing or empty
+		configured = []string{"/etc/dovecot", "/etc/postfix", "/opt/splunk", "/var/www"}
+	}
+	plan.Targets = append(plan.Targets, configured...)
+	if _, ok := profiles[commonBackupProfile]; ok {
+		selected = append([]string{commonBackupProfile}, selected...)
+	}
+	for _, name := range selected {
+		p := profiles[name]
+		plan.Profiles = append(plan.Profiles, name)
+		plan.Targets = append(plan.Targets, p.Targets...)
+		plan.Excludes = append(plan.Excludes, p.Excludes...)
+		for _, pattern := range p.Excludes {
+			if target := narrowedTarget(pattern, configured); target != "" {
+				fmt.Println(NewMessage(chalk.Yellow, "Backup profile "+name+" excludes "+pattern+" from "+target+" in backup.targets"))
+			}
+		}
+		plan.PreHooks = append(plan.PreHooks, p.Hooks.Pre...)
+		plan.PostHooks = append(plan.PostHooks, p.Hooks.Post...)
+	}
+	plan.Targets = dedupeTargets(plan.Targets)
+
+	cachedBackupPlan = plan
+	return plan, nil
+}
+
+// narrowedTarget returns the target in targets that an exclude pattern removes part of,
+// "" if none. Patterns without a slash match file names anywhere and aren't reported.
+func narrowedTarget(pattern string, targets []string) string {
+	if !strings.Contains(pattern, "/") {
+		return ""
+	}
+	pattern = filepath.Clean(pattern)
+	for _, t := range targets {
+		t = filepath.Clean(t)
+		if pattern == t || strings.HasPrefix(pattern, strings.TrimSuffix(t, "/")+"/") {
+			return t
+		}
+	}
+	return ""
+}
+
+// loadBackupProfiles merges backup.profiles over the built-in profiles.
+func loadBackupProfiles() (map[string]backupProfile, error) {
+	profiles := make(map[string]backupProfile, len(builtinBackupProfiles))
+	for name, p := range builtinBackupProfiles {
+		profiles[name] = p
+	}
+
+	var configured map[string]backupProfile
+	if err := viper.UnmarshalKey("backup.profiles", &configured); err != nil {
+		return nil, fmt.Errorf("invalid backup.profiles: %w", err)
+	}
+	for name, p := range configured {
+		if len(p.Detect) == 0 {
+			// Keep detecting known services even when their targets are overridden
+			p.Detect = builtinBackupProfiles[name].Detect
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+func detectProfile(p backupProfile) bool {
+	for _, path := range p.Detect {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func profileNames(profiles map[string]backupProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dedupeTargets drops repeated targets and ones already covered by another target, so
+// overlapping profiles don't archive the same files twice.
+func dedupeTargets(targets []string) []string {
+	var cleaned []string
+	for _, t := range targets {
+		cleaned = append(cleaned, filepath.Clean(t))
+	}
+	sort.Strings(cleaned)
+
+	var result []string
+	for _, t := range cleaned {
+		if !underAny(t, result) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// matchesExclude reports whether path matches one of the exclude globs. Patterns without
+// a slash match the file name, others the full path.
+func matchesExclude(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		subject := path
+		if !strings.Contains(pattern, "/") {
+			subject = filepath.Base(path)
+		}
+		if ok, _ := filepath.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolveBackupPlanForSystemType(t *testing.T) {
+	targets := []string{"/srv/data"}
+	tests := []struct {
+		sys         string
+		wantTargets []string
+		profiles    []string
+	}{
+		{sys: "mail", wantTargets: []string{"/etc/dovecot", "/etc/postfix", "/srv/data", "/var/mail", "/var/spool/mail"}, profiles: []string{"mail"}},
+		// Types the firewall knows but backups don't get just backup.targets
+		{sys: "ftp", wantTargets: targets},
+		{sys: "generic", wantTargets: targets},
+		{sys: "splunk, ad", wantTargets: []string{"/opt/splunk", "/srv/data"}, profiles: []string{"splunk"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sys, func(t *testing.T) {
+			useConfig(t, map[string]interface{}{"backup.targets": targets})
+			systemType = tt.sys
+			t.Cleanup(func() { systemType = "" })
+
+			plan, err := resolveBackupPlan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(plan.Targets, tt.wantTargets) {
+				t.Errorf("targets %v, want %v", plan.Targets, tt.wantTargets)
+			}
+			if !slices.Equal(plan.Profiles, tt.profiles) {
+				t.Errorf("profiles %v, want %v", plan.Profiles, tt.profiles)
+			}
+		})
+	}
+}
+
+func TestResolveBackupPlanCommonProfile(t *testing.T) {
+	useConfig(t, map[string]interface{}{
+		"backup.excludes": []string{"*.swp"},
+		"backup.profiles": map[string]interface{}{
+			"common": map[string]interface{}{"targets": []string{"/etc/ssh"}, "excludes": []string{"*.bak"}},
+			"dns":    map[string]interface{}{"targets": []string{"/etc/bind"}},
+		},
+	})
+	systemType = "dns"
+	t.Cleanup(func() { systemType = "" })
+
+	plan, err := resolveBackupPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"common", "dns"}; !slices.Equal(plan.Profiles, want) {
+		t.Errorf("profiles %v, want %v", plan.Profiles, want)
+	}
+	if want := []string{"/etc/bind", "/etc/dovecot", "/etc/postfix", "/etc/ssh", "/opt/splunk", "/var/www"}; !slices.Equal(plan.Targets, want) {
+		t.Errorf("targets %v, want %v", plan.Targets, want)
+	}
+	if want := []string{"*.swp", "*.bak"}; !slices.Equal(plan.Excludes, want) {
+		t.Errorf("excludes %v, want %v", plan.Excludes, want)
+	}
+}
+
+func TestResolveBackupPlanDetectedKeepsTargets(t *testing.T) {
+	detect := t.TempDir()
+	useConfig(t, map[string]interface{}{
+		"backup.targets": []string{"/srv/data", "/srv/app"},
+		"backup.profiles": map[string]interface{}{
+			"app": map[string]interface{}{"targets": []string{"/etc/app"}, "excludes": []string{"/srv/app/tmp", "*.log"}, "detect": []string{detect}},
+		},
+	})
+
+	plan, err := resolveBackupPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(plan.Profiles, "app") {
+		t.Fatalf("profiles %v, want app detected", plan.Profiles)
+	}
+	for _, want := range []string{"/etc/app", "/srv/app", "/srv/data"} {
+		if !slices.Contains(plan.Targets, want) {
+			t.Errorf("targets %v, missing %s", plan.Targets, want)
+		}
+	}
+}
+
+func TestNarrowedTarget(t *testing.T) {
+	targets := []string{"/opt/splunk", "/var/www/"}
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"/opt/splunk/var", "/opt/splunk"},
+		{"/var/www/*/cache", "/var/www"},
+		{"/opt/splunk", "/opt/splunk"},
+		{"/opt/splunkd/var", ""},
+		{"*.log", ""},
+		{"/etc/app", ""},
+	}
+	for _, tt := range tests {
+		if got := narrowedTarget(tt.pattern, targets); got != tt.want {
+			t.Errorf("narrowedTarget(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestDedupeTargets(t *testing.T) {
+	tests := []struct {
+		in, want []string
+	}{
+		{nil, nil},
+		{[]string{"/etc/postfix", "/etc/postfix/"}, []string{"/etc/postfix"}},
+		{[]string{"/var/www/html", "/var/www"}, []string{"/var/www"}},
+		{[]string{"/etc/php", "/etc/php.ini"}, []string{"/etc/php", "/etc/php.ini"}},
+		{[]string{"/opt/splunk/etc", "/etc", "/opt/splunk"}, []string{"/etc", "/opt/splunk"}},
+	}
+	for _, tt := range tests {
+		if got := dedupeTargets(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("dedupeTargets(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesExclude(t *testing.T) {
+	tests := []struct {
+		path     string
+		patterns []string
+		want     bool
+	}{
+		{"/var/log/app.log", []string{"*.log"}, true},
+		{"/var/log/app.log.1", []string{"*.log"}, false},
+		{"/var/www/site/cache", []string{"/var/www/*/cache"}, true},
+		{"/var/www/site/cache/page", []string{"/var/www/*/cache"}, false},
+		{"/var/www/a/b/cache", []string{"/var/www/*/cache"}, false},
+		{"/opt/splunk/var", []string{"*.log", "/opt/splunk/var"}, true},
+		{"/etc/passwd", nil, false},
+	}
+	for _, tt := range tests {
+		if got := matchesExclude(tt.path, tt.patterns); got != tt.want {
+			t.Errorf("matchesExclude(%q, %v) = %v, want %v", tt.path, tt.patterns, got, tt.want)
+		}
+	}
+}
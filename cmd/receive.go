@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Names a peer may upload: backup archives and their manifests, nothing else
+var replicaNamePattern = regexp.MustCompile(`^(bak|inc)_\d{8}_\d{6}\.tar\.gz(\.manifest\.json)?(\.age)?$`)
+
+// Used when neither --max-size nor backup.receive.max_size is set
+const defaultReceiveMaxSize = "8G"
+
+var receiveListen string
+var receiveDir string
+var receiveTokenFile string
+var receiveTLSCert string
+var receiveTLSKey string
+var receiveMaxSize string
+var receiveInsecure bool
+
+var backupReceiveCmd = &cobra.Command{
+	Use:   "receive",
+	Short: "Accept replicated backups from other qcd instances",
+	Long: `Runs an HTTP endpoint that other boxes push their backups to (backup.replicas entries with an http(s):// url).
+Uploads need the bearer token from --token-file, which is created with a random token if it doesn't exist. Files are checked against the sender's SHA-256 before they are kept, and existing files are never overwritten.
+Uploads larger than --max-size are cut off. Plain HTTP would send the token and the backups in the clear, so it is refused unless --insecure or backup.receive.allow_insecure is set.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := serveReceive(); err != nil {
+			fmt.Println(NewMessage(chalk.Red, err.Error()))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupReceiveCmd)
+	backupReceiveCmd.Flags().StringVarP(&receiveListen, "listen", "l", ":7443", "Address to listen on")
+	backupReceiveCmd.Flags().StringVarP(&receiveDir, "dir", "d", "", "Directory to store received backups in (default backup.receive.dir)")
+	backupReceiveCmd.Flags().StringVar(&receiveTokenFile, "token-file", "", "File holding the upload token (default backup.receive.token_file)")
+	backupReceiveCmd.Flags().StringVar(&receiveTLSCert, "tls-cert", "", "Serve HTTPS with this certificate")
+	backupReceiveCmd.Flags().StringVar(&receiveTLSKey, "tls-key", "", "Key for --tls-cert")
+	backupReceiveCmd.Flags().StringVar(&receiveMaxSize, "max-size", "", "Largest file a peer may upload, e.g. 2G (default backup.receive.max_size, or "+defaultReceiveMaxSize+")")
+	backupReceiveCmd.Flags().BoolVar(&receiveInsecure, "insecure", false, "Allow serving plain HTTP without --tls-cert")
+}
+
+// backupReceiver stores backups pushed by peers.
+type backupReceiver struct {
+	dir     string
+	token   []byte
+	maxSize int64
+}
+
+// receiveMaxBytes is the upload limit from --max-size or backup.receive.max_size.
+func receiveMaxBytes() (int64, error) {
+	raw := receiveMaxSize
+	if raw == "" {
+		raw = viper.GetString("backup.receive.max_size")
+	}
+	if raw == "" {
+		raw = defaultReceiveMaxSize
+	}
+	size, err := parseSize(raw)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("upload limit %q must be larger than zero", raw)
+	}
+	return size, nil
+}
+
+func serveReceive() error {
+	if receiveTLSCert == "" && !receiveInsecure && !viper.GetBool("backup.receive.allow_insecure") {
+		return fmt.Errorf("refusing to serve plain HTTP, the token and backups would travel unencrypted: use --tls-cert and --tls-key, or --insecure on a trusted network")
+	}
+	maxSize, err := receiveMaxBytes()
+	if err != nil {
+		return err
+	}
+
+	dir := receiveDir
+	if dir == "" {
+		dir = viper.GetString("backup.receive.dir")
+	}
+	if dir == "" {
+		dir = filepath.Join(qcdStateDir(), "replicas")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tokenFile := receiveTokenFile
+	if tokenFile == "" {
+		tokenFile = viper.GetString("backup.receive.token_file")
+	}
+	if tokenFile == "" {
+		tokenFile = filepath.Join(qcdStateDir(), "receive.token")
+	}
+	token, err := readSecretFile(tokenFile)
+	if os.IsNotExist(err) {
+		if token, err = generatePassword(); err != nil {
+			return err
+		}
+		if err := writeSecretFile(tokenFile, token); err != nil {
+			return err
+		}
+		fmt.Println(NewMessage(chalk.Yellow, "Generated an upload token in "+tokenFile+", give it to the sending boxes:").ThenColor(chalk.White, token))
+	} else if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("upload token in %s is empty", tokenFile)
+	}
+
+	rcv := &backupReceiver{dir: dir, token: []byte(token), maxSize: maxSize}
+	mux := http.NewServeMux()
+	mux.HandleFunc("HEAD /backups/{name}", rcv.head)
+	mux.HandleFunc("PUT /backups/{name}", rcv.put)
+
+	server := &http.Server{
+		Addr:              receiveListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	fmt.Println(NewMessage(chalk.Green, "Receiving backups into "+dir+" on "+receiveListen).
+		ThenColor(chalk.White, "(up to "+FormatBytes(maxSize)+" per file)"))
+	if receiveTLSCert != "" {
+		return server.ListenAndServeTLS(receiveTLSCert, receiveTLSKey)
+	}
+	fmt.Println(NewMessage(chalk.Yellow, "Warning: serving plain HTTP, the token and backups travel unencrypted (use --tls-cert)"))
+	return server.ListenAndServe()
+}
+
+// authorize checks the bearer token and the file name, writing the error response if
+// either is bad.
+func (rcv *backupReceiver) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), rcv.token) != 1 {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return "", false
+	}
+	name := r.PathValue("name")
+	if !replicaNamePattern.MatchString(name) {
+		http.Error(w, "not a backup file name", http.StatusBadRequest)
+		return "", false
+	}
+	return filepath.Join(rcv.dir, name), true
+}
+
+func (rcv *backupReceiver) head(w http.ResponseWriter, r *http.Request) {
+	path, ok := rcv.authorize(w, r)
+	if !ok {
+		return
+	}
+	sum, _, err := hashFile(path)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(replicaSumHeader, sum)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rcv *backupReceiver) put(w http.ResponseWriter, r *http.Request) {
+	path, ok := rcv.authorize(w, r)
+	if !ok {
+		return
+	}
+	want := strings.ToLower(r.Header.Get(replicaSumHeader))
+	if len(want) != sha256.Size*2 {
+		http.Error(w, "missing "+replicaSumHeader, http.StatusBadRequest)
+		return
+	}
+
+	if sum, _, err := hashFile(path); err == nil {
+		w.Header().Set(replicaSumHeader, sum)
+		if sum != want {
+			http.Error(w, "a different file with this name exists", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	tmp, err := os.CreateTemp(rcv.dir, ".receive-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), http.MaxBytesReader(w, r.Body, rcv.maxSize))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("file is larger than the %s limit", FormatBytes(tooLarge.Limit)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	w.Header().Set(replicaSumHeader, got)
+	if got != want {
+		http.Error(w, "checksum mismatch, got "+got, http.StatusUnprocessableEntity)
+		return
+	}
+	// Link instead of rename so a file that appeared meanwhile is never replaced
+	if err := os.Link(tmp.Name(), path); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	// Drop the temp name first, an immutable file can't be unlinked
+	os.Remove(tmp.Name())
+	if backupImmutable() {
+		if err := setImmutable(path, true); err != nil {
+			fmt.Println(NewMessage(chalk.Yellow, "Could not make "+filepath.Base(path)+" immutable: "+err.Error()))
+		}
+	}
+
+	fmt.Println(NewMessage(chalk.Green, fmt.Sprintf("Received %s from %s (%s)", filepath.Base(path), r.RemoteAddr, FormatBytes(n))))
+	w.WriteHeader(http.StatusCreated)
+}
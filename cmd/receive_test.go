@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReceivePutLimit(t *testing.T) {
+	useConfig(t, nil)
+	rcv := &backupReceiver{dir: t.TempDir(), token: []byte("secret"), maxSize: 16}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /backups/{name}", rcv.put)
+
+	tests := []struct {
+		name   string
+		file   string
+		body   string
+		status int
+	}{
+		{"within the limit", "bak_20240102_030405.tar.gz", "small", http.StatusCreated},
+		{"at the limit", "bak_20240102_040405.tar.gz", strings.Repeat("x", 16), http.StatusCreated},
+		{"over the limit", "bak_20240102_050405.tar.gz", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge},
+		{"not a backup", "passwd", "small", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/backups/"+tt.file, bytes.NewReader([]byte(tt.body)))
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set(replicaSumHeader, sha256Hex([]byte(tt.body)))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			_, err := os.Stat(filepath.Join(rcv.dir, tt.file))
+			if kept := err == nil; kept != (tt.status == http.StatusCreated) {
+				t.Errorf("file kept = %v with status %d", kept, rec.Code)
+			}
+		})
+	}
+}
+
+func TestReceiveRefusesPlainHTTP(t *testing.T) {
+	useConfig(t, nil)
+	if err := serveReceive(); err == nil || !strings.Contains(err.Error(), "plain HTTP") {
+		t.Fatalf("serveReceive without TLS = %v, want a plain HTTP error", err)
+	}
+}
+
+func TestLoadReplicasInsecure(t *testing.T) {
+	tests := []struct {
+		name    string
+		replica map[string]interface{}
+		wantErr bool
+	}{
+		{"https", map[string]interface{}{"url": "https://backup.example:7443", "token": "t"}, false},
+		{"sftp", map[string]interface{}{"url": "sftp://qcd@backup.example/srv"}, false},
+		{"plain http", map[string]interface{}{"url": "http://backup.example:7443", "token": "t"}, true},
+		{"plain http allowed", map[string]interface{}{"url": "http://backup.example:7443", "token": "t", "allow_insecure": true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]interface{}{"backup.replicas": []interface{}{tt.replica}})
+			_, err := loadReplicas()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadReplicas() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
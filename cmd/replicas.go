@@ -0,0 +1,501 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Header carrying the SHA-256 of an uploaded file between qcd peers
+const replicaSumHeader = "X-Qcd-Sha256"
+
+// A different file with the same name is already on the replica. Retrying won't help.
+var errReplicaConflict = errors.New("a different file already exists on the replica")
+
+var replicateAll bool
+
+var backupReplicateCmd = &cobra.Command{
+	Use:   "replicate [<archive>|latest]",
+	Short: "Copy backups to the configured replicas",
+	Long: `Uploads a backup and its manifest to every entry of backup.replicas. This happens automatically after each backup; use this to retry a failed copy or, with --all, to seed a new replica.
+Replicas are append only: files already present with the same checksum are skipped, and nothing is ever deleted or overwritten on the other side.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var archives []string
+		if replicateAll {
+			backups, err := listBackups(backupDest())
+			if CheckError(err) {
+				os.Exit(1)
+			}
+			for _, b := range backups {
+				archives = append(archives, b.Path)
+			}
+		} else {
+			ref := "latest"
+			if len(args) > 0 {
+				ref = args[0]
+			}
+			archive, err := resolveBackup(ref)
+			if CheckError(err) {
+				os.Exit(1)
+			}
+			archives = append(archives, archive)
+		}
+
+		if err := replicateBackups(archives); err != nil {
+			fmt.Println(NewMessage(chalk.Red, err.Error()))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupReplicateCmd)
+	backupReplicateCmd.Flags().BoolVarP(&replicateAll, "all", "a", false, "Replicate every backup in backup.dest")
+}
+
+// backupReplica is one entry of backup.replicas.
+type backupReplica struct {
+	Name string `mapstructure:"name"`
+	// sftp or qcd, guessed from the URL scheme when empty
+	Type string `mapstructure:"type"`
+	// sftp://user@host:22/path or http(s)://host:port of a qcd backup receive
+	URL string `mapstructure:"url"`
+	// SFTP authentication and host key checking
+	IdentityFile string `mapstructure:"identity_file"`
+	PasswordFile string `mapstructure:"password_file"`
+	KnownHosts   string `mapstructure:"known_hosts"`
+	HostKey      string `mapstructure:"host_key"`
+	// qcd peer authentication and TLS
+	Token     string `mapstructure:"token"`
+	TokenFile string `mapstructure:"token_file"`
+	CAFile    string `mapstructure:"ca_file"`
+	// Send the token and backups over plain http://
+	AllowInsecure bool `mapstructure:"allow_insecure"`
+
+	Retries int    `mapstructure:"retries"`
+	Timeout string `mapstructure:"timeout"`
+}
+
+// replicaTarget uploads files to a replica.
+type replicaTarget interface {
+	// Put uploads local as name unless an identical copy is already there, and checks
+	// that what arrived has the given SHA-256. It reports whether anything was sent.
+	Put(name, local, sum string) (bool, error)
+	Close() error
+}
+
+func loadReplicas() ([]backupReplica, error) {
+	var replicas []backupReplica
+	if err := viper.UnmarshalKey("backup.replicas", &replicas); err != nil {
+		return nil, fmt.Errorf("invalid backup.replicas: %w", err)
+	}
+	for i := range replicas {
+		r := &replicas[i]
+		u, err := url.Parse(r.URL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("backup.replicas[%d]: invalid url %q", i, r.URL)
+		}
+		if r.Name == "" {
+			r.Name = u.Host
+		}
+		if r.Type == "" {
+			switch u.Scheme {
+			case "sftp", "ssh":
+				r.Type = "sftp"
+			case "http", "https":
+				r.Type = "qcd"
+			}
+		}
+		if r.Type != "sftp" && r.Type != "qcd" {
+			return nil, fmt.Errorf("replica %s: unknown type %q (expected sftp or qcd)", r.Name, r.Type)
+		}
+		if r.Type == "qcd" && u.Scheme != "https" && !r.AllowInsecure {
+			return nil, fmt.Errorf("replica %s: refusing to send the token and backups over %s://, use https:// or set allow_insecure", r.Name, u.Scheme)
+		}
+		if r.Retries <= 0 {
+			r.Retries = 3
+		}
+	}
+	return replicas, nil
+}
+
+// replicateBackups copies each archive and its manifest to every replica. Every replica
+// is tried even if an earlier one fails.
+func replicateBackups(archives []string) error {
+	replicas, err := loadReplicas()
+	if err != nil {
+		return err
+	}
+	if len(replicas) == 0 {
+		return nil
+	}
+
+	// Hash once, every replica checks against the same sums
+	var files []string
+	sums := make(map[string]string)
+	for _, archive := range archives {
+		for _, f := range []string{archive, manifestPath(archive)} {
+			if _, err := os.Stat(f); err != nil {
+				continue
+			}
+			sum, _, err := hashFile(f)
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+			sums[f] = sum
+		}
+	}
+
+	var failed []string
+	for _, r := range replicas {
+		if err := replicateTo(r, files, sums); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Replica "+r.Name+" failed: "+err.Error()))
+			failed = append(failed, r.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("replication failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// replicateTo uploads files to one replica, reconnecting and retrying with backoff.
+func replicateTo(r backupReplica, files []string, sums map[string]string) error {
+	done := make(map[string]bool)
+	var err error
+	for attempt := 1; attempt <= r.Retries; attempt++ {
+		if attempt > 1 {
+			wait := time.Duration(1<<(attempt-1)) * time.Second
+			fmt.Println(NewMessage(chalk.Yellow, fmt.Sprintf("Retrying replica %s in %s (attempt %d of %d): %s", r.Name, wait, attempt, r.Retries, err)))
+			time.Sleep(wait)
+		}
+
+		var target replicaTarget
+		target, err = connectReplica(r)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if done[f] {
+				continue
+			}
+			var sent bool
+			sent, err = target.Put(filepath.Base(f), f, sums[f])
+			if err != nil {
+				err = fmt.Errorf("%s: %w", filepath.Base(f), err)
+				break
+			}
+			done[f] = true
+			if sent {
+				fmt.Println(NewMessage(chalk.Green, "Replicated "+filepath.Base(f)+" to "+r.Name))
+			} else {
+				fmt.Println(NewMessage(chalk.Blue, filepath.Base(f)+" is already on "+r.Name))
+			}
+		}
+		target.Close()
+		if err == nil || errors.Is(err, errReplicaConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func connectReplica(r backupReplica) (replicaTarget, error) {
+	timeout := 30 * time.Second
+	if r.Timeout != "" {
+		d, err := time.ParseDuration(r.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %w", r.Timeout, err)
+		}
+		timeout = d
+	}
+	if r.Type == "sftp" {
+		return dialSFTPReplica(r, timeout)
+	}
+	return newPeerReplica(r, timeout)
+}
+
+// sftpReplica stores backups in a directory on an SSH server.
+type sftpReplica struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	dir    string
+}
+
+func dialSFTPReplica(r backupReplica, timeout time.Duration) (*sftpReplica, error) {
+	u, _ := url.Parse(r.URL)
+	config := &ssh.ClientConfig{User: u.User.Username(), Timeout: timeout}
+	if config.User == "" {
+		config.User = "root"
+	}
+
+	if r.IdentityFile != "" {
+		key, err := os.ReadFile(r.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("can't use identity %s: %w", r.IdentityFile, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if r.PasswordFile != "" {
+		password, err := readSecretFile(r.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+	if len(config.Auth) == 0 {
+		return nil, fmt.Errorf("set identity_file or password_file")
+	}
+
+	// Never trust an unknown host, that's exactly what red team would hand us
+	switch {
+	case r.HostKey != "":
+		config.HostKeyCallback = func(host string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != r.HostKey {
+				return fmt.Errorf("host key %s does not match the pinned %s", got, r.HostKey)
+			}
+			return nil
+		}
+	default:
+		known := r.KnownHosts
+		if known == "" {
+			home, _ := os.UserHomeDir()
+			known = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		callback, err := knownhosts.New(known)
+		if err != nil {
+			return nil, fmt.Errorf("no host_key pinned and can't read known_hosts: %w", err)
+		}
+		config.HostKeyCallback = callback
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+	if err := client.MkdirAll(dir); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+	return &sftpReplica{conn: conn, client: client, dir: dir}, nil
+}
+
+func (s *sftpReplica) Put(name, local, sum string) (bool, error) {
+	remote := path.Join(s.dir, name)
+	if _, err := s.client.Stat(remote); err == nil {
+		got, err := s.remoteSum(remote)
+		if err != nil {
+			return false, err
+		}
+		if got != sum {
+			return false, errReplicaConflict
+		}
+		return false, nil
+	}
+
+	in, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	part := remote + ".part"
+	out, err := s.client.OpenFile(part, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		s.client.Remove(part)
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		s.client.Remove(part)
+		return false, err
+	}
+	s.client.Chmod(part, 0600)
+
+	// Read it back, a short write on a full disk would otherwise go unnoticed
+	got, err := s.remoteSum(part)
+	if err != nil || got != sum {
+		s.client.Remove(part)
+		if err == nil {
+			err = fmt.Errorf("checksum mismatch after upload (got %s)", got)
+		}
+		return false, err
+	}
+	if err := s.client.PosixRename(part, remote); err != nil {
+		if err := s.client.Rename(part, remote); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (s *sftpReplica) remoteSum(remote string) (string, error) {
+	f, err := s.client.Open(remote)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *sftpReplica) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
+
+// peerReplica pushes backups to another qcd running backup receive.
+type peerReplica struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newPeerReplica(r backupReplica, timeout time.Duration) (*peerReplica, error) {
+	token := r.Token
+	if r.TokenFile != "" {
+		t, err := readSecretFile(r.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = t
+	}
+	if token == "" {
+		return nil, fmt.Errorf("set token or token_file")
+	}
+
+	// The timeout only covers connecting and waiting for the peer to answer, large
+	// uploads may take longer than that
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+	transport.ResponseHeaderTimeout = timeout
+	if r.CAFile != "" {
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", r.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &peerReplica{
+		base:   strings.TrimSuffix(r.URL, "/"),
+		token:  token,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (p *peerReplica) request(method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, p.base+"/backups/"+url.PathEscape(name), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	return req, nil
+}
+
+func (p *peerReplica) Put(name, local, sum string) (bool, error) {
+	req, err := p.request(http.MethodHead, name, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.Header.Get(replicaSumHeader) != sum {
+			return false, errReplicaConflict
+		}
+		return false, nil
+	case http.StatusNotFound:
+	default:
+		return false, fmt.Errorf("peer answered %s", resp.Status)
+	}
+
+	in, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	req, err = p.request(http.MethodPut, name, in)
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set(replicaSumHeader, sum)
+	resp, err = p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("peer answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if got := resp.Header.Get(replicaSumHeader); got != sum {
+		return false, fmt.Errorf("peer stored checksum %q, expected %s", got, sum)
+	}
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+func (p *peerReplica) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
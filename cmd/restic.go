@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+	"go.yaml.in/yaml/v3"
+)
+
+// First line of every resticprofile config we write, so we know it's safe to regenerate
+const resticProfileHeader = "# Generated by qcd from the backup.restic settings, changes here will be overwritten.\n"
+
+// Name of the resticprofile profile qcd manages
+const resticProfileName = "default"
+
+var resticConfigPrint bool
+
+var backupResticConfigCmd = &cobra.Command{
+	Use:   "restic-config",
+	Short: "Generate the resticprofile config from backup.restic settings",
+	Long:  `Renders profiles.yaml for resticprofile from the backup.restic settings (sources, excludes, schedule, retention and repository), validates it, and writes it if it changed. Runs automatically with backup --restic.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if resticConfigPrint {
+			content, err := renderResticProfile()
+			if CheckError(err) {
+				return
+			}
+			fmt.Print(string(content))
+			return
+		}
+
+		changed, err := writeResticProfile()
+		if CheckError(err) {
+			return
+		}
+		if changed {
+			fmt.Println(NewMessage(chalk.Blue, "Updating resticprofile schedule..."))
+			RunCommand("resticprofile", resticprofileArgs("schedule")...)
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupResticConfigCmd)
+	backupResticConfigCmd.Flags().BoolVarP(&resticConfigPrint, "print", "p", false, "Print the generated config instead of writing it")
+}
+
+// resticProfile mirrors the subset of the resticprofile (v1) profile format qcd uses.
+type resticProfile struct {
+	Repository   string          `yaml:"repository"`
+	PasswordFile string          `yaml:"password-file"`
+	Initialize   bool            `yaml:"initialize"`
+	Backup       resticBackup    `yaml:"backup"`
+	Retention    resticRetention `yaml:"retention"`
+}
+
+type resticBackup struct {
+	Source   []string `yaml:"source"`
+	Exclude  []string `yaml:"exclude,omitempty"`
+	Schedule string   `yaml:"schedule,omitempty"`
+}
+
+type resticRetention struct {
+	AfterBackup bool `yaml:"after-backup"`
+	KeepLast    int  `yaml:"keep-last,omitempty"`
+	KeepHourly  int  `yaml:"keep-hourly,omitempty"`
+	KeepDaily   int  `yaml:"keep-daily,omitempty"`
+	Prune       bool `yaml:"prune"`
+}
+
+func resticConfigPath() string {
+	if path := viper.GetString("backup.restic.config"); path != "" {
+		return path
+	}
+	return "profiles.yaml"
+}
+
+// resticprofileArgs builds a resticprofile command line for qcd's profile and config.
+func resticprofileArgs(command string) []string {
+	return []string{"--config", resticConfigPath(), "--name", resticProfileName, command}
+}
+
+func resticRepository() string {
+	if repo := viper.GetString("backup.restic.repository"); repo != "" {
+		return repo
+	}
+	// Use configured backup destination for restic repo as well
+	dest := backupDest()
+	if dest == "" {
+		dest = "./backups"
+	}
+	if abs, err := filepath.Abs(dest); err == nil {
+		dest = abs
+	}
+	return "local:" + filepath.Join(dest, "restic")
+}
+
+func resticPasswordPath() string {
+	if path := viper.GetString("backup.restic.password_file"); path != "" {
+		return path
+	}
+	// CCDC tools usually run as root, otherwise keep it in the user's home
+	if os.Geteuid() != 0 {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, ".restic-passwd")
+	}
+	return "/root/.restic-passwd"
+}
+
+// buildResticProfile assembles the profile from viper settings.
+func buildResticProfile() resticProfile {
+	sources := viper.GetStringSlice("backup.restic.sources")
+	if len(sources) == 0 {
+		sources = backupTargets()
+	}
+	sources = append(sources, hookTargets()...)
+
+	// restic refuses to run if any source is missing
+	var existing []string
+	for _, source := range sources {
+		if _, err := os.Stat(source); err != nil {
+			fmt.Println(NewMessage(chalk.Yellow, "Warning: restic source "+source+" does not exist, leaving it out"))
+			continue
+		}
+		existing = append(existing, source)
+	}
+
+	return resticProfile{
+		Repository:   resticRepository(),
+		PasswordFile: resticPasswordPath(),
+		Initialize:   true,
+		Backup: resticBackup{
+			Source:   existing,
+			Exclude:  append(viper.GetStringSlice("backup.restic.excludes"), backupExcludes()...),
+			Schedule: viper.GetString("backup.restic.schedule"),
+		},
+		Retention: resticRetention{
+			AfterBackup: true,
+			KeepLast:    viper.GetInt("backup.restic.retention.keep_last"),
+			KeepHourly:  viper.GetInt("backup.restic.retention.keep_hourly"),
+			KeepDaily:   viper.GetInt("backup.restic.retention.keep_daily"),
+			Prune:       true,
+		},
+	}
+}
+
+func validateResticProfile(p resticProfile) error {
+	if p.Repository == "" {
+		return fmt.Errorf("restic repository is empty")
+	}
+	if len(p.Backup.Source) == 0 {
+		return fmt.Errorf("no restic sources exist on this system")
+	}
+	for _, source := range p.Backup.Source {
+		if !filepath.IsAbs(source) {
+			return fmt.Errorf("restic source %q must be an absolute path", source)
+		}
+	}
+
+	r := p.Retention
+	if r.KeepLast < 0 || r.KeepHourly < 0 || r.KeepDaily < 0 {
+		return fmt.Errorf("restic retention values can't be negative")
+	}
+	if r.KeepLast+r.KeepHourly+r.KeepDaily == 0 {
+		return fmt.Errorf("restic retention needs at least one of keep_last, keep_hourly or keep_daily, otherwise every snapshot is forgotten")
+	}
+
+	// systemd understands the schedule format resticprofile uses, so let it check
+	if p.Backup.Schedule != "" {
+		if _, err := exec.LookPath("systemd-analyze"); err == nil {
+			if out, err := exec.Command("systemd-analyze", "calendar", p.Backup.Schedule).CombinedOutput(); err != nil {
+				return fmt.Errorf("invalid restic schedule %q: %s", p.Backup.Schedule, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+	return nil
+}
+
+// renderResticProfile produces the validated profiles.yaml content.
+func renderResticProfile() ([]byte, error) {
+	profile := buildResticProfile()
+	if err := validateResticProfile(profile); err != nil {
+		return nil, err
+	}
+	// omitempty drops an empty exclude list, which then reads back as nil
+	if len(profile.Backup.Exclude) == 0 {
+		profile.Backup.Exclude = nil
+	}
+
+	body, err := yaml.Marshal(map[string]resticProfile{resticProfileName: profile})
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure what we hand resticprofile parses back to the same thing
+	var check map[string]resticProfile
+	if err := yaml.Unmarshal(body, &check); err != nil {
+		return nil, fmt.Errorf("generated resticprofile config is not valid YAML: %w", err)
+	}
+	if len(check) != 1 || !reflect.DeepEqual(check[resticProfileName], profile) {
+		return nil, fmt.Errorf("generated resticprofile config does not round-trip")
+	}
+
+	return append([]byte(resticProfileHeader), body...), nil
+}
+
+// writeResticProfile regenerates the resticprofile config and reports whether it
+// changed. A hand written config is kept as a .bak copy before it is replaced.
+func writeResticProfile() (bool, error) {
+	content, err := renderResticProfile()
+	if err != nil {
+		return false, err
+	}
+
+	path := resticConfigPath()
+	existing, err := os.ReadFile(path)
+	if err == nil {
+		if bytes.Equal(existing, content) {
+			fmt.Println(NewMessage(chalk.Green, "resticprofile config "+path+" is up to date"))
+			return false, nil
+		}
+		if !bytes.HasPrefix(existing, []byte(resticProfileHeader)) {
+			fmt.Println(NewMessage(chalk.Yellow, "Keeping the existing hand written config as "+path+".bak"))
+			if err := os.WriteFile(path+".bak", existing, 0600); err != nil {
+				return false, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return false, err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	fmt.Println(NewMessage(chalk.Green, "Wrote resticprofile config to "+path))
+	return true, nil
+}
+
+// setupRestic installs restic and resticprofile if needed, then prepares the password
+// file, profile and repository.
+func setupRestic(bundle string) error {
+	if err := installResticTools(bundle); err != nil {
+		return err
+	}
+
+	// Configure Password File
+	if err := ensureResticPassword(); err != nil {
+		return err
+	}
+
+	// Configure Profile
+	if _, err := writeResticProfile(); err != nil {
+		return fmt.Errorf("failed to write resticprofile config: %w", err)
+	}
+
+	// Explicitly try to init to ensure it exists (ignoring error if it already exists)
+	// We do this because auto-init sometimes fails permissions or paths silently if not explicit
+	fmt.Println(NewMessage(chalk.Blue, "Ensuring Restic Repository Initialized..."))
+	RunCommand("resticprofile", resticprofileArgs("init")...)
+
+	return nil
+}
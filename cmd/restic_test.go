@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.yaml.in/yaml/v3"
+)
+
+func TestRenderResticProfile(t *testing.T) {
+	src := t.TempDir()
+	tests := []struct {
+		name     string
+		sys      string
+		settings map[string]interface{}
+		wantErr  string
+	}{
+		{
+			// No excludes at all, which YAML leaves out
+			name: "plain",
+			sys:  "mail",
+			settings: map[string]interface{}{
+				"backup.restic.retention.keep_last": 5,
+			},
+		},
+		{
+			name: "values that need quoting",
+			settings: map[string]interface{}{
+				"backup.restic.repository":          "sftp:backup@10.0.0.5:/srv/restic #1",
+				"backup.restic.excludes":            []string{"*.tmp", "# not a comment", "key: value", "- dash", "yes"},
+				"backup.restic.retention.keep_last": 5,
+			},
+		},
+		{
+			name:     "no retention",
+			settings: map[string]interface{}{},
+			wantErr:  "needs at least one",
+		},
+		{
+			name: "relative source",
+			settings: map[string]interface{}{
+				"backup.restic.sources":             []string{"."},
+				"backup.restic.retention.keep_last": 5,
+			},
+			wantErr: "absolute path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := map[string]interface{}{"backup.restic.sources": []string{src}}
+			for k, v := range tt.settings {
+				settings[k] = v
+			}
+			useConfig(t, settings)
+			systemType = tt.sys
+			t.Cleanup(func() { systemType = "" })
+
+			body, err := renderResticProfile()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(body, []byte(resticProfileHeader)) {
+				t.Errorf("missing the generated header")
+			}
+
+			var parsed map[string]resticProfile
+			if err := yaml.Unmarshal(body, &parsed); err != nil {
+				t.Fatal(err)
+			}
+			got := parsed[resticProfileName]
+			if repo, ok := tt.settings["backup.restic.repository"]; ok && got.Repository != repo {
+				t.Errorf("repository %q, want %q", got.Repository, repo)
+			}
+			// Followed by the excludes of whatever backup profiles this box detects
+			if excludes, ok := tt.settings["backup.restic.excludes"].([]string); ok &&
+				(len(got.Backup.Exclude) < len(excludes) || !slices.Equal(got.Backup.Exclude[:len(excludes)], excludes)) {
+				t.Errorf("excludes %q, want %q first", got.Backup.Exclude, excludes)
+			}
+			if len(got.Backup.Source) != 1 || got.Backup.Source[0] != src {
+				t.Errorf("sources %q, want [%s]", got.Backup.Source, src)
+			}
+		})
+	}
+}
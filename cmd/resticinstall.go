@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// resticTool describes how to find and unpack a release of restic or resticprofile.
+type resticTool struct {
+	Name       string
+	VersionKey string
+	Version    string
+	URLKey     string
+	URL        string
+	// Release asset architecture names by GOARCH
+	Arches map[string]string
+}
+
+var resticTools = []resticTool{
+	{
+		Name:       "restic",
+		VersionKey: "backup.restic.version",
+		Version:    "0.16.4",
+		URLKey:     "backup.restic.url",
+		URL:        "https://github.com/restic/restic/releases/download/v{{.Version}}/restic_{{.Version}}_{{.OS}}_{{.Arch}}.bz2",
+		Arches:     map[string]string{"amd64": "amd64", "arm64": "arm64", "arm": "arm", "386": "386"},
+	},
+	{
+		Name:       "resticprofile",
+		VersionKey: "backup.restic.resticprofile_version",
+		Version:    "0.26.0",
+		URLKey:     "backup.restic.resticprofile_url",
+		URL:        "https://github.com/creativeprojects/resticprofile/releases/download/v{{.Version}}/resticprofile_{{.Version}}_{{.OS}}_{{.Arch}}.tar.gz",
+		Arches:     map[string]string{"amd64": "amd64", "arm64": "arm64", "arm": "armv7", "386": "386"},
+	},
+}
+
+// installResticTools installs restic and resticprofile if they aren't already on the
+// PATH, from bundle when given and from the release URLs otherwise.
+func installResticTools(bundle string) error {
+	for _, tool := range resticTools {
+		if err := RunCommand(tool.Name, "version"); err == nil {
+			continue
+		}
+		if err := installResticTool(tool, bundle); err != nil {
+			return fmt.Errorf("failed to install %s: %w", tool.Name, err)
+		}
+	}
+	return nil
+}
+
+func installResticTool(tool resticTool, bundle string) error {
+	arch, ok := tool.Arches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("no %s release for architecture %s", tool.Name, runtime.GOARCH)
+	}
+
+	rawURL, version := viper.GetString(tool.URLKey), viper.GetString(tool.VersionKey)
+	if rawURL == "" {
+		rawURL = tool.URL
+	}
+	if version == "" {
+		version = tool.Version
+	}
+	url, err := expandReleaseURL(rawURL, version, arch)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", tool.URLKey, err)
+	}
+	artifact := path.Base(url)
+
+	var data []byte
+	if bundle != "" {
+		fmt.Println(NewMessage(chalk.Yellow, tool.Name+" not found. Installing "+artifact+" from "+bundle+"..."))
+		data, err = readBundleArtifact(bundle, artifact)
+	} else {
+		fmt.Println(NewMessage(chalk.Yellow, tool.Name+" not found. Downloading "+url+"..."))
+		data, err = downloadArtifact(url)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := verifyArtifact(artifact, data); err != nil {
+		return err
+	}
+
+	binary, err := extractBinary(artifact, tool.Name, data)
+	if err != nil {
+		return fmt.Errorf("failed to unpack %s: %w", artifact, err)
+	}
+
+	binDir := viper.GetString("backup.restic.bin_dir")
+	if binDir == "" {
+		binDir = "/usr/local/bin"
+	}
+	dest := filepath.Join(binDir, tool.Name)
+	if err := installBinary(dest, binary); err != nil {
+		return err
+	}
+	fmt.Println(NewMessage(chalk.Green, "Installed "+tool.Name+" to "+dest))
+	return nil
+}
+
+// expandReleaseURL fills in {{.Version}}, {{.OS}} and {{.Arch}} in a release URL template.
+func expandReleaseURL(raw, version, arch string) (string, error) {
+	tmpl, err := template.New("url").Option("missingkey=error").Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]string{
+		"Version": strings.TrimPrefix(version, "v"),
+		"OS":      runtime.GOOS,
+		"Arch":    arch,
+	})
+	return buf.String(), err
+}
+
+// readBundleArtifact finds a release artifact by file name in a bundle, which is either a
+// directory or a (optionally gzipped) tarball.
+func readBundleArtifact(bundle, artifact string) ([]byte, error) {
+	info, err := os.Stat(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		data, err := os.ReadFile(filepath.Join(bundle, artifact))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("bundle %s has no %s", bundle, artifact)
+		}
+		return data, err
+	}
+
+	f, err := os.Open(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if head, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(head, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("bundle %s has no %s", bundle, artifact)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle %s: %w", bundle, err)
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Base(hdr.Name) == artifact {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+func downloadArtifact(url string) ([]byte, error) {
+	tmp, err := os.CreateTemp("", "qcd-download-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := DownloadFile(tmp.Name(), url); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(tmp.Name())
+}
+
+// resticChecksums parses backup.restic.checksums, which holds lines in sha256sum format
+// ("<sha256>  <file name>").
+func resticChecksums() (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, line := range viper.GetStringSlice("backup.restic.checksums") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid backup.restic.checksums entry %q, expected \"<sha256>  <file>\"", line)
+		}
+		sum := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid SHA-256 %q in backup.restic.checksums", fields[0])
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = sum
+	}
+	return sums, nil
+}
+
+// verifyArtifact checks data against the pinned checksum for artifact. Unpinned artifacts
+// are refused unless backup.restic.allow_unpinned is set, either way the error or warning
+// shows the checksum to pin.
+func verifyArtifact(artifact string, data []byte) error {
+	sums, err := resticChecksums()
+	if err != nil {
+		return err
+	}
+
+	h := sha256.Sum256(data)
+	got := hex.EncodeToString(h[:])
+	want, pinned := sums[artifact]
+	if !pinned {
+		if !viper.GetBool("backup.restic.allow_unpinned") {
+			return fmt.Errorf("no checksum pinned for %s, refusing to install it, check the release and add \"%s  %s\" to backup.restic.checksums", artifact, got, artifact)
+		}
+		fmt.Println(NewMessage(chalk.Yellow, "Warning: installing "+artifact+" without a pinned checksum (backup.restic.allow_unpinned), add it to backup.restic.checksums:").
+			ThenColor(chalk.White, got+"  "+artifact))
+		return nil
+	}
+	if got != want {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s, refusing to install", artifact, want, got)
+	}
+	fmt.Println(NewMessage(chalk.Green, "Checksum verified for "+artifact))
+	return nil
+}
+
+// extractBinary unpacks the named executable from a release artifact: a bzip2 compressed
+// binary, a tarball containing it, or the plain binary.
+func extractBinary(artifact, name string, data []byte) ([]byte, error) {
+	switch {
+	case strings.HasSuffix(artifact, ".bz2"):
+		return io.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	case strings.HasSuffix(artifact, ".tar.gz"), strings.HasSuffix(artifact, ".tgz"):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil, fmt.Errorf("no %s in %s", name, artifact)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg && path.Base(hdr.Name) == name {
+				return io.ReadAll(tr)
+			}
+		}
+	default:
+		return data, nil
+	}
+}
+
+// installBinary writes an executable into place atomically.
+func installBinary(dest string, binary []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestExpandReleaseURL(t *testing.T) {
+	tests := []struct {
+		raw, version, arch string
+		want               string
+		wantErr            bool
+	}{
+		{
+			raw:     "https://example.com/v{{.Version}}/restic_{{.Version}}_{{.OS}}_{{.Arch}}.bz2",
+			version: "0.16.4", arch: "amd64",
+			want: "https://example.com/v0.16.4/restic_0.16.4_" + runtime.GOOS + "_amd64.bz2",
+		},
+		{raw: "https://example.com/{{.Version}}", version: "v1.2.3", want: "https://example.com/1.2.3"},
+		{raw: "https://example.com/static.tar.gz", version: "1.0", want: "https://example.com/static.tar.gz"},
+		{raw: "https://example.com/{{.Release}}", version: "1.0", wantErr: true},
+		{raw: "https://example.com/{{.Version", version: "1.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandReleaseURL(tt.raw, tt.version, tt.arch)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("expandReleaseURL(%q) = %q, %v, want %q, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestResticChecksums(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		lines   []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", want: map[string]string{}},
+		{
+			name:  "sha256sum format",
+			lines: []string{sum + "  restic_0.16.4_linux_amd64.bz2", strings.ToUpper(sum) + " *resticprofile.tar.gz"},
+			want:  map[string]string{"restic_0.16.4_linux_amd64.bz2": sum, "resticprofile.tar.gz": sum},
+		},
+		{name: "missing file name", lines: []string{sum}, wantErr: true},
+		{name: "short sum", lines: []string{"abcd  restic.bz2"}, wantErr: true},
+		{name: "not hex", lines: []string{strings.Repeat("zz", 32) + "  restic.bz2"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]interface{}{"backup.restic.checksums": tt.lines})
+			got, err := resticChecksums()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s: got %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyArtifact(t *testing.T) {
+	data := []byte("release")
+	sum := sha256Hex(data)
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		wantErr  string
+	}{
+		{name: "pinned", settings: map[string]interface{}{"backup.restic.checksums": []string{sum + "  restic.bz2"}}},
+		{
+			name:     "mismatch",
+			settings: map[string]interface{}{"backup.restic.checksums": []string{sha256Hex([]byte("other")) + "  restic.bz2"}},
+			wantErr:  "checksum mismatch",
+		},
+		{name: "unpinned", wantErr: "no checksum pinned"},
+		{name: "unpinned allowed", settings: map[string]interface{}{"backup.restic.allow_unpinned": true}},
+		{
+			name: "mismatch not overridden",
+			settings: map[string]interface{}{
+				"backup.restic.checksums":      []string{sha256Hex([]byte("other")) + "  restic.bz2"},
+				"backup.restic.allow_unpinned": true,
+			},
+			wantErr: "checksum mismatch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.settings)
+			err := verifyArtifact("restic.bz2", data)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
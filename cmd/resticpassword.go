@@ -0,0 +1,259 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Password older versions of qcd wrote for every restic repository
+const legacyResticPassword = "changeme_ccdc_password"
+
+var backupRotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Replace the restic repository password",
+	Long: `Generates a new random password, adds it as a key to the restic repository, removes the old key and replaces the password file.
+If backup.restic.escrow_recipients is set the new password is escrowed again. Use this to move off the old shared changeme_ccdc_password.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := rotateResticKey(); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Key rotation failed: "+err.Error()))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupRotateKeyCmd)
+}
+
+// generatePassword returns a random 256 bit password, URL safe base64 encoded.
+func generatePassword() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// writeSecretFile writes a secret to path with mode 0600, failing if it already exists.
+func writeSecretFile(path string, secret string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(secret + "\n"); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// ensureResticPassword makes sure the restic password file exists and is only readable
+// by its owner, generating (and escrowing) a new random password if needed.
+func ensureResticPassword() error {
+	path := resticPasswordPath()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		password, err := generatePassword()
+		if err != nil {
+			return fmt.Errorf("failed to generate restic password: %w", err)
+		}
+		if err := writeSecretFile(path, password); err != nil {
+			return fmt.Errorf("failed to create password file: %w", err)
+		}
+		fmt.Println(NewMessage(chalk.Green, "Generated a new restic password in "+path))
+
+		if err := escrowResticPassword(password); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Failed to escrow restic password: "+err.Error()))
+		}
+		if viper.GetBool("backup.restic.print_password") {
+			fmt.Println(NewMessage(chalk.Yellow, "Restic password (record it now, it won't be shown again):").ThenColor(chalk.White, password))
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		fmt.Println(NewMessage(chalk.Yellow, fmt.Sprintf("Restic password file %s was mode %04o, fixing to 0600", path, info.Mode().Perm())))
+		if err := os.Chmod(path, 0600); err != nil {
+			return err
+		}
+	}
+
+	if password, err := readSecretFile(path); err == nil && password == legacyResticPassword {
+		fmt.Println(NewMessage(chalk.Red, "Restic repository still uses the default shared password, run `qcd backup rotate-key`"))
+	}
+	return nil
+}
+
+// readSecretFile reads a password or token from a file, ignoring surrounding whitespace.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// escrowResticPassword encrypts password to backup.restic.escrow_recipients and writes it
+// to backup.restic.escrow_file. Without recipients nothing is escrowed.
+func escrowResticPassword(password string) error {
+	keys := viper.GetStringSlice("backup.restic.escrow_recipients")
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var recipients []age.Recipient
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return fmt.Errorf("invalid escrow recipient %q: %w", key, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	path := viper.GetString("backup.restic.escrow_file")
+	if path == "" {
+		path = filepath.Join(backupDest(), "restic-password.age")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write([]byte(password + "\n")); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Println(NewMessage(chalk.Green, "Restic password escrowed to "+path))
+	return nil
+}
+
+// resticKey is one entry of `restic key list --json`.
+type resticKey struct {
+	Current bool   `json:"current"`
+	ID      string `json:"id"`
+}
+
+// resticCurrentKey returns the ID of the repository key that passwordFile unlocks.
+func resticCurrentKey(passwordFile string) (string, error) {
+	out, err := resticOutput(passwordFile, "key", "list", "--json")
+	if err != nil {
+		return "", err
+	}
+	var keys []resticKey
+	if err := json.Unmarshal(out, &keys); err != nil {
+		return "", fmt.Errorf("can't parse restic key list: %w", err)
+	}
+	for _, k := range keys {
+		if k.Current {
+			return k.ID, nil
+		}
+	}
+	return "", fmt.Errorf("restic did not report a current key")
+}
+
+// resticOutput runs restic against the configured repository and returns its stdout.
+func resticOutput(passwordFile string, args ...string) ([]byte, error) {
+	full := append([]string{"--repo", resticRepository(), "--password-file", passwordFile}, args...)
+	var stderr bytes.Buffer
+	c := exec.Command("restic", full...)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("restic %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// rotateResticKey swaps the repository password for a freshly generated one. The new key
+// is added, checked and escrowed before the old one is removed, so a failure part way
+// leaves a working, escrowed password file behind.
+func rotateResticKey() error {
+	path := resticPasswordPath()
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no restic password file at %s: %w", path, err)
+	}
+
+	oldKey, err := resticCurrentKey(path)
+	if err != nil {
+		return err
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return err
+	}
+	newPath := path + ".new"
+	os.Remove(newPath)
+	if err := writeSecretFile(newPath, password); err != nil {
+		return err
+	}
+
+	fmt.Println(NewMessage(chalk.Blue, "Adding new restic key..."))
+	if _, err := resticOutput(path, "key", "add", "--new-password-file", newPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	newKey, err := resticCurrentKey(newPath)
+	if err != nil {
+		return fmt.Errorf("new key does not unlock the repository, keeping the old password: %w", err)
+	}
+
+	// A password nobody else has a copy of must never become the only key
+	if err := escrowResticPassword(password); err != nil {
+		fmt.Println(NewMessage(chalk.Red, "Failed to escrow the new restic password, removing the new key "+newKey+" again"))
+		if _, rerr := resticOutput(path, "key", "remove", newKey); rerr != nil {
+			return fmt.Errorf("escrow failed: %w, and the new key %s could not be removed (its password is in %s): %v", err, newKey, newPath, rerr)
+		}
+		os.Remove(newPath)
+		return fmt.Errorf("escrow failed, keeping the old password: %w", err)
+	}
+
+	if err := os.Rename(newPath, path); err != nil {
+		return fmt.Errorf("new key %s was added but the password file could not be replaced (new password is in %s): %w", newKey, newPath, err)
+	}
+
+	fmt.Println(NewMessage(chalk.Blue, "Removing old restic key "+oldKey+"..."))
+	if _, err := resticOutput(path, "key", "remove", oldKey); err != nil {
+		return err
+	}
+
+	fmt.Println(NewMessage(chalk.Green, "Restic key rotated").ThenColor(chalk.White, "(new key "+newKey+")"))
+	if viper.GetBool("backup.restic.print_password") {
+		fmt.Println(NewMessage(chalk.Yellow, "New restic password:").ThenColor(chalk.White, password))
+	}
+	return nil
+}
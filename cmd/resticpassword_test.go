@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// Stands in for restic: a key's ID is the checksum of the password that unlocks it, and
+// every key command is logged to $RESTIC_LOG.
+const fakeRestic = `#!/bin/sh
+while [ "$1" = --repo ] || [ "$1" = --password-file ]; do
+	[ "$1" = --password-file ] && pwfile=$2
+	shift 2
+done
+echo "$*" >> "$RESTIC_LOG"
+id=$(cksum < "$pwfile" | cut -d' ' -f1)
+case "$1 $2" in
+"key list") echo "[{\"current\":true,\"id\":\"$id\"}]" ;;
+esac
+`
+
+func TestRotateResticKeyEscrowsFirst(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		recipient  string
+		wantErr    bool
+		oldRemoved bool
+	}{
+		{name: "escrowed", recipient: identity.Recipient().String(), oldRemoved: true},
+		{name: "escrow fails", recipient: "not-a-recipient", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "restic"), []byte(fakeRestic), 0755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+			log := filepath.Join(dir, "restic.log")
+			t.Setenv("RESTIC_LOG", log)
+
+			passwordFile := filepath.Join(dir, "passwd")
+			escrowFile := filepath.Join(dir, "escrow.age")
+			useConfig(t, map[string]interface{}{
+				"backup.restic.repository":        "local:" + dir,
+				"backup.restic.password_file":     passwordFile,
+				"backup.restic.escrow_recipients": []string{tt.recipient},
+				"backup.restic.escrow_file":       escrowFile,
+			})
+			if err := writeSecretFile(passwordFile, "old-password"); err != nil {
+				t.Fatal(err)
+			}
+			oldKey, err := resticCurrentKey(passwordFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = rotateResticKey()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rotateResticKey error %v, want error %v", err, tt.wantErr)
+			}
+			calls, _ := os.ReadFile(log)
+			removedOld := strings.Contains(string(calls), "key remove "+oldKey)
+			if removedOld != tt.oldRemoved {
+				t.Errorf("old key removed: %v, want %v\n%s", removedOld, tt.oldRemoved, calls)
+			}
+
+			password, err := readSecretFile(passwordFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				if password != "old-password" {
+					t.Errorf("password file changed although escrow failed")
+				}
+				if strings.Count(string(calls), "key remove") != 1 {
+					t.Errorf("expected the unescrowed new key to be removed again:\n%s", calls)
+				}
+				if _, err := os.Stat(passwordFile + ".new"); err == nil {
+					t.Errorf("new password file left behind")
+				}
+				return
+			}
+			if password == "old-password" {
+				t.Errorf("password file was not replaced")
+			}
+			if _, err := os.Stat(escrowFile); err != nil {
+				t.Errorf("password was not escrowed: %v", err)
+			}
+		})
+	}
+}
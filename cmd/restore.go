@@ -0,0 +1,470 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/ttacon/chalk"
+)
+
+// Files larger than this are compared but not diffed
+const maxRestoreDiffSize = 1 << 20
+
+var restoreRoot string
+var restoreYes bool
+var restoreDryRun bool
+var restoreList bool
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore [<archive>|latest] [<path|glob>...]",
+	Short: "Restore files from a backup tarball",
+	Long: `Restores files from the tarballs created by backup. Without arguments the available backups are listed.
+Give an archive (file name, path, or "latest") to restore all of it, optionally followed by paths or globs (e.g. /etc/postfix or "/etc/postfix/*.cf") to restore only part of it.
+A diff against the live file is shown before anything is overwritten, and modes, ownership and mtimes are preserved.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if restoreList || len(args) == 0 {
+			printBackupList(nil)
+			return
+		}
+
+		archive, err := resolveBackup(args[0])
+		if CheckError(err) {
+			return
+		}
+
+		r := &restorer{
+			root:      restoreRoot,
+			patterns:  restorePatterns(args[1:]),
+			assumeYes: restoreYes,
+			dryRun:    restoreDryRun,
+			in:        bufio.NewReader(os.Stdin),
+		}
+
+		fmt.Println(NewMessage(chalk.Blue, "Restoring from "+archive+" into "+restoreRoot+"..."))
+		err = r.restore(archive)
+		summary := fmt.Sprintf("%d restored, %d unchanged, %d skipped, %d failed", r.restored, r.unchanged, r.skipped, r.failed)
+		if err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Restore aborted: "+err.Error()).ThenColor(chalk.White, "("+summary+")"))
+			os.Exit(1)
+		}
+
+		fmt.Println(NewMessage(chalk.Green, "Restore complete: "+summary))
+		if r.matched == 0 && len(r.patterns) > 0 {
+			fmt.Println(NewMessage(chalk.Yellow, "Nothing in the archive matched "+strings.Join(args[1:], ", ")))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringVarP(&restoreRoot, "target", "t", "/", "Directory to restore into")
+	restoreCmd.Flags().BoolVarP(&restoreYes, "yes", "y", false, "Overwrite changed files without asking")
+	restoreCmd.Flags().BoolVarP(&restoreDryRun, "dry-run", "n", false, "Only show what would be restored")
+	restoreCmd.Flags().BoolVarP(&restoreList, "list", "l", false, "List available backups")
+}
+
+// printBackupList prints the backups in backup.dest, oldest first. details, when set,
+// adds to the line of each backup.
+func printBackupList(details func(b backupFile) string) {
+	dest := backupDest()
+	backups, err := listBackups(dest)
+	if CheckError(err) {
+		return
+	}
+	if len(backups) == 0 {
+		fmt.Println(NewMessage(chalk.Yellow, "No backups found in "+dest))
+		return
+	}
+
+	fmt.Println(NewMessage(chalk.Blue, fmt.Sprintf("%d backup(s) in %s:", len(backups), dest)))
+	for _, b := range backups {
+		line := fmt.Sprintf(" - %s  %s  %s", b.Name, b.Time.Format("2006-01-02 15:04:05"), FormatBytes(b.Size))
+		if details != nil {
+			line += "  " + details(b)
+		}
+		fmt.Println(line)
+	}
+}
+
+// restorePatterns normalises user supplied paths to archive entry names.
+func restorePatterns(args []string) []string {
+	var patterns []string
+	for _, arg := range args {
+		p := strings.Trim(filepath.ToSlash(arg), "/")
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// matchesAny reports whether name, or one of its parent directories, matches a pattern.
+// No patterns means everything matches.
+func matchesAny(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for candidate := name; candidate != "." && candidate != "/"; candidate = path.Dir(candidate) {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type restorer struct {
+	root      string
+	patterns  []string
+	assumeYes bool
+	dryRun    bool
+	in        *bufio.Reader
+
+	// Directory metadata is applied last, writing files would bump the mtimes
+	dirs []*tar.Header
+	// The backup captured extended attributes, so live ones it lacks are removed
+	pruneXattrs bool
+
+	matched, restored, unchanged, skipped, failed int
+}
+
+func (r *restorer) restore(archive string) error {
+	m, err := readManifest(archive)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.pruneXattrs = m != nil && m.Xattrs
+
+	err = walkSnapshot(archive, func(hdr *tar.Header, rd io.Reader) error {
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" || !matchesAny(name, r.patterns) {
+			return nil
+		}
+		r.matched++
+
+		dest := filepath.Join(r.root, filepath.FromSlash(name))
+		if err := r.restoreEntry(hdr, rd, dest); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Failed to restore "+dest+": "+err.Error()))
+			r.failed++
+		}
+		return nil
+	})
+
+	if !r.dryRun {
+		for i := len(r.dirs) - 1; i >= 0; i-- {
+			hdr := r.dirs[i]
+			dest := filepath.Join(r.root, filepath.FromSlash(path.Clean("/"+hdr.Name)))
+			// A later entry may have swapped the directory for a symlink
+			if merr := r.checkDir(dest); merr != nil {
+				fmt.Println(NewMessage(chalk.Red, "Not restoring metadata of "+dest+": "+merr.Error()))
+				continue
+			}
+			if merr := applyMetadata(dest, hdr, r.pruneXattrs); merr != nil {
+				fmt.Println(NewMessage(chalk.Yellow, "Could not restore metadata of "+dest+": "+merr.Error()))
+			}
+		}
+	}
+	return err
+}
+
+// checkParents refuses paths whose existing parent directories under the restore root
+// include a symlink. Otherwise a symlink restored from a tampered archive, say etc/x ->
+// /root, would send every later entry below etc/x outside the target.
+func (r *restorer) checkParents(dest string) error {
+	rel, err := filepath.Rel(r.root, dest)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", dest, r.root)
+	}
+	dir := r.root
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// MkdirAll creates the rest as real directories
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink, refusing to restore through it", dir)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// checkDir is checkParents for a directory entry, which must not be a symlink itself.
+func (r *restorer) checkDir(dest string) error {
+	if err := r.checkParents(dest); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dest); err == nil && !info.IsDir() {
+		return fmt.Errorf("%s is a %s, not a directory", dest, info.Mode().Type())
+	}
+	return nil
+}
+
+func (r *restorer) restoreEntry(hdr *tar.Header, rd io.Reader, dest string) error {
+	if hdr.Typeflag == tar.TypeDir {
+		if err := r.checkDir(dest); err != nil {
+			return err
+		}
+	} else if err := r.checkParents(dest); err != nil {
+		return err
+	}
+	if !r.dryRun && hdr.Typeflag != tar.TypeDir {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if r.dryRun {
+			return nil
+		}
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		r.dirs = append(r.dirs, hdr)
+		return nil
+	case tar.TypeReg:
+		return r.restoreFile(hdr, rd, dest)
+	case tar.TypeSymlink:
+		return r.restoreSymlink(hdr, dest)
+	case tar.TypeLink:
+		return r.restoreHardlink(hdr, dest)
+	default:
+		fmt.Println(NewMessage(chalk.Yellow, fmt.Sprintf("Skipping %s: unsupported entry type %q", dest, hdr.Typeflag)))
+		r.skipped++
+		return nil
+	}
+}
+
+func (r *restorer) restoreFile(hdr *tar.Header, rd io.Reader, dest string) error {
+	// Stage next to the destination so the final rename is atomic
+	stageDir := filepath.Dir(dest)
+	if r.dryRun {
+		stageDir = ""
+	}
+	tmp, err := os.CreateTemp(stageDir, ".qcd-restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, rd)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if live, err := os.Lstat(dest); err == nil {
+		if live.Mode().IsRegular() && sameContents(tmp.Name(), dest) {
+			return r.unchangedEntry(hdr, dest)
+		}
+		r.showFileDiff(dest, live, tmp.Name())
+		if !r.confirm("Overwrite " + dest + "?") {
+			r.skipped++
+			return nil
+		}
+	} else if r.dryRun {
+		fmt.Println(NewMessage(chalk.Green, "Would create "+dest))
+	}
+
+	if r.dryRun {
+		r.restored++
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+	r.restored++
+	fmt.Println(NewMessage(chalk.Green, "Restored "+dest))
+	return applyMetadata(dest, hdr, r.pruneXattrs)
+}
+
+func (r *restorer) restoreSymlink(hdr *tar.Header, dest string) error {
+	if live, err := os.Lstat(dest); err == nil {
+		if live.Mode()&os.ModeSymlink != 0 {
+			if target, _ := os.Readlink(dest); target == hdr.Linkname {
+				return r.unchangedEntry(hdr, dest)
+			}
+		}
+		fmt.Printf("--- %s (live)\n+++ %s -> %s (backup)\n", dest, dest, hdr.Linkname)
+		if !r.confirm("Replace " + dest + "?") {
+			r.skipped++
+			return nil
+		}
+		if !r.dryRun {
+			if err := os.Remove(dest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.dryRun {
+		r.restored++
+		return nil
+	}
+	if err := os.Symlink(hdr.Linkname, dest); err != nil {
+		return err
+	}
+	r.restored++
+	fmt.Println(NewMessage(chalk.Green, "Restored "+dest+" -> "+hdr.Linkname))
+	return applyMetadata(dest, hdr, r.pruneXattrs)
+}
+
+func (r *restorer) restoreHardlink(hdr *tar.Header, dest string) error {
+	target := filepath.Join(r.root, filepath.FromSlash(path.Clean("/"+hdr.Linkname)))
+	if err := r.checkParents(target); err != nil {
+		return err
+	}
+	if live, err := os.Lstat(dest); err == nil {
+		if targetInfo, err := os.Lstat(target); err == nil && os.SameFile(live, targetInfo) {
+			r.unchanged++
+			return nil
+		}
+		if !r.confirm("Replace " + dest + " with a hard link to " + target + "?") {
+			r.skipped++
+			return nil
+		}
+		if !r.dryRun {
+			if err := os.Remove(dest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.dryRun {
+		r.restored++
+		return nil
+	}
+	if err := os.Link(target, dest); err != nil {
+		return err
+	}
+	r.restored++
+	fmt.Println(NewMessage(chalk.Green, "Restored "+dest+" (hard link to "+target+")"))
+	return nil
+}
+
+// unchangedEntry handles an entry whose content already matches the live file, only
+// putting its metadata back.
+func (r *restorer) unchangedEntry(hdr *tar.Header, dest string) error {
+	r.unchanged++
+	if r.dryRun {
+		return nil
+	}
+	return applyMetadata(dest, hdr, r.pruneXattrs)
+}
+
+func (r *restorer) showFileDiff(dest string, live os.FileInfo, staged string) {
+	if !live.Mode().IsRegular() {
+		fmt.Println(NewMessage(chalk.Yellow, dest+" is currently a "+live.Mode().Type().String()+", backup has a regular file"))
+		return
+	}
+
+	stagedInfo, err := os.Stat(staged)
+	if err != nil || live.Size() > maxRestoreDiffSize || stagedInfo.Size() > maxRestoreDiffSize {
+		fmt.Println(NewMessage(chalk.Yellow, dest+" differs from the backup (too large to diff)"))
+		return
+	}
+
+	liveData, err1 := os.ReadFile(dest)
+	backupData, err2 := os.ReadFile(staged)
+	if err1 != nil || err2 != nil || !isText(liveData) || !isText(backupData) {
+		fmt.Println(NewMessage(chalk.Yellow, dest+" differs from the backup (binary)"))
+		return
+	}
+	fmt.Print(unifiedDiff(dest+" (live)", dest+" (backup)", liveData, backupData))
+}
+
+func (r *restorer) confirm(question string) bool {
+	if r.dryRun {
+		fmt.Println(NewMessage(chalk.Yellow, "Would ask: "+question))
+		return true
+	}
+	if r.assumeYes {
+		return true
+	}
+
+	fmt.Print(NewMessage(chalk.Yellow, question+" [y/N/a(ll)] ").String())
+	answer, _ := r.in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "a", "all":
+		r.assumeYes = true
+		return true
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// applyMetadata restores ownership, mode, extended attributes and mtime from hdr onto
+// path. Ownership is only restored when running as root. Extended attributes go on after
+// chown, which would otherwise drop file capabilities; with pruneXattrs any that hdr
+// doesn't have are removed.
+func applyMetadata(path string, hdr *tar.Header, pruneXattrs bool) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+			return err
+		}
+	}
+	if err := writeXattrs(path, headerXattrs(hdr), pruneXattrs); err != nil {
+		if !errors.Is(err, errXattrUnsupported) {
+			return err
+		}
+		fmt.Println(NewMessage(chalk.Yellow, "Could not restore extended attributes of "+path+": "+err.Error()))
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
+
+func sameContents(a, b string) bool {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false
+		}
+		if errA != nil || errB != nil {
+			return (errA == io.EOF || errA == io.ErrUnexpectedEOF) && errA == errB
+		}
+	}
+}
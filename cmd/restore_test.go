@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	Name     string
+	Type     byte
+	Linkname string
+	Body     string
+}
+
+// writeTestArchive writes a gzipped tarball with entries to path.
+func writeTestArchive(t *testing.T, path string, entries []testEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.Name,
+			Typeflag: e.Type,
+			Linkname: e.Linkname,
+			Mode:     0644,
+			Size:     int64(len(e.Body)),
+			ModTime:  time.Unix(1700000000, 0),
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		}
+		if e.Type == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.Type != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreRefusesSymlinkedParents(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		entries []testEntry
+	}{
+		{"file below symlink", []testEntry{
+			{Name: "etc/", Type: tar.TypeDir},
+			{Name: "etc/x", Type: tar.TypeSymlink, Linkname: outside},
+			{Name: "etc/x/evil", Type: tar.TypeReg, Body: "owned"},
+		}},
+		{"directory below symlink", []testEntry{
+			{Name: "etc/x", Type: tar.TypeSymlink, Linkname: outside},
+			{Name: "etc/x/evil/", Type: tar.TypeDir},
+		}},
+		{"directory replaced by symlink", []testEntry{
+			{Name: "etc/x", Type: tar.TypeSymlink, Linkname: outside},
+			{Name: "etc/x/", Type: tar.TypeDir},
+		}},
+		{"hard link through symlink", []testEntry{
+			{Name: "etc/x", Type: tar.TypeSymlink, Linkname: outside},
+			{Name: "etc/evil", Type: tar.TypeLink, Linkname: "etc/x/secret"},
+		}},
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(root, strings.ReplaceAll(tt.name, " ", "-"))
+			archive := filepath.Join(dir, "test"+string(rune('a'+i))+".tar.gz")
+			writeTestArchive(t, archive, tt.entries)
+
+			r := &restorer{root: target, assumeYes: true, in: bufio.NewReader(strings.NewReader(""))}
+			if err := r.restore(archive); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			if r.failed == 0 {
+				t.Errorf("expected the entry through the symlink to fail")
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "evil")); err == nil {
+				t.Errorf("evil was created outside the target")
+			}
+			if _, err := os.Lstat(filepath.Join(target, "etc", "evil")); err == nil {
+				t.Errorf("hard link to a file outside the target was created")
+			}
+			after, err := os.Stat(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+				t.Errorf("metadata of the directory outside the target changed")
+			}
+		})
+	}
+}
+
+func TestRestoreCreatesNestedEntries(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "nested.tar.gz")
+	writeTestArchive(t, archive, []testEntry{
+		{Name: "etc/", Type: tar.TypeDir},
+		{Name: "etc/app/conf", Type: tar.TypeReg, Body: "a=1\n"},
+		{Name: "etc/app/link", Type: tar.TypeSymlink, Linkname: "conf"},
+	})
+
+	root := filepath.Join(dir, "root")
+	r := &restorer{root: root, assumeYes: true, in: bufio.NewReader(strings.NewReader(""))}
+	if err := r.restore(archive); err != nil {
+		t.Fatal(err)
+	}
+	if r.failed != 0 || r.restored != 2 {
+		t.Fatalf("restored %d, failed %d, want 2 and 0", r.restored, r.failed)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "etc", "app", "link"))
+	if err != nil || string(data) != "a=1\n" {
+		t.Fatalf("read through restored link: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+var pruneDryRun bool
+
+var backupPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove old backups according to backup.retention",
+	Long: `Applies the backup.retention policy to backup.dest. The same policy is enforced automatically after every backup.
+  keep_last   keep the N most recent backups
+  keep_hourly keep the newest backup of each of the last N hours that have one
+  max_size    remove the oldest backups until the total size is under this limit (e.g. "2GB")
+The most recent backup is never removed, and backups that a kept incremental backup depends on are kept with it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if policy, err := loadRetentionPolicy(); err == nil && policy.empty() {
+			fmt.Println(NewMessage(chalk.Yellow, "No backup.retention policy configured, keeping all backups"))
+			return
+		}
+		if err := pruneBackups(pruneDryRun); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Prune failed: "+err.Error()))
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupPruneCmd)
+	backupPruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "n", false, "Only list the backups that would be removed")
+}
+
+type retentionPolicy struct {
+	KeepLast   int
+	KeepHourly int
+	MaxSize    int64
+}
+
+func (p retentionPolicy) empty() bool {
+	return p.KeepLast <= 0 && p.KeepHourly <= 0 && p.MaxSize <= 0
+}
+
+type pruneCandidate struct {
+	Backup backupFile
+	Reason string
+}
+
+func loadRetentionPolicy() (retentionPolicy, error) {
+	policy := retentionPolicy{
+		KeepLast:   viper.GetInt("backup.retention.keep_last"),
+		KeepHourly: viper.GetInt("backup.retention.keep_hourly"),
+	}
+	if raw := viper.GetString("backup.retention.max_size"); raw != "" {
+		size, err := parseSize(raw)
+		if err != nil {
+			return policy, fmt.Errorf("invalid backup.retention.max_size: %w", err)
+		}
+		policy.MaxSize = size
+	}
+	return policy, nil
+}
+
+// planPrune decides which of backups (oldest first) fall outside the policy.
+func planPrune(backups []backupFile, policy retentionPolicy) []pruneCandidate {
+	if policy.empty() || len(backups) == 0 {
+		return nil
+	}
+
+	keep := make([]bool, len(backups))
+	if policy.KeepLast <= 0 && policy.KeepHourly <= 0 {
+		// Size limit only
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+	for i := max(0, len(backups)-policy.KeepLast); i < len(backups) && policy.KeepLast > 0; i++ {
+		keep[i] = true
+	}
+	hours := make(map[string]bool)
+	for i := len(backups) - 1; i >= 0 && len(hours) < policy.KeepHourly; i-- {
+		hour := backups[i].Time.Format("2006010215")
+		if !hours[hour] {
+			hours[hour] = true
+			keep[i] = true
+		}
+	}
+	keep[len(backups)-1] = true
+
+	// Incremental backups can't be restored without the rest of their chain
+	for i := len(backups) - 1; i >= 0; i-- {
+		if keep[i] {
+			for _, j := range backupChain(backups, i) {
+				keep[j] = true
+			}
+		}
+	}
+
+	var candidates []pruneCandidate
+	var total int64
+	for i, b := range backups {
+		if keep[i] {
+			total += b.Size
+		} else {
+			candidates = append(candidates, pruneCandidate{Backup: b, Reason: "outside keep_last/keep_hourly"})
+		}
+	}
+
+	// Over the size limit whole chains go, oldest first, never the latest one
+	latestChain := backupChain(backups, len(backups)-1)[0]
+	for i := 0; i < latestChain && policy.MaxSize > 0 && total > policy.MaxSize; {
+		end := i + 1
+		for end < latestChain && backups[end].Incremental {
+			end++
+		}
+		for j := i; j < end; j++ {
+			if keep[j] {
+				keep[j] = false
+				total -= backups[j].Size
+				candidates = append(candidates, pruneCandidate{Backup: backups[j], Reason: "over max_size " + FormatBytes(policy.MaxSize)})
+			}
+		}
+		i = end
+	}
+	return candidates
+}
+
+// pruneBackups enforces backup.retention on backup.dest. Without a policy nothing is
+// removed.
+func pruneBackups(dryRun bool) error {
+	policy, err := loadRetentionPolicy()
+	if err != nil || policy.empty() {
+		return err
+	}
+
+	backups, err := listBackups(backupDest())
+	if err != nil {
+		return err
+	}
+
+	candidates := planPrune(backups, policy)
+	if len(candidates) == 0 {
+		fmt.Println(NewMessage(chalk.Green, fmt.Sprintf("Retention: all %d backup(s) kept", len(backups))))
+		return nil
+	}
+
+	var freed int64
+	for _, c := range candidates {
+		if dryRun {
+			fmt.Println(NewMessage(chalk.Yellow, "Would remove "+c.Backup.Name).ThenColor(chalk.White, "("+c.Reason+")"))
+			freed += c.Backup.Size
+			continue
+		}
+		if err := removeBackup(c.Backup); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Failed to remove "+c.Backup.Name+": "+err.Error()))
+			continue
+		}
+		fmt.Println(NewMessage(chalk.Yellow, "Removed "+c.Backup.Name).ThenColor(chalk.White, "("+c.Reason+")"))
+		freed += c.Backup.Size
+	}
+
+	verb := "Freed"
+	if dryRun {
+		verb = "Would free"
+	}
+	fmt.Println(NewMessage(chalk.Green, fmt.Sprintf("%s %s across %d backup(s)", verb, FormatBytes(freed), len(candidates))))
+	return nil
+}
+
+// removeBackup deletes an archive together with its manifest.
+func removeBackup(b backupFile) error {
+	for _, f := range []string{b.Path, manifestPath(b.Path)} {
+		if err := unprotectBackup(f); err != nil {
+			return fmt.Errorf("clearing immutable attribute of %s: %w", f, err)
+		}
+	}
+	if err := os.Remove(b.Path); err != nil {
+		return err
+	}
+	if err := os.Remove(manifestPath(b.Path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// parseSize parses sizes like "500MB", "2G" or "1048576" (binary units).
+func parseSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := int64(1)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("can't parse size %q", raw)
+	}
+	return int64(n * float64(multiplier)), nil
+}
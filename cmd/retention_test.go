@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// testBackups builds a backup list, oldest first, from kinds ('F' full, 'I' incremental)
+// taken 30 minutes apart, each size bytes.
+func testBackups(kinds string, size int64) []backupFile {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.Local)
+	backups := make([]backupFile, len(kinds))
+	for i, k := range kinds {
+		t := start.Add(time.Duration(i) * 30 * time.Minute)
+		prefix := fullBackupPrefix
+		if k == 'I' {
+			prefix = incrementalBackupPrefix
+		}
+		name := prefix + t.Format(backupTimeLayout) + ".tar.gz"
+		backups[i] = backupFile{Name: name, Path: "/backups/" + name, Time: t, Size: size, Incremental: k == 'I'}
+	}
+	return backups
+}
+
+func TestPlanPrune(t *testing.T) {
+	tests := []struct {
+		name    string
+		kinds   string
+		policy  retentionPolicy
+		removed []int
+	}{
+		{name: "no policy", kinds: "FFF", removed: nil},
+		{name: "keep last", kinds: "FFFFF", policy: retentionPolicy{KeepLast: 2}, removed: []int{0, 1, 2}},
+		{name: "keep last more than exist", kinds: "FF", policy: retentionPolicy{KeepLast: 5}, removed: nil},
+		{name: "latest always kept", kinds: "FFF", policy: retentionPolicy{MaxSize: 1}, removed: []int{0, 1}},
+		// Two backups per hour, the newest of each of the last two hours survives
+		{name: "keep hourly", kinds: "FFFFFF", policy: retentionPolicy{KeepHourly: 2}, removed: []int{0, 1, 2, 4}},
+		{name: "keep last and hourly", kinds: "FFFFFF", policy: retentionPolicy{KeepLast: 1, KeepHourly: 3}, removed: []int{0, 2, 4}},
+		{name: "chain of kept incremental", kinds: "FIIFI", policy: retentionPolicy{KeepLast: 1}, removed: []int{0, 1, 2}},
+		{name: "whole chain kept", kinds: "FIII", policy: retentionPolicy{KeepLast: 1}, removed: nil},
+		{name: "size removes whole chains", kinds: "FIFIF", policy: retentionPolicy{MaxSize: 250}, removed: []int{0, 1, 2, 3}},
+		{name: "size under limit", kinds: "FIFIF", policy: retentionPolicy{MaxSize: 1000}, removed: nil},
+		{name: "size stops once under", kinds: "FIFIF", policy: retentionPolicy{MaxSize: 300}, removed: []int{0, 1}},
+		{name: "size on top of keep last", kinds: "FFFF", policy: retentionPolicy{KeepLast: 3, MaxSize: 150}, removed: []int{0, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backups := testBackups(tt.kinds, 100)
+			var removed []int
+			for _, c := range planPrune(backups, tt.policy) {
+				removed = append(removed, slices.IndexFunc(backups, func(b backupFile) bool { return b.Name == c.Backup.Name }))
+			}
+			slices.Sort(removed)
+			if !slices.Equal(removed, tt.removed) {
+				t.Errorf("removed %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "1048576", want: 1 << 20},
+		{in: "500MB", want: 500 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "2GiB", want: 2 << 30},
+		{in: "1.5k", want: 1536},
+		{in: " 3 TB ", want: 3 << 40},
+		{in: "10B", want: 10},
+		{in: "", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "-5G", wantErr: true},
+		{in: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
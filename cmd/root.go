@@ -52,8 +52,77 @@ func initConfig() {
 		viper.SetConfigType("toml")
 
 		// Set Defaults
+		viper.SetDefault("state_dir", "/var/lib/qcd")
 		viper.SetDefault("backup.targets", []string{"/etc/dovecot", "/etc/postfix", "/var/www", "/opt/splunk"})
 		viper.SetDefault("backup.dest", "./backups")
+		viper.SetDefault("backup.hide", false)
+		viper.SetDefault("backup.hide_root", "/var/lib")
+		viper.SetDefault("backup.immutable", false)
+		viper.SetDefault("backup.excludes", []string{})
+		viper.SetDefault("backup.encryption.mode", "none")
+		viper.SetDefault("backup.encryption.recipients", []string{})
+		viper.SetDefault("backup.encryption.passphrase_file", "")
+		viper.SetDefault("backup.encryption.identity_file", "")
+		viper.SetDefault("backup.manifest_key_file", "")
+		viper.SetDefault("backup.xattrs", true)
+		viper.SetDefault("backup.incremental", false)
+		viper.SetDefault("backup.full_every", 24)
+		viper.SetDefault("backup.retention.keep_last", 0)
+		viper.SetDefault("backup.retention.keep_hourly", 0)
+		viper.SetDefault("backup.retention.max_size", "")
+		viper.SetDefault("backup.receive.dir", "")
+		viper.SetDefault("backup.receive.token_file", "")
+		viper.SetDefault("backup.receive.max_size", "")
+		viper.SetDefault("backup.receive.allow_insecure", false)
+		viper.SetDefault("backup.hooks.dir", "/var/lib/qcd/hooks")
+		viper.SetDefault("backup.restic.version", "0.16.4")
+		viper.SetDefault("backup.restic.url", "https://github.com/restic/restic/releases/download/v{{.Version}}/restic_{{.Version}}_{{.OS}}_{{.Arch}}.bz2")
+		viper.SetDefault("backup.restic.resticprofile_version", "0.26.0")
+		viper.SetDefault("backup.restic.resticprofile_url", "https://github.com/creativeprojects/resticprofile/releases/download/v{{.Version}}/resticprofile_{{.Version}}_{{.OS}}_{{.Arch}}.tar.gz")
+		viper.SetDefault("backup.restic.checksums", []string{})
+		viper.SetDefault("backup.restic.allow_unpinned", false)
+		viper.SetDefault("backup.restic.bundle", "")
+		viper.SetDefault("backup.restic.bin_dir", "/usr/local/bin")
+		viper.SetDefault("backup.restic.config", "profiles.yaml")
+		viper.SetDefault("backup.restic.repository", "")
+		viper.SetDefault("backup.restic.password_file", "")
+		viper.SetDefault("backup.restic.print_password", false)
+		viper.SetDefault("backup.restic.escrow_recipients", []string{})
+		viper.SetDefault("backup.restic.escrow_file", "")
+		viper.SetDefault("backup.restic.sources", []string{})
+		viper.SetDefault("backup.restic.excludes", []string{})
+		viper.SetDefault("backup.restic.schedule", "*:0/15")
+		viper.SetDefault("backup.restic.retention.keep_last", 5)
+		viper.SetDefault("backup.restic.retention.keep_hourly", 0)
+		viper.SetDefault("backup.restic.retention.keep_daily", 0)
+		viper.SetDefault("baseline.file", "")
+		viper.SetDefault("baseline.suid_roots", []string{"/"})
+		viper.SetDefault("firewall.backend", "auto")
+		viper.SetDefault("firewall.tcp_ports", []string{})
+		viper.SetDefault("firewall.udp_ports", []string{})
+		viper.SetDefault("firewall.sources", []string{})
+		viper.SetDefault("firewall.scoring_cidrs", []string{})
+		viper.SetDefault("firewall.management_ports", []string{"22"})
+		viper.SetDefault("firewall.management_cidrs", []string{})
+		viper.SetDefault("firewall.icmp", "accept")
+		viper.SetDefault("firewall.log", false)
+		viper.SetDefault("firewall.log_prefix", "qcd-drop: ")
+		viper.SetDefault("firewall.log_rate", "10/minute")
+		viper.SetDefault("firewall.confirm_timeout", 120)
+		viper.SetDefault("firewall.nftbuild.url", "https://github.com/UWStout-CCDC/CCDC-scripts/raw/refs/heads/master/firewall/host_firewall/nftbuild")
+		viper.SetDefault("firewall.nftbuild.sha256", "")
+		viper.SetDefault("firewall.nftbuild.path", "")
+		viper.SetDefault("firewall.egress.enabled", false)
+		viper.SetDefault("firewall.egress.resolvers", []string{})
+		viper.SetDefault("firewall.egress.ntp", []string{})
+		viper.SetDefault("firewall.egress.mirrors", []string{})
+		viper.SetDefault("firewall.egress.splunk_indexers", []string{})
+		viper.SetDefault("firewall.egress.splunk_ports", []string{"9997"})
+		viper.SetDefault("firewall.egress.tcp_ports", []string{})
+		viper.SetDefault("firewall.egress.udp_ports", []string{})
+		viper.SetDefault("firewall.egress.deny_users", []string{})
+		viper.SetDefault("firewall.egress.log", true)
+		viper.SetDefault("firewall.egress.log_prefix", "qcd-egress-drop: ")
 		viper.SetDefault("harden.shell_whitelist", []string{"root", "sysadmin", "splunkuser"})
 		viper.SetDefault("persistence.ignore_users", []string{"root", "sysadmin", "splunkuser"})
 
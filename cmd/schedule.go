@@ -0,0 +1,448 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Names of the files `backup schedule` installs
+const (
+	backupUnitName   = "qcd-backup"
+	systemdUnitDir   = "/etc/systemd/system"
+	backupCronFile   = "/etc/cron.d/qcd-backup"
+	scheduleFileName = "backup-schedule.json"
+	statusFileName   = "backup-status.json"
+)
+
+var scheduleEvery time.Duration
+var scheduleIncremental bool
+var scheduleCron bool
+
+var backupScheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Run the tarball backup periodically",
+	Long: `Installs a systemd service and timer (or, without systemd, an /etc/cron.d entry) that runs qcd backup with the current config file and --sys.
+The interval has to divide an hour or a day evenly (e.g. 5m, 15m, 1h, 6h, 24h) so runs line up with the clock. Scheduling again replaces the previous schedule.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := installBackupSchedule(); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Failed to schedule backups: "+err.Error()))
+			os.Exit(1)
+		}
+	},
+}
+
+var backupUnscheduleCmd = &cobra.Command{
+	Use:   "unschedule",
+	Short: "Remove the periodic backup schedule",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := removeBackupSchedule(); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "Failed to remove backup schedule: "+err.Error()))
+			os.Exit(1)
+		}
+	},
+}
+
+var backupStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the backup schedule and the result of the last run",
+	Run: func(cmd *cobra.Command, args []string) {
+		printBackupStatus()
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupScheduleCmd)
+	backupCmd.AddCommand(backupUnscheduleCmd)
+	backupCmd.AddCommand(backupStatusCmd)
+	backupScheduleCmd.Flags().DurationVarP(&scheduleEvery, "every", "e", 15*time.Minute, "How often to back up")
+	backupScheduleCmd.Flags().BoolVarP(&scheduleIncremental, "incremental", "i", false, "Take incremental backups")
+	backupScheduleCmd.Flags().BoolVar(&scheduleCron, "cron", false, "Use cron even if systemd is available")
+}
+
+// backupSchedule records what `backup schedule` installed.
+type backupSchedule struct {
+	Kind      string    `json:"kind"`
+	Every     string    `json:"every"`
+	Command   []string  `json:"command"`
+	Dir       string    `json:"dir"`
+	Installed time.Time `json:"installed"`
+}
+
+// backupRunStatus records the outcome of the last backup run.
+type backupRunStatus struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Status   string    `json:"status"`
+	Archive  string    `json:"archive,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// qcdStateDir is where qcd keeps state that isn't configuration.
+func qcdStateDir() string {
+	if dir := viper.GetString("state_dir"); dir != "" {
+		return dir
+	}
+	return "/var/lib/qcd"
+}
+
+// scheduleCalendar converts an interval into a systemd OnCalendar expression and the
+// equivalent cron schedule.
+func scheduleCalendar(every time.Duration) (string, string, error) {
+	if every <= 0 || every%time.Minute != 0 {
+		return "", "", fmt.Errorf("interval %s must be a whole number of minutes", every)
+	}
+	minutes := int(every / time.Minute)
+	switch {
+	case minutes < 60 && 60%minutes == 0:
+		return fmt.Sprintf("*:0/%d", minutes), fmt.Sprintf("*/%d * * * *", minutes), nil
+	case minutes%60 == 0 && minutes < 24*60 && (24*60)%minutes == 0:
+		hours := minutes / 60
+		return fmt.Sprintf("0/%d:00", hours), fmt.Sprintf("0 */%d * * *", hours), nil
+	case minutes == 24*60:
+		return "*-*-* 00:00:00", "0 0 * * *", nil
+	}
+	return "", "", fmt.Errorf("interval %s doesn't divide an hour or a day evenly", every)
+}
+
+// nextScheduledRun returns the next clock aligned run of a schedule after t.
+func nextScheduledRun(every time.Duration, t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	steps := t.Sub(midnight)/every + 1
+	return midnight.Add(steps * every)
+}
+
+func hasSystemd() bool {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("systemctl")
+	return err == nil
+}
+
+// scheduledCommand is the qcd invocation the timer runs, pinned to the current
+// executable, config file and system type.
+func scheduledCommand() ([]string, error) {
+	command, err := selfCommand()
+	if err != nil {
+		return nil, err
+	}
+	if systemType != "" {
+		command = append(command, "--sys", systemType)
+	}
+	command = append(command, "backup")
+	if scheduleIncremental {
+		command = append(command, "--incremental")
+	}
+	return command, nil
+}
+
+// selfCommand is the start of a qcd invocation that runs this executable with the
+// current config file, for commands run later or in the background.
+func selfCommand() ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return nil, err
+	}
+
+	command := []string{exe}
+	if cfg := viper.ConfigFileUsed(); cfg != "" {
+		abs, err := filepath.Abs(cfg)
+		if err != nil {
+			return nil, err
+		}
+		command = append(command, "--config", abs)
+	}
+	return command, nil
+}
+
+func installBackupSchedule() error {
+	calendar, cronSpec, err := scheduleCalendar(scheduleEvery)
+	if err != nil {
+		return err
+	}
+	command, err := scheduledCommand()
+	if err != nil {
+		return err
+	}
+	// Scheduled runs start in / under both systemd and cron, so they run from the directory
+	// the schedule was installed in to keep a relative backup.dest pointing at the same place
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dest, err := filepath.Abs(backupDest())
+	if err != nil {
+		return err
+	}
+
+	// Don't leave the old kind of schedule running next to the new one
+	if err := removeBackupSchedule(); err != nil {
+		return err
+	}
+
+	schedule := backupSchedule{Every: scheduleEvery.String(), Command: command, Dir: dir, Installed: time.Now()}
+	if hasSystemd() && !scheduleCron {
+		schedule.Kind = "systemd"
+		err = installSystemdSchedule(calendar, command, dir)
+	} else {
+		schedule.Kind = "cron"
+		err = installCronSchedule(cronSpec, command, dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := writeStateJSON(scheduleFileName, schedule); err != nil {
+		return err
+	}
+	fmt.Println(NewMessage(chalk.Green, "Backups scheduled every "+schedule.Every+" via "+schedule.Kind).
+		ThenColor(chalk.White, "(next run "+nextScheduledRun(scheduleEvery, time.Now()).Format(time.DateTime)+")"))
+	fmt.Println(NewMessage(chalk.Blue, "Backups will be written to").ThenColor(chalk.White, dest))
+	return nil
+}
+
+// systemdBackupService renders the oneshot unit that runs command from dir.
+func systemdBackupService(command []string, dir string) string {
+	return fmt.Sprintf(`# Installed by qcd backup schedule
+[Unit]
+Description=qcd native backup
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+WorkingDirectory=%s
+ExecStart=%s
+Nice=10
+IOSchedulingClass=idle
+`, strings.ReplaceAll(dir, "%", "%%"), systemdJoin(command))
+}
+
+// cronBackupLine renders the /etc/cron.d entry that runs command from dir.
+func cronBackupLine(spec string, command []string, dir string) string {
+	// cron turns % into newlines
+	return fmt.Sprintf("%s root cd %s && %s >> /var/log/qcd-backup.log 2>&1\n",
+		spec, strings.ReplaceAll(shellJoin([]string{dir}), "%", `\%`), strings.ReplaceAll(shellJoin(command), "%", `\%`))
+}
+
+func installSystemdSchedule(calendar string, command []string, dir string) error {
+	service := systemdBackupService(command, dir)
+
+	timer := fmt.Sprintf(`# Installed by qcd backup schedule
+[Unit]
+Description=Run qcd native backup on a schedule
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+AccuracySec=30s
+
+[Install]
+WantedBy=timers.target
+`, calendar)
+
+	if err := os.WriteFile(filepath.Join(systemdUnitDir, backupUnitName+".service"), []byte(service), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(systemdUnitDir, backupUnitName+".timer"), []byte(timer), 0644); err != nil {
+		return err
+	}
+	if err := RunCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return RunCommand("systemctl", "enable", "--now", backupUnitName+".timer")
+}
+
+func installCronSchedule(spec string, command []string, dir string) error {
+	if _, err := os.Stat(filepath.Dir(backupCronFile)); err != nil {
+		return fmt.Errorf("no systemd and no %s, can't schedule backups", filepath.Dir(backupCronFile))
+	}
+	content := "# Installed by qcd backup schedule\nSHELL=/bin/sh\nPATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n" + cronBackupLine(spec, command, dir)
+	return os.WriteFile(backupCronFile, []byte(content), 0644)
+}
+
+func removeBackupSchedule() error {
+	removed := false
+	for _, unit := range []string{backupUnitName + ".timer", backupUnitName + ".service"} {
+		path := filepath.Join(systemdUnitDir, unit)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if strings.HasSuffix(unit, ".timer") && hasSystemd() {
+			RunCommand("systemctl", "disable", "--now", unit)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if removed && hasSystemd() {
+		RunCommand("systemctl", "daemon-reload")
+	}
+
+	if err := os.Remove(backupCronFile); err == nil {
+		removed = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(qcdStateDir(), scheduleFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if removed {
+		fmt.Println(NewMessage(chalk.Yellow, "Removed existing backup schedule"))
+	}
+	return nil
+}
+
+func printBackupStatus() {
+	var schedule backupSchedule
+	if err := readStateJSON(scheduleFileName, &schedule); err != nil {
+		fmt.Println(NewMessage(chalk.Yellow, "Schedule:").ThenColor(chalk.White, "none"))
+	} else {
+		fmt.Println(NewMessage(chalk.Blue, "Schedule:").ThenColor(chalk.White, "every "+schedule.Every+" via "+schedule.Kind))
+		fmt.Println(NewMessage(chalk.Blue, "Command:").ThenColor(chalk.White, shellJoin(schedule.Command)))
+		if schedule.Dir != "" {
+			fmt.Println(NewMessage(chalk.Blue, "Runs in:").ThenColor(chalk.White, schedule.Dir))
+		}
+		if next := nextBackupRun(schedule); !next.IsZero() {
+			fmt.Println(NewMessage(chalk.Blue, "Next run:").ThenColor(chalk.White, next.Format(time.DateTime)))
+		}
+	}
+
+	var last backupRunStatus
+	if err := readStateJSON(statusFileName, &last); err != nil {
+		fmt.Println(NewMessage(chalk.Yellow, "Last run:").ThenColor(chalk.White, "never"))
+		return
+	}
+
+	color := chalk.Green
+	if last.Status != "success" {
+		color = chalk.Red
+	}
+	when := last.Started.Local().Format(time.DateTime)
+	if last.Finished.IsZero() {
+		// Either still going or it died without recording a result
+		fmt.Println(NewMessage(chalk.Yellow, "Last run:").ThenColor(chalk.White, when+", did not finish"))
+		return
+	}
+	fmt.Println(NewMessage(chalk.Blue, "Last run:").ThenColor(chalk.White, when+" ("+last.Finished.Sub(last.Started).Round(time.Second).String()+")"))
+	fmt.Println(NewMessage(color, "Last result:").ThenColor(chalk.White, last.Status))
+	if last.Archive != "" {
+		fmt.Println(NewMessage(chalk.Blue, "Last archive:").ThenColor(chalk.White, last.Archive))
+	}
+	if last.Error != "" {
+		fmt.Println(NewMessage(chalk.Red, "Last error:").ThenColor(chalk.White, last.Error))
+	}
+}
+
+// nextBackupRun asks systemd when the timer fires next, or works it out from the interval.
+func nextBackupRun(schedule backupSchedule) time.Time {
+	if schedule.Kind == "systemd" {
+		out, err := exec.Command("systemctl", "show", backupUnitName+".timer", "--property=NextElapseUSecRealtime", "--value", "--timestamp=unix").Output()
+		if err == nil {
+			var secs int64
+			if _, err := fmt.Sscanf(strings.TrimSpace(string(out)), "@%d", &secs); err == nil {
+				return time.Unix(secs, 0)
+			}
+		}
+	}
+	every, err := time.ParseDuration(schedule.Every)
+	if err != nil {
+		return time.Time{}
+	}
+	return nextScheduledRun(every, time.Now())
+}
+
+// lockBackup takes the backup lock so scheduled and manual runs don't overlap. The lock
+// is held until the returned file is closed or the process exits.
+func lockBackup() (*os.File, error) {
+	dir := qcdStateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "backup.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("another backup is already running")
+	}
+	return f, nil
+}
+
+// recordBackupRun saves the outcome of a backup run for `backup status`.
+func recordBackupRun(run backupRunStatus) {
+	if err := writeStateJSON(statusFileName, run); err != nil {
+		fmt.Println(NewMessage(chalk.Yellow, "Could not record backup status: "+err.Error()))
+	}
+}
+
+func writeStateJSON(name string, v interface{}) error {
+	return writeJSONFile(filepath.Join(qcdStateDir(), name), v)
+}
+
+// writeJSONFile atomically replaces path with v as indented JSON, readable only by root.
+func writeJSONFile(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readStateJSON(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(qcdStateDir(), name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// systemdJoin quotes args for a systemd ExecStart line.
+func systemdJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.ReplaceAll(arg, "%", "%%")
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$;") {
+			quoted[i] = arg
+		} else {
+			quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$").Replace(arg) + `"`
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellJoin quotes args for a shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]#~%") {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleCalendar(t *testing.T) {
+	tests := []struct {
+		every    time.Duration
+		calendar string
+		cron     string
+		wantErr  bool
+	}{
+		{15 * time.Minute, "*:0/15", "*/15 * * * *", false},
+		{time.Minute, "*:0/1", "*/1 * * * *", false},
+		{time.Hour, "0/1:00", "0 */1 * * *", false},
+		{6 * time.Hour, "0/6:00", "0 */6 * * *", false},
+		{24 * time.Hour, "*-*-* 00:00:00", "0 0 * * *", false},
+		{7 * time.Minute, "", "", true},
+		{90 * time.Minute, "", "", true},
+		{5 * time.Hour, "", "", true},
+		{48 * time.Hour, "", "", true},
+		{30 * time.Second, "", "", true},
+		{0, "", "", true},
+	}
+	for _, tt := range tests {
+		calendar, cron, err := scheduleCalendar(tt.every)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("scheduleCalendar(%s) error = %v, want error %v", tt.every, err, tt.wantErr)
+			continue
+		}
+		if calendar != tt.calendar || cron != tt.cron {
+			t.Errorf("scheduleCalendar(%s) = %q, %q, want %q, %q", tt.every, calendar, cron, tt.calendar, tt.cron)
+		}
+	}
+}
+
+func TestNextScheduledRun(t *testing.T) {
+	at := func(clock string) time.Time {
+		ts, err := time.ParseInLocation(time.DateTime, "2024-03-01 "+clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	tests := []struct {
+		every time.Duration
+		now   string
+		want  time.Time
+	}{
+		{15 * time.Minute, "09:07:00", at("09:15:00")},
+		{15 * time.Minute, "09:15:00", at("09:30:00")},
+		{6 * time.Hour, "13:00:00", at("18:00:00")},
+		{24 * time.Hour, "13:00:00", at("00:00:00").AddDate(0, 0, 1)},
+	}
+	for _, tt := range tests {
+		if got := nextScheduledRun(tt.every, at(tt.now)); !got.Equal(tt.want) {
+			t.Errorf("nextScheduledRun(%s, %s) = %s, want %s", tt.every, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestScheduledRunsFromInstallDir(t *testing.T) {
+	command := []string{"/usr/local/bin/qcd", "--sys", "web", "backup"}
+	dir := "/srv/qcd 50%"
+
+	service := systemdBackupService(command, dir)
+	if !strings.Contains(service, "\nWorkingDirectory=/srv/qcd 50%%\n") {
+		t.Errorf("service doesn't run from %s:\n%s", dir, service)
+	}
+	line := cronBackupLine("*/15 * * * *", command, dir)
+	if !strings.HasPrefix(line, `*/15 * * * * root cd '/srv/qcd 50\%' && /usr/local/bin/qcd --sys web backup `) {
+		t.Errorf("cron line doesn't run from %s: %s", dir, line)
+	}
+}
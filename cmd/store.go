@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/ttacon/chalk"
+)
+
+// Where backups go unless backup.dest says otherwise
+const defaultBackupDest = "./backups"
+
+var errImmutableUnsupported = errors.New("immutable attribute not supported")
+
+// backupDest returns the directory backups are stored in.
+func backupDest() string {
+	if dest := viper.GetString("backup.dest"); dest != "" {
+		return dest
+	}
+	return defaultBackupDest
+}
+
+// hideBackupDest moves backup.dest to a random directory under backup.hide_root when
+// backup.hide is set and the store is still in the predictable default location. The
+// new path is saved to the config file so later runs and restores find it.
+func hideBackupDest() error {
+	if !viper.GetBool("backup.hide") {
+		return nil
+	}
+	if backupDest() != defaultBackupDest {
+		return nil
+	}
+
+	root := viper.GetString("backup.hide_root")
+	if root == "" {
+		root = "/var/lib"
+	}
+	// Saved for every later run, which may start from another directory
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	dest := filepath.Join(root, "."+hex.EncodeToString(b))
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+
+	viper.Set("backup.dest", dest)
+	if err := viper.WriteConfig(); err != nil {
+		return fmt.Errorf("could not save backup.dest %s to the config: %w", dest, err)
+	}
+	// The config now gives the location away
+	if cfg := viper.ConfigFileUsed(); cfg != "" {
+		os.Chmod(cfg, 0600)
+	}
+	fmt.Println(NewMessage(chalk.Green, "Backups now go to hidden directory "+dest).ThenColor(chalk.White, "(saved as backup.dest)"))
+	if backups, err := listBackups(defaultBackupDest); err == nil && len(backups) > 0 {
+		fmt.Println(NewMessage(chalk.Yellow, fmt.Sprintf("%d older backup(s) are still in %s, move them by hand", len(backups), defaultBackupDest)))
+	}
+	return nil
+}
+
+// backupImmutable reports whether finished backups get the immutable attribute.
+func backupImmutable() bool {
+	return viper.GetBool("backup.immutable")
+}
+
+// protectBackup marks an archive and its manifest immutable (chattr +i) so they can't be
+// changed or deleted until the flag is cleared again, which needs CAP_LINUX_IMMUTABLE.
+func protectBackup(archive string) {
+	if !backupImmutable() {
+		return
+	}
+	for _, f := range []string{archive, manifestPath(archive)} {
+		if _, err := os.Lstat(f); err != nil {
+			continue
+		}
+		if err := setImmutable(f, true); err != nil {
+			fmt.Println(NewMessage(chalk.Yellow, "Could not make "+filepath.Base(f)+" immutable: "+err.Error()))
+			return
+		}
+	}
+}
+
+// unprotectBackup clears the immutable attribute before a backup file is removed.
+func unprotectBackup(path string) error {
+	err := setImmutable(path, false)
+	if os.IsNotExist(err) || errors.Is(err, errImmutableUnsupported) {
+		return nil
+	}
+	return err
+}
+
+// storeFile is what the monitor remembers about a file in the backup store.
+type storeFile struct {
+	Size      int64
+	ModTime   time.Time
+	Mode      os.FileMode
+	Immutable bool
+}
+
+// storeWatch reports anything that touches the backup store: inotify events for opens,
+// writes and attribute changes, plus a comparison of every file against the last check.
+// Files are keyed by their path relative to the store, subdirectories included.
+type storeWatch struct {
+	dir    string
+	files  map[string]*storeFile
+	events <-chan storeEvent
+}
+
+// storeEvent is one inotify event on the backup store. Name is relative to the store,
+// empty for the store directory itself.
+type storeEvent struct {
+	Name string
+	Op   string
+	// A qcd backup run held the backup lock when the event was read
+	DuringBackup bool
+}
+
+// newStoreWatch starts watching the backup store, or returns nil if there isn't one yet.
+func newStoreWatch() *storeWatch {
+	// A relative dest resolves against wherever the monitor was started, which needn't
+	// be where the backups were made, so the wrong directory would look untouched
+	dir := backupDest()
+	if !filepath.IsAbs(dir) {
+		fmt.Println(NewMessage(chalk.Red, "backup.dest "+dir+" is a relative path, not watching the backup store").
+			ThenColor(chalk.White, "(set backup.dest to an absolute path)"))
+		return nil
+	}
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(dir); err != nil {
+		fmt.Println(NewMessage(chalk.Yellow, "No backup store at "+dir+" yet, not watching it"))
+		return nil
+	}
+
+	// Listed before the watch starts, later listings would show up as events
+	w := &storeWatch{dir: dir, files: listStore(dir)}
+
+	var err error
+	w.events, err = watchStore(dir)
+	if err != nil {
+		fmt.Println(NewMessage(chalk.Yellow, "Can't watch the backup store for access ("+err.Error()+"), only checking for changes"))
+	}
+	fmt.Println(NewMessage(chalk.Blue, fmt.Sprintf("Watching backup store %s (%d files).", dir, len(w.files))))
+	return w
+}
+
+// listStore stats everything below dir, keyed by the path relative to dir.
+func listStore(dir string) map[string]*storeFile {
+	files := make(map[string]*storeFile)
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if f := statStoreFile(path); f != nil {
+			files[strings.TrimPrefix(path, dir+string(filepath.Separator))] = f
+		}
+		return nil
+	})
+	return files
+}
+
+func statStoreFile(path string) *storeFile {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	immutable, _ := isImmutable(path)
+	return &storeFile{Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode(), Immutable: immutable}
+}
+
+// check reports what happened to the backup store since the last call.
+func (w *storeWatch) check() {
+	if w == nil {
+		return
+	}
+	// Our own backup runs (and their prune) write and remove files, those are only noted
+	running := backupRunActive()
+	alert := func(ownRun bool) (chalk.Color, string) {
+		if ownRun {
+			return chalk.Blue, " (qcd backup run)"
+		}
+		return chalk.Red, ""
+	}
+
+	touched := make(map[string][]string)
+	ownRun := make(map[string]bool)
+	var names []string
+	for drained := false; !drained; {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				w.events, drained = nil, true
+				continue
+			}
+			if _, seen := touched[ev.Name]; !seen {
+				names = append(names, ev.Name)
+				ownRun[ev.Name] = true
+			}
+			ownRun[ev.Name] = ownRun[ev.Name] && ev.DuringBackup
+			if !slices.Contains(touched[ev.Name], ev.Op) {
+				touched[ev.Name] = append(touched[ev.Name], ev.Op)
+			}
+			if _, known := w.files[ev.Name]; !known && ev.Name != "" {
+				// Compared below like any other file, nil marks it as new
+				w.files[ev.Name] = nil
+			}
+		default:
+			drained = true
+		}
+	}
+	for _, name := range names {
+		target := filepath.Join(w.dir, name)
+		msg := "BACKUP STORE ACCESS: " + target + " " + strings.Join(touched[name], ", ")
+		if pids := openedBy(target); len(pids) > 0 {
+			msg += " by " + strings.Join(pids, ", ")
+		}
+		color, note := alert(ownRun[name])
+		fmt.Println(NewMessage(color, msg+note))
+	}
+
+	if w.events == nil {
+		// No inotify, find new files by listing
+		if _, err := os.ReadDir(w.dir); err != nil {
+			fmt.Println(NewMessage(chalk.Red, "BACKUP STORE UNREADABLE: "+err.Error()))
+		}
+		for name := range listStore(w.dir) {
+			if _, known := w.files[name]; !known {
+				w.files[name] = nil
+			}
+		}
+	}
+
+	current := make([]string, 0, len(w.files))
+	for name := range w.files {
+		current = append(current, name)
+	}
+	sort.Strings(current)
+	for _, name := range current {
+		prev := w.files[name]
+		now := statStoreFile(filepath.Join(w.dir, name))
+		var changes []string
+		switch {
+		case now == nil && prev != nil:
+			changes = append(changes, "removed")
+		case now == nil:
+			// Created and removed between checks, the events above show it
+		case prev == nil:
+			changes = append(changes, "new file")
+		default:
+			// A directory's mtime moves with every file added, those are reported on their own
+			if !now.Mode.IsDir() && (now.Size != prev.Size || !now.ModTime.Equal(prev.ModTime)) {
+				changes = append(changes, "content changed")
+			}
+			if now.Mode != prev.Mode {
+				changes = append(changes, "mode "+prev.Mode.String()+" -> "+now.Mode.String())
+			}
+			if prev.Immutable && !now.Immutable {
+				changes = append(changes, "immutable flag cleared")
+			}
+		}
+		if len(changes) > 0 {
+			own, seen := ownRun[name]
+			color, note := alert((seen && own) || (!seen && running))
+			fmt.Println(NewMessage(color, "BACKUP STORE CHANGED: "+filepath.Join(w.dir, name)+" "+strings.Join(changes, ", ")+note))
+		}
+		if now == nil {
+			delete(w.files, name)
+		} else {
+			w.files[name] = now
+		}
+	}
+}
+
+// backupRunActive reports whether a qcd backup run is in progress or has only just
+// finished, so its writes may still be arriving as events.
+func backupRunActive() bool {
+	if backupLockHeld() {
+		return true
+	}
+	var run backupRunStatus
+	if err := readStateJSON(statusFileName, &run); err != nil {
+		return false
+	}
+	return time.Since(run.Finished) < time.Second
+}
+
+// openedBy lists the processes ("pid (command)") that have path open.
+func openedBy(path string) []string {
+	var pids []string
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	for _, p := range procs {
+		if !isNumeric(p.Name()) || p.Name() == fmt.Sprint(os.Getpid()) {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == path {
+				comm, _ := os.ReadFile(filepath.Join("/proc", p.Name(), "comm"))
+				pids = append(pids, p.Name()+" ("+strings.TrimSpace(string(comm))+")")
+				break
+			}
+		}
+	}
+	return pids
+}
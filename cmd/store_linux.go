@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FS_IMMUTABLE_FL from linux/fs.h, the flag chattr +i sets
+const fsImmutableFlag = 0x00000010
+
+// setImmutable sets or clears the immutable attribute of path.
+func setImmutable(path string, on bool) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.ENOTSUP) {
+			return errImmutableUnsupported
+		}
+		return err
+	}
+	want := flags &^ fsImmutableFlag
+	if on {
+		want |= fsImmutableFlag
+	}
+	if want == flags {
+		return nil
+	}
+	// The kernel reads an int, not the long the ioctl number suggests
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_SETFLAGS, uintptr(unsafe.Pointer(&want))); errno != 0 {
+		if errno == unix.ENOTTY || errno == unix.EOPNOTSUPP {
+			return errImmutableUnsupported
+		}
+		return errno
+	}
+	return nil
+}
+
+// isImmutable reports whether path has the immutable attribute. It uses statx rather than
+// opening the file, so checking doesn't show up as an access to the store.
+func isImmutable(path string) (bool, error) {
+	var st unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, 0, &st); err != nil {
+		return false, err
+	}
+	return st.Attributes&unix.STATX_ATTR_IMMUTABLE != 0, nil
+}
+
+// watchStore streams inotify events for dir and every directory below it until dir
+// goes away. Directories created later are watched as they appear.
+func watchStore(dir string) (<-chan storeEvent, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(unix.IN_OPEN | unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CREATE | unix.IN_DELETE |
+		unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF)
+
+	// Watch descriptor to directory, relative to the store
+	dirs := make(map[int]string)
+	addWatch := func(rel string) error {
+		wd, err := unix.InotifyAddWatch(fd, filepath.Join(dir, rel), mask)
+		if err == nil {
+			dirs[wd] = rel
+		}
+		return err
+	}
+	// Collected before any watch is added, listing a watched directory is an event
+	var subdirs []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != dir {
+			subdirs = append(subdirs, strings.TrimPrefix(path, dir+string(filepath.Separator)))
+		}
+		return nil
+	})
+	if err := addWatch(""); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	for _, rel := range subdirs {
+		addWatch(rel)
+	}
+
+	events := make(chan storeEvent, 1024)
+	send := func(ev storeEvent) {
+		select {
+		case events <- ev:
+		default:
+			// The monitor is behind, the file comparison still catches changes
+		}
+	}
+	go func() {
+		defer close(events)
+		defer unix.Close(fd)
+		// Directories the watcher listed itself, their next open event is ours
+		ownListing := make(map[string]int)
+		// watchNew watches a directory that just appeared and reports what was put in it
+		// before the watch was in place
+		var watchNew func(rel string, running bool)
+		watchNew = func(rel string, running bool) {
+			entries, err := os.ReadDir(filepath.Join(dir, rel))
+			if err == nil {
+				ownListing[rel]++
+			}
+			if addWatch(rel) != nil {
+				return
+			}
+			for _, e := range entries {
+				child := filepath.Join(rel, e.Name())
+				send(storeEvent{Name: child, Op: "created", DuringBackup: running})
+				if e.IsDir() {
+					watchNew(child, running)
+				}
+			}
+		}
+
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := unix.Read(fd, buf)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				return
+			}
+			running := backupRunActive()
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+				name := strings.TrimRight(string(nameBytes), "\x00")
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+
+				parent, ok := dirs[int(ev.Wd)]
+				if !ok {
+					continue
+				}
+				if ev.Mask&unix.IN_IGNORED != 0 {
+					delete(dirs, int(ev.Wd))
+					if parent == "" {
+						return
+					}
+					continue
+				}
+				if parent != "" && ev.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+					// Reported by the parent directory's watch
+					continue
+				}
+				if name != "" {
+					name = filepath.Join(parent, name)
+				} else {
+					name = parent
+				}
+				if ev.Mask&(unix.IN_OPEN|unix.IN_ISDIR) == unix.IN_OPEN|unix.IN_ISDIR && ownListing[name] > 0 {
+					ownListing[name]--
+					continue
+				}
+
+				op := inotifyOp(ev.Mask)
+				if op == "" {
+					continue
+				}
+				send(storeEvent{Name: name, Op: op, DuringBackup: running})
+				if ev.Mask&unix.IN_ISDIR != 0 && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					watchNew(name, running)
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+func inotifyOp(mask uint32) string {
+	switch {
+	case mask&unix.IN_DELETE_SELF != 0:
+		return "store deleted"
+	case mask&unix.IN_MOVE_SELF != 0:
+		return "store moved"
+	case mask&unix.IN_OPEN != 0 && mask&unix.IN_ISDIR != 0:
+		return "listed"
+	case mask&unix.IN_OPEN != 0:
+		return "opened"
+	case mask&unix.IN_MODIFY != 0:
+		return "written"
+	case mask&unix.IN_ATTRIB != 0:
+		return "attributes changed"
+	case mask&unix.IN_CREATE != 0:
+		return "created"
+	case mask&unix.IN_DELETE != 0:
+		return "deleted"
+	case mask&unix.IN_MOVED_FROM != 0:
+		return "renamed away"
+	case mask&unix.IN_MOVED_TO != 0:
+		return "renamed into place"
+	}
+	return ""
+}
+
+// backupLockHeld reports whether a backup run holds the backup lock. It reads
+// /proc/locks instead of trying the lock, which could make a starting backup fail.
+func backupLockHeld() bool {
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join(qcdStateDir(), "backup.lock"), &st); err != nil {
+		return false
+	}
+	id := fmt.Sprintf("%02x:%02x:%d", unix.Major(st.Dev), unix.Minor(st.Dev), st.Ino)
+
+	f, err := os.Open("/proc/locks")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 1: FLOCK  ADVISORY  WRITE 1234 08:01:131090 0 EOF
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 6 && fields[1] == "FLOCK" && fields[5] == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchStoreSeesSubdirectories(t *testing.T) {
+	useConfig(t, nil)
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	events, err := watchStore(dir)
+	if err != nil {
+		t.Skipf("inotify unavailable: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "old", "a"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "new", "deeper"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Give the watcher time to pick up the new directories
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "new", "deeper", "b"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"old/a": false, "new/deeper": false, "new/deeper/b": false}
+	timeout := time.After(5 * time.Second)
+	for missing := len(want); missing > 0; {
+		select {
+		case ev := <-events:
+			if ev.Name == "new" && ev.Op == "listed" {
+				t.Errorf("the watcher reported its own listing of %s", ev.Name)
+			}
+			if seen, ok := want[ev.Name]; ok && !seen {
+				want[ev.Name] = true
+				missing--
+			}
+		case <-timeout:
+			t.Fatalf("no events for %v", want)
+		}
+	}
+}
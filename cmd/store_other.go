@@ -0,0 +1,24 @@
+//go:build !linux
+
+package cmd
+
+import "errors"
+
+// The immutable attribute and inotify are Linux only. Elsewhere the monitor falls back
+// to comparing the store's files on every check.
+
+func setImmutable(path string, on bool) error {
+	return errImmutableUnsupported
+}
+
+func isImmutable(path string) (bool, error) {
+	return false, nil
+}
+
+func watchStore(dir string) (<-chan storeEvent, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
+
+func backupLockHeld() bool {
+	return false
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestHideBackupDestIsAbsolute(t *testing.T) {
+	useConfig(t, map[string]interface{}{"backup.hide": true, "backup.hide_root": "hidden"})
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "qcd.yaml")
+	if err := os.WriteFile(cfg, []byte("backup:\n  hide: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(cfg)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := hideBackupDest(); err != nil {
+		t.Fatal(err)
+	}
+	dest := backupDest()
+	if !filepath.IsAbs(dest) || filepath.Dir(dest) != filepath.Join(dir, "hidden") {
+		t.Fatalf("backup.dest = %q, want an absolute path under %s", dest, filepath.Join(dir, "hidden"))
+	}
+	if info, err := os.Stat(dest); err != nil || !info.IsDir() {
+		t.Fatalf("hidden store not created: %v", err)
+	}
+}
+
+func TestStoreWatchRefusesRelativeDest(t *testing.T) {
+	useConfig(t, map[string]interface{}{"backup.dest": "backups"})
+	if w := newStoreWatch(); w != nil {
+		t.Errorf("watching relative backup.dest %s", w.dir)
+	}
+}
+
+func TestListStoreIncludesSubdirectories(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "replicas", "web"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bak_20240102_030405.tar.gz", "replicas/web/bak_20240102_030405.tar.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := listStore(dir)
+	for _, want := range []string{"bak_20240102_030405.tar.gz", "replicas", "replicas/web", "replicas/web/bak_20240102_030405.tar.gz"} {
+		if files[want] == nil {
+			t.Errorf("listStore is missing %s", want)
+		}
+	}
+	if len(files) != 4 {
+		t.Errorf("listStore found %d entries, want 4", len(files))
+	}
+}
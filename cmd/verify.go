@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/ttacon/chalk"
+)
+
+var verifyAllowUnsigned bool
+
+var backupVerifyCmd = &cobra.Command{
+	Use:   "verify [<archive>...]",
+	Short: "Verify backup archives against their manifests",
+	Long: `Recomputes the SHA-256 of each backup archive and every file inside it, and compares them with the manifest written at backup time to detect truncation or tampering. Incremental backups also check that the earlier archives they depend on are present. Verifies every backup in backup.dest when no archive is given.
+Manifests are signed with the key in backup.manifest_key_file (default manifest.key in state_dir), so an archive whose manifest is missing, unsigned or signed with another key fails. --allow-unsigned accepts archives from before manifests were signed, only checking that they read end to end.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var archives []string
+		for _, arg := range args {
+			archive, err := resolveBackup(arg)
+			if CheckError(err) {
+				os.Exit(1)
+			}
+			archives = append(archives, archive)
+		}
+		if len(args) == 0 {
+			backups, err := listBackups(backupDest())
+			if CheckError(err) {
+				os.Exit(1)
+			}
+			for _, b := range backups {
+				archives = append(archives, b.Path)
+			}
+		}
+		if len(archives) == 0 {
+			fmt.Println(NewMessage(chalk.Yellow, "No backups to verify"))
+			return
+		}
+
+		failed := 0
+		for _, archive := range archives {
+			result := verifyArchive(archive, verifyAllowUnsigned)
+			switch {
+			case len(result.Problems) > 0:
+				failed++
+				fmt.Println(NewMessage(chalk.Red, "FAILED").ThenColor(chalk.White, archive))
+				for _, p := range result.Problems {
+					fmt.Println(" - " + p)
+				}
+			case !result.HasManifest:
+				fmt.Println(NewMessage(chalk.Yellow, "UNVERIFIED").ThenColor(chalk.White, archive).
+					ThenColor(chalk.Yellow, fmt.Sprintf("(no manifest, %d entries readable)", result.Entries)))
+			default:
+				fmt.Println(NewMessage(chalk.Green, "OK").ThenColor(chalk.White, archive).
+					ThenColor(chalk.Green, fmt.Sprintf("(%d entries)", result.Entries)))
+			}
+		}
+
+		if failed > 0 {
+			fmt.Println(NewMessage(chalk.Red, fmt.Sprintf("%d of %d backup(s) failed verification", failed, len(archives))))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupVerifyCmd)
+	backupVerifyCmd.Flags().BoolVar(&verifyAllowUnsigned, "allow-unsigned", false, "Don't fail archives with a missing or unsigned manifest")
+}
+
+type verifyResult struct {
+	HasManifest bool
+	Entries     int
+	Problems    []string
+}
+
+// verifyArchive checks an archive against its manifest. A missing or unsigned manifest
+// is a problem unless allowUnsigned, in which case the archive is only checked to be
+// readable end to end.
+func verifyArchive(archive string, allowUnsigned bool) verifyResult {
+	var result verifyResult
+	problem := func(format string, args ...interface{}) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+	}
+
+	m, err := readManifest(archive)
+	switch {
+	case os.IsNotExist(err):
+		if !allowUnsigned {
+			problem("manifest %s is missing", manifestPath(archive))
+		}
+	case err != nil:
+		problem("%v", err)
+	case m.MAC == "" && allowUnsigned:
+		// Written before manifests were signed, checked against as far as it goes
+	default:
+		key, err := manifestKey(false)
+		if err != nil {
+			problem("can't check the manifest signature: %v", err)
+		} else if err := checkManifestMAC(m, key); err != nil {
+			problem("%v", err)
+		}
+	}
+	expected := make(map[string]manifestEntry)
+	checkedChain := make(map[string]bool)
+	if m != nil {
+		result.HasManifest = true
+		for _, e := range m.Entries {
+			if e.Archive == "" {
+				expected[e.Path] = e
+				continue
+			}
+			// Content carried over from an earlier archive of an incremental chain
+			if checkedChain[e.Archive] {
+				continue
+			}
+			checkedChain[e.Archive] = true
+			if _, err := os.Stat(filepath.Join(filepath.Dir(archive), e.Archive)); err != nil {
+				problem("backup chain is broken, %s is missing", e.Archive)
+			}
+		}
+
+		sum, size, err := hashFile(archive)
+		switch {
+		case err != nil:
+			problem("could not read archive: %v", err)
+		case size < m.ArchiveSize:
+			problem("archive is truncated: %d of %d bytes", size, m.ArchiveSize)
+		case size != m.ArchiveSize || sum != m.ArchiveSHA256:
+			problem("archive SHA-256 %s does not match manifest %s", sum, m.ArchiveSHA256)
+		}
+	}
+
+	err = walkArchive(archive, func(hdr *tar.Header, r io.Reader) error {
+		result.Entries++
+		actual := newManifestEntry(hdr)
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			actual.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+
+		if m == nil {
+			return nil
+		}
+		want, ok := expected[actual.Path]
+		if !ok {
+			problem("%s: not in manifest", actual.Path)
+			return nil
+		}
+		delete(expected, actual.Path)
+		for _, diff := range compareEntries(want, actual) {
+			problem("%s: %s", actual.Path, diff)
+		}
+		return nil
+	})
+	if err != nil {
+		problem("archive is corrupt or truncated: %v", err)
+	}
+
+	if m != nil {
+		for _, e := range m.Entries {
+			if _, missing := expected[e.Path]; missing {
+				problem("%s: missing from archive", e.Path)
+			}
+		}
+	}
+	return result
+}
+
+// compareEntries lists the differences between two manifest entries for the same path.
+func compareEntries(want, got manifestEntry) []string {
+	var diffs []string
+	if want.Type != got.Type {
+		diffs = append(diffs, fmt.Sprintf("type %s, expected %s", got.Type, want.Type))
+	}
+	if want.Size != got.Size {
+		diffs = append(diffs, fmt.Sprintf("size %d, expected %d", got.Size, want.Size))
+	}
+	if want.Mode != got.Mode {
+		diffs = append(diffs, fmt.Sprintf("mode %s, expected %s", got.Mode, want.Mode))
+	}
+	if want.UID != got.UID || want.GID != got.GID {
+		diffs = append(diffs, fmt.Sprintf("owner %d:%d, expected %d:%d", got.UID, got.GID, want.UID, want.GID))
+	}
+	if want.Link != got.Link {
+		diffs = append(diffs, fmt.Sprintf("link %q, expected %q", got.Link, want.Link))
+	}
+	if want.SHA256 != got.SHA256 {
+		diffs = append(diffs, "content hash mismatch")
+	}
+	diffs = append(diffs, xattrChanges(want.Xattrs, got.Xattrs)...)
+	return diffs
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestBackup archives a small tree into dest and writes its signed manifest.
+func writeTestBackup(t *testing.T, dest string) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "etc")
+	if err := os.MkdirAll(filepath.Join(src, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "app", "conf"), []byte("a=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dest, fullBackupPrefix+"20240102_030405.tar.gz")
+	stats, err := writeArchive(archive, []string{src}, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(stats.Manifest, manifestPath(archive)); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestVerifyArchive(t *testing.T) {
+	tests := []struct {
+		name          string
+		tamper        func(t *testing.T, archive string)
+		allowUnsigned bool
+		problem       string
+	}{
+		{name: "intact"},
+		{
+			name:    "missing manifest",
+			tamper:  func(t *testing.T, archive string) { os.Remove(manifestPath(archive)) },
+			problem: "is missing",
+		},
+		{
+			name:          "missing manifest allowed",
+			tamper:        func(t *testing.T, archive string) { os.Remove(manifestPath(archive)) },
+			allowUnsigned: true,
+		},
+		{
+			name:    "unsigned manifest",
+			tamper:  func(t *testing.T, archive string) { editManifest(t, archive, func(m *backupManifest) { m.MAC = "" }) },
+			problem: "no MAC",
+		},
+		{
+			name: "regenerated manifest",
+			tamper: func(t *testing.T, archive string) {
+				editManifest(t, archive, func(m *backupManifest) { m.Entries[0].Mode = "4755" })
+			},
+			problem: "MAC does not match",
+		},
+		{
+			name: "signed with another key",
+			tamper: func(t *testing.T, archive string) {
+				os.Remove(manifestKeyPath())
+				if _, err := manifestKey(true); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: "MAC does not match",
+		},
+		{
+			name: "modified archive",
+			tamper: func(t *testing.T, archive string) {
+				f, err := os.OpenFile(archive, os.O_APPEND|os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Write([]byte("junk"))
+				f.Close()
+			},
+			problem: "does not match manifest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			archive := writeTestBackup(t, t.TempDir())
+			if tt.tamper != nil {
+				tt.tamper(t, archive)
+			}
+
+			result := verifyArchive(archive, tt.allowUnsigned)
+			problems := strings.Join(result.Problems, "\n")
+			if tt.problem == "" && problems != "" {
+				t.Fatalf("unexpected problems:\n%s", problems)
+			}
+			if tt.problem != "" && !strings.Contains(problems, tt.problem) {
+				t.Fatalf("problems %q don't mention %q", problems, tt.problem)
+			}
+		})
+	}
+}
+
+// editManifest rewrites the manifest of archive after passing it through edit, keeping
+// the old MAC unless edit changes it.
+func editManifest(t *testing.T, archive string, edit func(m *backupManifest)) {
+	t.Helper()
+	data, err := os.ReadFile(manifestPath(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m backupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	edit(&m)
+	data, err = json.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifestPath(archive), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
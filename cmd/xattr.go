@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// PAX record prefix GNU tar and bsdtar use for extended attributes
+const xattrPAXPrefix = "SCHILY.xattr."
+
+var errXattrUnsupported = errors.New("extended attributes are not supported here")
+
+type xattrError struct {
+	Name string
+	Err  error
+}
+
+func (e *xattrError) Error() string {
+	return "xattr " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *xattrError) Unwrap() error {
+	return e.Err
+}
+
+// backupXattrs reports whether backups should capture extended attributes
+// (backup.xattrs, on unless disabled).
+func backupXattrs() bool {
+	return !viper.IsSet("backup.xattrs") || viper.GetBool("backup.xattrs")
+}
+
+// headerXattrs returns the extended attributes recorded in hdr's PAX records.
+func headerXattrs(hdr *tar.Header) map[string][]byte {
+	var attrs map[string][]byte
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, xattrPAXPrefix); ok {
+			if attrs == nil {
+				attrs = make(map[string][]byte)
+			}
+			attrs[name] = []byte(value)
+		}
+	}
+	return attrs
+}
+
+// setHeaderXattrs replaces the extended attribute PAX records of hdr with attrs.
+func setHeaderXattrs(hdr *tar.Header, attrs map[string][]byte) {
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, xattrPAXPrefix) {
+			delete(hdr.PAXRecords, key)
+		}
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string, len(attrs))
+	}
+	for name, value := range attrs {
+		hdr.PAXRecords[xattrPAXPrefix+name] = string(value)
+	}
+}
+
+// xattrChanges describes how the extended attributes got differ from want, e.g.
+// "xattr security.capability added".
+func xattrChanges(want, got map[string][]byte) []string {
+	var changes []string
+	for name, value := range got {
+		if old, ok := want[name]; !ok {
+			changes = append(changes, "xattr "+name+" added")
+		} else if !bytes.Equal(old, value) {
+			changes = append(changes, "xattr "+name+" changed")
+		}
+	}
+	for name := range want {
+		if _, ok := got[name]; !ok {
+			changes = append(changes, "xattr "+name+" removed")
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
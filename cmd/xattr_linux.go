@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const xattrsSupported = true
+
+// readXattrs returns the extended attributes of path without following symlinks. This
+// covers POSIX ACLs (system.posix_acl_*), SELinux labels (security.selinux) and file
+// capabilities (security.capability). Filesystems without xattr support yield nothing.
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := listXattrs(path)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range names {
+		value, err := lgetxattr(path, name)
+		if errors.Is(err, unix.ENODATA) {
+			// Removed while we were looking
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// listXattrs returns the names of path's extended attributes without following symlinks.
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			if errors.Is(err, unix.ENOTSUP) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// Grew since the size check
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range strings.Split(string(buf[:size]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+func lgetxattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// Grew since the size check
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// writeXattrs sets attrs on path without following symlinks. With prune, attributes on
+// path that attrs doesn't have are removed first, so a capability or ACL added since the
+// backup doesn't survive the restore. The SELinux label is left alone unless attrs has
+// one, it belongs to the local policy. File capabilities are cleared by chown, so this has
+// to run after ownership is restored.
+func writeXattrs(path string, attrs map[string][]byte, prune bool) error {
+	var errs []error
+	if prune {
+		live, err := listXattrs(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range live {
+			if _, ok := attrs[name]; ok || name == "security.selinux" {
+				continue
+			}
+			if err := unix.Lremovexattr(path, name); err != nil && !errors.Is(err, unix.ENODATA) {
+				errs = append(errs, &xattrError{Name: name, Err: err})
+			}
+		}
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := unix.Lsetxattr(path, name, attrs[name], 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) {
+				return errXattrUnsupported
+			}
+			errs = append(errs, &xattrError{Name: name, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
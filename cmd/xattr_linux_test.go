@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// requireUserXattrs skips the test when dir's filesystem has no user xattrs.
+func requireUserXattrs(t *testing.T, dir string) {
+	t.Helper()
+	probe := filepath.Join(dir, ".probe")
+	if err := os.WriteFile(probe, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(probe)
+	if err := unix.Lsetxattr(probe, "user.probe", []byte("1"), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+			t.Skip("no user xattrs on this filesystem")
+		}
+		t.Fatal(err)
+	}
+}
+
+func TestWriteXattrsPrune(t *testing.T) {
+	dir := t.TempDir()
+	requireUserXattrs(t, dir)
+
+	tests := []struct {
+		name  string
+		prune bool
+		want  []string
+	}{
+		{name: "additive", prune: false, want: []string{"user.added", "user.kept"}},
+		{name: "prune", prune: true, want: []string{"user.kept"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := unix.Lsetxattr(path, "user.added", []byte("evil"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeXattrs(path, map[string][]byte{"user.kept": []byte("v")}, tt.prune); err != nil {
+				t.Fatal(err)
+			}
+			names, err := listXattrs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var user []string
+			for _, n := range names {
+				if strings.HasPrefix(n, "user.") {
+					user = append(user, n)
+				}
+			}
+			if strings.Join(user, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("xattrs %v, want %v", user, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreRemovesAddedXattrs(t *testing.T) {
+	src := t.TempDir()
+	requireUserXattrs(t, src)
+	useConfig(t, nil)
+
+	file := filepath.Join(src, "tool")
+	if err := os.WriteFile(file, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(file, "user.label", []byte("good"), 0); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), fullBackupPrefix+"20240102_030405.tar.gz")
+	stats, err := writeArchive(archive, []string{src}, archiveOptions{Xattrs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(stats.Manifest, manifestPath(archive)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tampered after the backup
+	if err := unix.Lsetxattr(file, "user.backdoor", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(file, "user.label", []byte("changed"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &restorer{root: "/", patterns: restorePatterns([]string{file}), assumeYes: true, in: bufio.NewReader(strings.NewReader(""))}
+	if err := r.restore(archive); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := readXattrs(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := attrs["user.backdoor"]; ok {
+		t.Errorf("xattr added after the backup survived the restore")
+	}
+	if string(attrs["user.label"]) != "good" {
+		t.Errorf("user.label = %q, want good", attrs["user.label"])
+	}
+}
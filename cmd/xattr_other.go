@@ -0,0 +1,18 @@
+//go:build !linux
+
+package cmd
+
+// Extended attributes are only backed up on Linux.
+
+const xattrsSupported = false
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(path string, attrs map[string][]byte, prune bool) error {
+	if len(attrs) > 0 {
+		return errXattrUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestXattrChanges(t *testing.T) {
+	acl := []byte("acl")
+	tests := []struct {
+		name      string
+		want, got map[string][]byte
+		changes   []string
+	}{
+		{name: "both empty"},
+		{name: "nil and empty", want: map[string][]byte{}},
+		{name: "same", want: map[string][]byte{"system.posix_acl_access": acl}, got: map[string][]byte{"system.posix_acl_access": acl}},
+		{name: "added", got: map[string][]byte{"security.capability": []byte("cap")}, changes: []string{"xattr security.capability added"}},
+		{name: "removed", want: map[string][]byte{"user.a": acl}, changes: []string{"xattr user.a removed"}},
+		{
+			name:    "changed and added",
+			want:    map[string][]byte{"user.a": acl},
+			got:     map[string][]byte{"user.a": []byte("other"), "user.b": nil},
+			changes: []string{"xattr user.a changed", "xattr user.b added"},
+		},
+	}
+	for _, tt := range tests {
+		if got := xattrChanges(tt.want, tt.got); !slices.Equal(got, tt.changes) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.changes)
+		}
+	}
+}
+
+func TestCompareEntries(t *testing.T) {
+	base := manifestEntry{Path: "/usr/bin/ping", Type: "file", Size: 10, Mode: "0755", SHA256: "aa"}
+	tests := []struct {
+		name  string
+		edit  func(e *manifestEntry)
+		diffs []string
+	}{
+		{name: "same", edit: func(e *manifestEntry) {}},
+		{name: "mode", edit: func(e *manifestEntry) { e.Mode = "4755" }, diffs: []string{"mode 4755, expected 0755"}},
+		{name: "owner", edit: func(e *manifestEntry) { e.UID = 1000 }, diffs: []string{"owner 1000:0, expected 0:0"}},
+		{name: "content", edit: func(e *manifestEntry) { e.SHA256 = "bb" }, diffs: []string{"content hash mismatch"}},
+		{
+			name:  "capability",
+			edit:  func(e *manifestEntry) { e.Xattrs = map[string][]byte{"security.capability": []byte("cap")} },
+			diffs: []string{"xattr security.capability added"},
+		},
+	}
+	for _, tt := range tests {
+		got := base
+		tt.edit(&got)
+		if diffs := compareEntries(base, got); !slices.Equal(diffs, tt.diffs) {
+			t.Errorf("%s: got %q, want %q", tt.name, diffs, tt.diffs)
+		}
+	}
+}